@@ -2,7 +2,11 @@ package main
 
 import (
 	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/controllers"
 	"agnos-hospital-middleware/routes"
+	"agnos-hospital-middleware/utils"
+	"log"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -10,9 +14,30 @@ func main() {
 	// Initialize DB
 	config.InitDB()
 
+	// Add records stored before the master patient index to it
+	if err := controllers.IndexUnlinkedPatients(); err != nil {
+		log.Print("Failed to index patients: ", err)
+	}
+
+	// Load JWT signing keys, fail fast on a bad key configuration
+	if err := utils.LoadSigningKeys(); err != nil {
+		log.Fatal("Failed to load signing keys: ", err)
+	}
+	if err := utils.LoadPasswordHasher(); err != nil {
+		log.Fatal("Failed to configure password hashing: ", err)
+	}
+	if err := utils.LoadPasswordPolicy(); err != nil {
+		log.Fatal("Failed to load password policy: ", err)
+	}
+
 	// Start Gin router
 	r := gin.Default()
 
+	// Believe X-Forwarded-For only from our own proxies, logins are throttled per client IP
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+
 	// Set up routes
 	routes.SetupRoutes(r)
 
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/names"
+	"agnos-hospital-middleware/validation"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -29,5 +32,152 @@ func InitDB() {
 
 	fmt.Println("DB connected!")
 
-	DB.AutoMigrate(&models.Hospital{}, &models.Staff{}, &models.Patient{})
+	if err := Migrate(DB); err != nil {
+		log.Fatal("Failed to migrate database: ", err)
+	}
+}
+
+func Migrate(db *gorm.DB) error {
+	if err := backfillHospitalCodes(db); err != nil {
+		return err
+	}
+	err := db.AutoMigrate(
+		&models.Hospital{},
+		&models.Staff{},
+		&models.Patient{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.AuditEvent{},
+		&models.MFARecoveryCode{},
+		&models.PasswordHistory{},
+		&models.PasswordResetToken{},
+		&models.StaffHospitalAccess{},
+		&models.NegativeLookup{},
+		&models.EnterprisePatient{},
+		&models.MatchReview{},
+	)
+	if err != nil {
+		return err
+	}
+	if err := migrateDatesOfBirth(db); err != nil {
+		return err
+	}
+	if err := backfillPatientTimestamps(db); err != nil {
+		return err
+	}
+	enableTrigrams(db)
+	return backfillMatchingKeys(db)
+}
+
+// enableTrigrams installs pg_trgm, which fuzzy name search uses on Postgres
+// when the database user may install it. Without it names are compared in
+// process.
+func enableTrigrams(db *gorm.DB) {
+	if db.Dialector.Name() != "postgres" {
+		return
+	}
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("pg_trgm unavailable, fuzzy name search runs in process: %v", err)
+	}
+}
+
+// matchingKeyColumns are derived from the names, phone number and email of a
+// patient. They are NULL only in rows stored before the column existed.
+var matchingKeyColumns = []string{
+	"first_name_rtgs", "middle_name_rtgs", "last_name_rtgs",
+	"first_name_soundex", "middle_name_soundex", "last_name_soundex",
+	"phone_e164", "email_normalized",
+}
+
+// withoutMatchingKeys selects the patients whose matching keys were never
+// derived.
+func withoutMatchingKeys(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Patient{}).Where(strings.Join(matchingKeyColumns, " IS NULL OR ") + " IS NULL")
+}
+
+// backfillMatchingKeys derives the name, phone and email matching keys of
+// patients stored before they existed. Originals that cannot be read keep an
+// empty key, so they are not tried again on the next start.
+func backfillMatchingKeys(db *gorm.DB) error {
+	var patients []models.Patient
+	err := withoutMatchingKeys(db).Select("id, first_name_th, middle_name_th, last_name_th, first_name_en, middle_name_en, last_name_en, phone_number, email").
+		Find(&patients).Error
+	if err != nil {
+		return err
+	}
+	for _, patient := range patients {
+		phone, _ := validation.PhoneE164(patient.PhoneNumber, PhoneDefaultRegion)
+		email, _ := validation.NormalizeEmail(patient.Email)
+		err := db.Model(&models.Patient{}).Where("id = ?", patient.ID).Updates(map[string]any{
+			"first_name_rtgs":     names.Key(patient.FirstNameTH),
+			"middle_name_rtgs":    names.Key(patient.MiddleNameTH),
+			"last_name_rtgs":      names.Key(patient.LastNameTH),
+			"first_name_soundex":  names.Soundex(patient.FirstNameEN),
+			"middle_name_soundex": names.Soundex(patient.MiddleNameEN),
+			"last_name_soundex":   names.Soundex(patient.LastNameEN),
+			"phone_e164":          phone,
+			"email_normalized":    email,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillPatientTimestamps dates patients stored before they had
+// timestamps by when they were fetched, or as of the migration.
+func backfillPatientTimestamps(db *gorm.DB) error {
+	for _, column := range []string{"created_at", "updated_at"} {
+		err := db.Table("patients").Where(column + " IS NULL").
+			UpdateColumn(column, gorm.Expr("COALESCE(fetched_at, CURRENT_TIMESTAMP)")).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDatesOfBirth moves the free-form dates of birth stored before dates
+// were typed into the date and precision columns, then drops the old column.
+// Dates that cannot be read are logged and left unknown.
+func migrateDatesOfBirth(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasColumn(&models.Patient{}, "date_of_birth") {
+		return nil
+	}
+	var rows []struct {
+		ID          uint
+		DateOfBirth string
+	}
+	if err := db.Table("patients").Select("id, date_of_birth").Where("date_of_birth IS NOT NULL AND date_of_birth <> ''").Scan(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		date, err := validation.ParseDate(row.DateOfBirth)
+		if err != nil {
+			log.Printf("patient %d: unreadable date of birth %q left unknown", row.ID, row.DateOfBirth)
+			continue
+		}
+		err = db.Table("patients").Where("id = ?", row.ID).
+			Updates(map[string]any{"date_of_birth_value": date.Value, "date_of_birth_precision": date.Precision}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return migrator.DropColumn(&models.Patient{}, "date_of_birth")
+}
+
+// backfillHospitalCodes gives hospitals created before codes existed a unique
+// placeholder code, so the unique index can be created. Administrators should
+// replace it with the real code.
+func backfillHospitalCodes(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.Hospital{}) || migrator.HasColumn(&models.Hospital{}, "Code") {
+		return nil
+	}
+	if err := db.Exec("ALTER TABLE hospitals ADD COLUMN code varchar(32)").Error; err != nil {
+		return err
+	}
+	return db.Exec("UPDATE hospitals SET code = 'HOSP-' || id WHERE code IS NULL").Error
 }
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"agnos-hospital-middleware/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrate_TypesDatesOfBirth(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	//a patients table from before dates of birth were typed
+	require.NoError(t, db.Exec("CREATE TABLE `patients` (`id` integer PRIMARY KEY, `first_name_en` text, `date_of_birth` text, `hospital_id` integer)").Error)
+	require.NoError(t, db.Exec("INSERT INTO patients (id, first_name_en, date_of_birth, hospital_id) VALUES (1, 'A', '12/04/2528', 1), (2, 'B', '1985', 1), (3, 'C', 'unknown', 1), (4, 'D', '', 1)").Error)
+
+	require.NoError(t, Migrate(db))
+	assert.False(t, db.Migrator().HasColumn(&models.Patient{}, "date_of_birth"))
+
+	var patients []models.Patient
+	require.NoError(t, db.Order("id").Find(&patients).Error)
+	require.Len(t, patients, 4)
+	assert.Equal(t, "1985-04-12", patients[0].DateOfBirth.String())
+	assert.Equal(t, models.DatePrecisionYear, patients[1].DateOfBirth.Precision)
+	assert.True(t, patients[2].DateOfBirth.IsZero())
+	assert.True(t, patients[3].DateOfBirth.IsZero())
+
+	//migrating again is a no-op
+	require.NoError(t, Migrate(db))
+}
+
+func TestMigrate_BackfillsMatchingKeys(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	//patients stored before names, phone numbers and emails had matching keys
+	require.NoError(t, db.Exec("CREATE TABLE `patients` (`id` integer PRIMARY KEY, `first_name_th` text, `phone_number` text, `email` text, `hospital_id` integer)").Error)
+	require.NoError(t, db.Exec("INSERT INTO patients (id, first_name_th, phone_number, email, hospital_id) VALUES (1, 'สมชาย', '081-234-5678', 'A@Example.com', 1), (2, '', 'call me', '', 1)").Error)
+
+	require.NoError(t, Migrate(db))
+
+	var patients []models.Patient
+	require.NoError(t, db.Order("id").Find(&patients).Error)
+	require.Len(t, patients, 2)
+	assert.Equal(t, "081-234-5678", patients[0].PhoneNumber)
+	assert.Equal(t, "+66812345678", patients[0].PhoneE164)
+	assert.Equal(t, "a@example.com", patients[0].EmailNormalized)
+	assert.Equal(t, "somchai", patients[0].FirstNameRTGS)
+	assert.Equal(t, "", patients[1].PhoneE164)
+	assert.False(t, patients[1].UpdatedAt.IsZero(), "dated as of the migration")
+
+	//a phone number that cannot be read is not tried again on the next start
+	var pending int64
+	require.NoError(t, withoutMatchingKeys(db).Count(&pending).Error)
+	assert.Zero(t, pending)
+}
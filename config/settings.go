@@ -0,0 +1,216 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BootstrapToken guards the one-time creation of the first administrator.
+// Bootstrap is disabled when it is empty.
+var BootstrapToken = os.Getenv("BOOTSTRAP_TOKEN")
+
+// MetricsToken is the bearer token /metrics must be scraped with. The
+// endpoint is disabled when it is empty.
+var MetricsToken = os.Getenv("METRICS_TOKEN")
+
+// JWTKeysFile points to a JSON key list (see utils.LoadKeySetFile). When it
+// is empty JWTSecret is used as a single HS256 key.
+var (
+	JWTKeysFile = os.Getenv("JWT_KEYS_FILE")
+	JWTSecret   = os.Getenv("JWT_SECRET")
+)
+
+var (
+	AccessTokenTTL  = getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	RefreshTokenTTL = getEnvDuration("REFRESH_TOKEN_TTL", 7*24*time.Hour)
+)
+
+// MFAIssuer is the account issuer shown in authenticator apps.
+var (
+	MFAIssuer       = getEnv("MFA_ISSUER", "Hospital Middleware")
+	MFAChallengeTTL = getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+)
+
+// Password policy. PasswordHistory is how many previous passwords, the
+// current one included, a new password may not repeat.
+var (
+	PasswordMinLength     = getEnvInt("PASSWORD_MIN_LENGTH", 12)
+	PasswordRequireUpper  = getEnvBool("PASSWORD_REQUIRE_UPPER", true)
+	PasswordRequireLower  = getEnvBool("PASSWORD_REQUIRE_LOWER", true)
+	PasswordRequireDigit  = getEnvBool("PASSWORD_REQUIRE_DIGIT", true)
+	PasswordRequireSymbol = getEnvBool("PASSWORD_REQUIRE_SYMBOL", false)
+	PasswordDenylistFile  = os.Getenv("PASSWORD_DENYLIST_FILE")
+	PasswordHistory       = getEnvInt("PASSWORD_HISTORY", 5)
+	PasswordResetTTL      = getEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+)
+
+// Password hashing. PasswordHashAlgorithm is "bcrypt" or "argon2id" and only
+// applies to new hashes; existing hashes are upgraded on the next login.
+var (
+	PasswordHashAlgorithm = getEnv("PASSWORD_HASH_ALGORITHM", "bcrypt")
+	BcryptCost            = getEnvInt("BCRYPT_COST", 12)
+	Argon2Time            = getEnvInt("ARGON2_TIME", 3)
+	Argon2MemoryKiB       = getEnvInt("ARGON2_MEMORY_KIB", 64*1024)
+	Argon2Threads         = getEnvInt("ARGON2_THREADS", 2)
+)
+
+// Login throttling. Each failed password for an account doubles the wait
+// before the next attempt is checked, starting at LoginDelayBase. After
+// LoginLockoutThreshold failures the account is locked for
+// LoginLockoutDuration. Independently, an IP address is refused after
+// LoginIPMaxFailures failures within LoginIPWindow.
+var (
+	LoginDelayBase        = getEnvDuration("LOGIN_DELAY_BASE", time.Second)
+	LoginDelayMax         = getEnvDuration("LOGIN_DELAY_MAX", 30*time.Second)
+	LoginLockoutThreshold = getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5)
+	LoginLockoutDuration  = getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	LoginIPMaxFailures    = getEnvInt("LOGIN_IP_MAX_FAILURES", 20)
+	LoginIPWindow         = getEnvDuration("LOGIN_IP_WINDOW", 15*time.Minute)
+)
+
+// TrustedProxies lists the addresses or CIDR ranges of the reverse proxies
+// whose X-Forwarded-For header names the client, separated by commas. When it
+// is empty no header is believed and the client is the connecting address.
+var TrustedProxies = getEnvList("TRUSTED_PROXIES")
+
+// Upstream retries. A failed lookup is retried up to the hospital's
+// MaxRetries times, waiting a random time up to UpstreamRetryBaseDelay
+// doubled per attempt and capped at UpstreamRetryMaxDelay. A Retry-After
+// longer than UpstreamRetryMaxDelay is not waited for.
+var (
+	UpstreamRetryBaseDelay = getEnvDuration("UPSTREAM_RETRY_BASE_DELAY", 200*time.Millisecond)
+	UpstreamRetryMaxDelay  = getEnvDuration("UPSTREAM_RETRY_MAX_DELAY", 5*time.Second)
+)
+
+// Upstream circuit breaker, per hospital: opened after
+// UpstreamBreakerFailureThreshold consecutive failed lookups, tried again
+// with UpstreamBreakerHalfOpenRequests lookups after
+// UpstreamBreakerOpenDuration.
+var (
+	UpstreamBreakerFailureThreshold = getEnvInt("UPSTREAM_BREAKER_FAILURE_THRESHOLD", 5)
+	UpstreamBreakerOpenDuration     = getEnvDuration("UPSTREAM_BREAKER_OPEN_DURATION", 30*time.Second)
+	UpstreamBreakerHalfOpenRequests = getEnvInt("UPSTREAM_BREAKER_HALF_OPEN_REQUESTS", 1)
+)
+
+// UpstreamMaxResponseBytes bounds the body of a hospital system's answer;
+// a longer one fails the lookup.
+var UpstreamMaxResponseBytes = int64(getEnvInt("UPSTREAM_MAX_RESPONSE_BYTES", 1<<20))
+
+// FederatedSearchTimeout bounds a federated patient search as a whole; hospital
+// systems that have not answered by then are reported as timed out.
+var FederatedSearchTimeout = getEnvDuration("FEDERATED_SEARCH_TIMEOUT", 5*time.Second)
+
+// NegativeLookupTTL is how long an upstream "no such patient" answer is
+// remembered before the hospital system is asked again. Zero disables it.
+var NegativeLookupTTL = getEnvDuration("NEGATIVE_LOOKUP_TTL", 5*time.Minute)
+
+// PhoneDefaultRegion is the country, as an ISO 3166 alpha-2 code, of phone
+// numbers given without an international prefix.
+var PhoneDefaultRegion = getEnv("PHONE_DEFAULT_REGION", "TH")
+
+// SearchDemographicRules lists the combinations of criteria a patient search
+// without national_id, passport_id or hn must include: rules separated by ;
+// each naming criteria joined by +. "none" allows no such search.
+var SearchDemographicRules = getEnv("SEARCH_DEMOGRAPHIC_RULES", "last_name+date_of_birth;first_name+phone_number;first_name+email")
+
+// Page sizes of list endpoints: PageSizeDefault when the client gives no
+// limit, and at most PageSizeMax.
+var (
+	PageSizeDefault = getEnvInt("PAGE_SIZE_DEFAULT", 50)
+	PageSizeMax     = getEnvInt("PAGE_SIZE_MAX", 100)
+)
+
+// NameSimilarityThreshold is the trigram similarity, between 0 and 1, a name
+// needs to match a fuzzy name search.
+var NameSimilarityThreshold = getEnvFloat("NAME_SIMILARITY_THRESHOLD", 0.3)
+
+// Match scores of the master patient index (see package mpi): records
+// scoring at least MPILinkThreshold are linked, at least MPIReviewThreshold
+// queued for review.
+var (
+	MPILinkThreshold   = getEnvFloat("MPI_LINK_THRESHOLD", 22)
+	MPIReviewThreshold = getEnvFloat("MPI_REVIEW_THRESHOLD", 12)
+)
+
+// CacheRefreshTimeout bounds a background refresh of a cached patient.
+var CacheRefreshTimeout = getEnvDuration("CACHE_REFRESH_TIMEOUT", 15*time.Second)
+
+// A search refreshes at most CacheSyncRefreshLimit stale copies before
+// answering, together and within CacheSyncRefreshTimeout; any others are
+// served stale and refreshed in the background.
+var (
+	CacheSyncRefreshLimit   = getEnvInt("CACHE_SYNC_REFRESH_LIMIT", 5)
+	CacheSyncRefreshTimeout = getEnvDuration("CACHE_SYNC_REFRESH_TIMEOUT", 5*time.Second)
+)
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("invalid %s %q, using %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid %s %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/utils"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type LogoutInput struct {
+	RefreshToken string `json:"refresh_token"`
+	AllSessions  bool   `json:"all_sessions"`
+}
+
+var errRefreshReused = errors.New("refresh token reused")
+
+/*
+-> look up the refresh token by hash
+-> a token that was already used or revoked means it leaked: kill the family
+-> mark it used and issue a new pair in the same family
+*/
+func RefreshToken(c *gin.Context) {
+	var input RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	db := config.DB
+
+	var stored models.RefreshToken
+	if err := db.Where("token_hash = ?", utils.HashToken(input.RefreshToken)).First(&stored).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if stored.UsedAt != nil || stored.RevokedAt != nil {
+		revokeTokenFamily(stored.FamilyID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	var staff models.Staff
+	if err := db.Preload("Hospital").First(&staff, stored.StaffID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	var tokens gin.H
+	err := db.Transaction(func(tx *gorm.DB) error {
+		//conditional update so two concurrent refreshes cannot both succeed
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", stored.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errRefreshReused
+		}
+		var err error
+		tokens, err = issueTokens(tx, staff, staff.Hospital, stored.FamilyID)
+		return err
+	})
+	if errors.Is(err, errRefreshReused) {
+		revokeTokenFamily(stored.FamilyID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+/*
+-> revoke the presented access token by jti
+-> revoke the refresh token family, or every session of the staff if asked
+*/
+func Logout(c *gin.Context) {
+	var input LogoutInput
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	db := config.DB
+
+	if err := revokeJTI(claims.ID, claims.ExpiresAt.Time); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	//revoked access tokens are only needed until they would have expired anyway
+	db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{})
+
+	if input.AllSessions {
+		revokeStaffSessions(claims.StaffID)
+		revokeStaffAccessTokens(claims.StaffID)
+	} else if input.RefreshToken != "" {
+		var stored models.RefreshToken
+		err := db.Where("token_hash = ? AND staff_id = ?", utils.HashToken(input.RefreshToken), claims.StaffID).First(&stored).Error
+		if err == nil {
+			revokeTokenFamily(stored.FamilyID)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+/*
+-> only administrators reach here (see routes)
+-> revoke every refresh token of the staff member, e.g. when they leave
+-> and every access token issued to them so far
+*/
+func RevokeStaffSessions(c *gin.Context) {
+	staff, err := findManagedStaff(c)
+	if err != (CodedError{}) {
+		c.JSON(err.Code, gin.H{"error": err.Error})
+		return
+	}
+
+	if !revokeStaffSessions(staff.ID) || !revokeStaffAccessTokens(staff.ID) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked"})
+}
+
+// issueTokens creates an access token and a refresh token. An empty familyID
+// starts a new family, as on login.
+func issueTokens(db *gorm.DB, staff models.Staff, hospital models.Hospital, familyID string) (gin.H, error) {
+	accessToken, err := utils.GenerateJWT(staff, hospital)
+	if err != nil {
+		return nil, err
+	}
+
+	if familyID == "" {
+		familyID, err = utils.RandomToken(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+	refreshToken, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := models.RefreshToken{
+		TokenHash: utils.HashToken(refreshToken),
+		FamilyID:  familyID,
+		StaffID:   staff.ID,
+		ExpiresAt: time.Now().Add(config.RefreshTokenTTL),
+	}
+	if err := db.Create(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(config.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// revokeJTI puts a token on the revocation list checked by AuthMiddleware.
+func revokeJTI(jti string, expiresAt time.Time) error {
+	return config.DB.Create(&models.RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+func revokeTokenFamily(familyID string) bool {
+	err := config.DB.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+	return err == nil
+}
+
+func revokeStaffSessions(staffID uint) bool {
+	err := config.DB.Model(&models.RefreshToken{}).
+		Where("staff_id = ? AND revoked_at IS NULL", staffID).
+		Update("revoked_at", time.Now()).Error
+	return err == nil
+}
+
+// revokeStaffAccessTokens refuses every access token issued to the staff
+// member until now, whose jtis are not all known.
+func revokeStaffAccessTokens(staffID uint) bool {
+	err := config.DB.Model(&models.Staff{}).Where("id = ?", staffID).UpdateColumn("sessions_revoked_at", time.Now().Truncate(time.Microsecond)).Error
+	return err == nil
+}
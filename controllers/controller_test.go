@@ -4,19 +4,26 @@ import (
 	"agnos-hospital-middleware/config"
 	middleware "agnos-hospital-middleware/middlewares"
 	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/upstream"
 	"agnos-hospital-middleware/utils"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -30,31 +37,128 @@ func TestMain(m *testing.M) {
 		log.Fatalf("failed to connect to test DB: %v", err)
 	}
 	config.DB = db
+	// every connection to :memory: is a new database; background refreshes must share this one
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	config.BootstrapToken = "test-bootstrap-token"
+	config.MetricsToken = "test-metrics-token"
+	// no back-off between attempts unless a test asks for it
+	config.LoginDelayBase = 0
+	// keep upstream retries quick
+	config.UpstreamRetryBaseDelay = time.Millisecond
+	config.UpstreamRetryMaxDelay = 10 * time.Millisecond
+	// cheapest hashing so the suite stays fast
+	utils.SetPasswordHasher(utils.BcryptHasher{Cost: bcrypt.MinCost})
 	// Migrate schemas
-	err = db.AutoMigrate(&models.Staff{}, &models.Hospital{}, &models.Patient{})
+	err = config.Migrate(db)
 	if err != nil {
 		log.Fatalf("failed to migrate: %v", err)
 	}
 	// Set up router
 	gin.SetMode(gin.TestMode)
 	testRouter = gin.Default()
-	testRouter.POST("/staff/create", CreateStaff)
+	testRouter.POST("/staff/bootstrap", BootstrapAdmin)
+	testRouter.POST("/staff/create", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermStaffManage), CreateStaff)
 	testRouter.POST("/staff/login", LoginStaff)
-	testRouter.POST("/patient/search", middleware.AuthMiddleware(), SearchPatient)
+	testRouter.POST("/staff/refresh", RefreshToken)
+	testRouter.POST("/staff/password", middleware.AuthMiddleware(), ChangePassword)
+	testRouter.POST("/staff/password/reset", ResetPassword)
+	testRouter.POST("/staff/:id/password-reset", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermStaffManage), IssuePasswordReset)
+	testRouter.POST("/staff/login/mfa", LoginMFA)
+	testRouter.POST("/staff/login/mfa/enroll", LoginMFAEnroll)
+	testRouter.POST("/staff/mfa/enroll", middleware.AuthMiddleware(), EnrollMFA)
+	testRouter.POST("/staff/mfa/activate", middleware.AuthMiddleware(), ActivateMFA)
+	testRouter.PATCH("/admin/hospitals/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), UpdateHospital)
+	testRouter.POST("/staff/logout", middleware.AuthMiddleware(), Logout)
+	testRouter.POST("/staff/:id/revoke-sessions", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermStaffManage), RevokeStaffSessions)
+	testRouter.POST("/staff/:id/unlock", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermStaffManage), UnlockStaff)
+	testRouter.GET("/audit/events", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermAuditRead), ListAuditEvents)
+	testRouter.POST("/admin/hospitals", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), CreateHospital)
+	testRouter.GET("/mpi/enterprise-patients/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermPatientRead), GetEnterprisePatient)
+	testRouter.POST("/mpi/links", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermMPIManage), LinkPatients)
+	testRouter.DELETE("/mpi/links/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermMPIManage), UnlinkPatient)
+	testRouter.GET("/mpi/reviews", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermMPIManage), ListMatchReviews)
+	testRouter.POST("/mpi/reviews/:id/resolve", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermMPIManage), ResolveMatchReview)
+	testRouter.GET("/admin/hospitals", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), ListHospitals)
+	testRouter.GET("/admin/hospitals/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), GetHospital)
+	testRouter.DELETE("/admin/hospitals/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), DeleteHospital)
+	testRouter.GET("/admin/upstreams/status", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), UpstreamStatus)
+	testRouter.GET("/metrics", Metrics)
+	testRouter.POST("/admin/staff/:id/hospital-access", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), GrantHospitalAccess)
+	testRouter.DELETE("/admin/staff/:id/hospital-access/:hospital_id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage), RevokeHospitalAccess)
+	testRouter.POST("/patient/search", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermPatientRead), SearchPatient)
+	testRouter.POST("/patients", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermPatientWrite), CreatePatient)
+	testRouter.GET("/patients/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermPatientRead), GetPatient)
+	testRouter.PATCH("/patients/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermPatientWrite), UpdatePatient)
+	testRouter.DELETE("/patients/:id", middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermPatientWrite), DeletePatient)
 
 	code := m.Run()
 	os.Exit(code)
 }
 
+// adminToken returns a token for the administrator of the hospital created by TestBootstrapAdmin
+func adminToken(role models.Role) string {
+	hospital := models.Hospital{ID: 1, Name: "Test Hospital"}
+	token, _ := utils.GenerateJWT(models.Staff{Username: "rootadmin", Role: role}, hospital)
+	return token
+}
+
+func TestBootstrapAdmin_InvalidToken(t *testing.T) {
+	input := models.BootstrapInput{
+		Username:     "rootadmin",
+		Password:     "Root-Secret-2026",
+		Hospital:     "Test Hospital",
+		HospitalCode: "TEST",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/bootstrap", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bootstrap-Token", "wrong-token")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	input := models.BootstrapInput{
+		Username:     "rootadmin",
+		Password:     "Root-Secret-2026",
+		Hospital:     "Test Hospital",
+		HospitalCode: "TEST",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/bootstrap", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bootstrap-Token", "test-bootstrap-token")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var admin models.Staff
+	require.NoError(t, config.DB.Where("username = ?", "rootadmin").First(&admin).Error)
+	assert.Equal(t, models.RoleSystemAdmin, admin.Role)
+
+	// A second bootstrap must be refused once staff exist
+	input.Username = "secondadmin"
+	body, _ = json.Marshal(input)
+	req, _ = http.NewRequest("POST", "/staff/bootstrap", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bootstrap-Token", "test-bootstrap-token")
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
 func TestCreateStaff(t *testing.T) {
-	input := models.StaffInput{
+	input := models.StaffCreateInput{
 		Username: "testuser",
-		Password: "secret123",
+		Password: "Secret-Pass-123",
 		Hospital: "Test Hospital",
 	}
 	body, _ := json.Marshal(input)
 	req, _ := http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
 	w := httptest.NewRecorder()
 	testRouter.ServeHTTP(w, req)
 	if w.Code != http.StatusOK {
@@ -62,11 +166,149 @@ func TestCreateStaff(t *testing.T) {
 	}
 }
 
+func TestCreateStaff_Unauthenticated(t *testing.T) {
+	input := models.StaffCreateInput{
+		Username: "intruder",
+		Password: "Secret-Pass-123",
+		Hospital: "Test Hospital",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCreateStaff_NonAdminForbidden(t *testing.T) {
+	input := models.StaffCreateInput{
+		Username: "byadoctor",
+		Password: "Secret-Pass-123",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleDoctor))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestCreateStaff_UnknownHospitalNotCreated(t *testing.T) {
+	input := models.StaffCreateInput{
+		Username: "elsewhere",
+		Password: "Secret-Pass-123",
+		Hospital: "Brand New Hospital",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleSystemAdmin))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var count int64
+	config.DB.Model(&models.Hospital{}).Where("name = ?", "Brand New Hospital").Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestCreateStaff_OtherHospitalForbiddenForAdmin(t *testing.T) {
+	hospital := models.Hospital{Name: "Other Hospital"}
+	body, _ := json.Marshal(models.HospitalInput{Name: hospital.Name, Code: "OTHER"})
+	req, _ := http.NewRequest("POST", "/admin/hospitals", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleSystemAdmin))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	input := models.StaffCreateInput{
+		Username: "crosstenant",
+		Password: "Secret-Pass-123",
+		Hospital: hospital.Name,
+	}
+	body, _ = json.Marshal(input)
+	req, _ = http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestCreateHospital_RequiresSystemAdmin(t *testing.T) {
+	body, _ := json.Marshal(models.HospitalInput{Name: "Rogue Hospital", Code: "ROGUE"})
+	req, _ := http.NewRequest("POST", "/admin/hospitals", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestCreateHospital_Validation(t *testing.T) {
+	token := adminToken(models.RoleSystemAdmin)
+
+	code, _ := postJSON("POST", "/admin/hospitals", token, models.HospitalInput{Name: "Bad URL Hospital", Code: "BADURL", BaseURL: "ftp://example.com"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = postJSON("POST", "/admin/hospitals", token, models.HospitalInput{Name: "No Key Hospital", Code: "NOKEY", BaseURL: "https://example.com", AuthMethod: models.HospitalAuthAPIKey})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	refreshAhead := 100
+	code, _ = postJSON("POST", "/admin/hospitals", token, models.HospitalInput{Name: "Always Refreshing Hospital", Code: "REFRESH", CacheRefreshAheadPercent: &refreshAhead})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = postJSON("POST", "/admin/hospitals", token, models.HospitalInput{Name: "Duplicate Code Hospital", Code: "test"})
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestHospitalRegistry_ConfigureUpstream(t *testing.T) {
+	token := adminToken(models.RoleSystemAdmin)
+	baseURL := "https://hospital-a.api.co.th"
+	authMethod := models.HospitalAuthAPIKey
+	credential := "upstream-key"
+	code, _ := postJSON("PATCH", "/admin/hospitals/1", token, models.HospitalUpdateInput{BaseURL: &baseURL, AuthMethod: &authMethod, AuthCredential: &credential})
+	require.Equal(t, http.StatusOK, code)
+
+	code, resp := postJSON("GET", "/admin/hospitals/1", token, nil)
+	require.Equal(t, http.StatusOK, code)
+	hospital := resp["hospital"].(map[string]any)
+	assert.Equal(t, "TEST", hospital["Code"])
+	assert.Equal(t, baseURL, hospital["BaseURL"])
+	assert.NotContains(t, hospital, "AuthCredential")
+
+	code, resp = postJSON("POST", "/admin/hospitals", token, models.HospitalInput{Name: "Renamed Hospital", Code: "RENAMED"})
+	require.Equal(t, http.StatusOK, code)
+	name := "Test Hospital"
+	code, _ = postJSON("PATCH", fmt.Sprintf("/admin/hospitals/%v", resp["hospital"].(map[string]any)["ID"]), token, models.HospitalUpdateInput{Name: &name})
+	assert.Equal(t, http.StatusConflict, code, "names are unique")
+	code, _ = postJSON("PATCH", "/admin/hospitals/1", token, models.HospitalUpdateInput{Name: &name})
+	assert.Equal(t, http.StatusOK, code, "keeping its own name")
+
+	//ids are numbers, never SQL
+	code, _ = postJSON("GET", "/admin/hospitals/1=1%20OR%201=1", token, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestDeleteHospital_InUse(t *testing.T) {
+	code, _ := postJSON("DELETE", "/admin/hospitals/1", adminToken(models.RoleSystemAdmin), nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, resp := postJSON("POST", "/admin/hospitals", adminToken(models.RoleSystemAdmin), models.HospitalInput{Name: "Closed Hospital", Code: "CLOSED"})
+	require.Equal(t, http.StatusOK, code)
+	id := uint(resp["hospital"].(map[string]any)["ID"].(float64))
+	code, _ = postJSON("DELETE", fmt.Sprintf("/admin/hospitals/%d", id), adminToken(models.RoleSystemAdmin), nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
 func TestCreateStaff_InvalidInput(t *testing.T) {
     invalidInput := "not a valid staff input"
     body, _ := json.Marshal(invalidInput)
     req, _ := http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
     req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
     w := httptest.NewRecorder()
     testRouter.ServeHTTP(w, req)
     assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -76,7 +318,7 @@ func TestLoginStaff(t *testing.T) {
 	// Reuse same input to login
 	input := models.StaffInput{
 		Username: "testuser",
-		Password: "secret123",
+		Password: "Secret-Pass-123",
 		Hospital: "Test Hospital",
 	}
 	body, _ := json.Marshal(input)
@@ -92,6 +334,443 @@ func TestLoginStaff(t *testing.T) {
 	}
 }
 
+func TestCreateStaff_InvalidRole(t *testing.T) {
+	input := models.StaffCreateInput{
+		Username: "badrole",
+		Password: "Secret-Pass-123",
+		Role:     "janitor",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/create", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLoginStaff_TokenCarriesRole(t *testing.T) {
+	input := models.StaffInput{
+		Username: "testuser",
+		Password: "Secret-Pass-123",
+		Hospital: "Test Hospital",
+	}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/login", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	claims, err := utils.ValidateJWT(response["token"])
+	require.NoError(t, err)
+	assert.Equal(t, models.DefaultRole, claims.Role)
+	assert.Equal(t, "Test Hospital", claims.HospitalName)
+}
+
+func TestSearchPatient_ForbiddenForRoleWithoutPermission(t *testing.T) {
+	hospital := models.Hospital{ID: 1, Name: "Test Hospital"}
+	token, _ := utils.GenerateJWT(models.Staff{Username: "auditor", Role: models.RoleAuditor}, hospital)
+
+	w := httptest.NewRecorder()
+	body, _ := json.Marshal(PatientSearchInput{NationalID: "1000000123453"})
+	req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// login posts credentials and returns the decoded response body
+func login(t *testing.T, username, password, hospital string) (int, map[string]any) {
+	input := models.StaffInput{Username: username, Password: password, Hospital: hospital}
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/staff/login", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	var response map[string]any
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func refresh(refreshToken string) (int, map[string]any) {
+	body, _ := json.Marshal(RefreshInput{RefreshToken: refreshToken})
+	req, _ := http.NewRequest("POST", "/staff/refresh", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	var response map[string]any
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestRefreshToken_Rotation(t *testing.T) {
+	code, tokens := login(t, "testuser", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+	first := tokens["refresh_token"].(string)
+
+	code, rotated := refresh(first)
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, rotated["token"])
+	second := rotated["refresh_token"].(string)
+	assert.NotEqual(t, first, second)
+
+	// Reusing the first token is treated as theft and kills the family
+	code, _ = refresh(first)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = refresh(second)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestLogout_RevokesAccessAndRefreshTokens(t *testing.T) {
+	code, tokens := login(t, "testuser", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+	accessToken := tokens["token"].(string)
+
+	body, _ := json.Marshal(LogoutInput{RefreshToken: tokens["refresh_token"].(string)})
+	req, _ := http.NewRequest("POST", "/staff/logout", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The access token is rejected by the middleware from now on
+	body, _ = json.Marshal(PatientSearchInput{NationalID: "1000000123453"})
+	req, _ = http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	code, _ = refresh(tokens["refresh_token"].(string))
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestRevokeStaffSessions(t *testing.T) {
+	code, tokens := login(t, "testuser", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+
+	var staff models.Staff
+	require.NoError(t, config.DB.Where("username = ?", "testuser").First(&staff).Error)
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/staff/%d/revoke-sessions", staff.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	code, _ = refresh(tokens["refresh_token"].(string))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	//access tokens issued before are refused too, not those of a new login
+	code, _ = postJSON("POST", "/patient/search", tokens["token"].(string), PatientSearchInput{NationalID: "1000000123453"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, tokens = login(t, "testuser", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = postJSON("POST", "/patient/search", tokens["token"].(string), PatientSearchInput{NationalID: "1000000123453"})
+	assert.NotEqual(t, http.StatusUnauthorized, code)
+}
+
+// createTestStaff inserts a staff member in the bootstrap hospital directly
+func createTestStaff(t *testing.T, username, password string, role models.Role) models.Staff {
+	hashed, err := utils.HashPassword(password)
+	require.NoError(t, err)
+	staff := models.Staff{Username: username, Password: hashed, Role: role, HospitalID: 1}
+	require.NoError(t, config.DB.Create(&staff).Error)
+	return staff
+}
+
+func TestLoginStaff_LockoutAndUnlock(t *testing.T) {
+	oldThreshold := config.LoginLockoutThreshold
+	config.LoginLockoutThreshold = 3
+	defer func() { config.LoginLockoutThreshold = oldThreshold }()
+
+	staff := createTestStaff(t, "lockme", "Secret-Pass-123", models.RoleNurse)
+
+	for i := 0; i < 3; i++ {
+		code, response := login(t, "lockme", "wrong", "Test Hospital")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		assert.Equal(t, "Invalid credentials", response["error"])
+	}
+
+	// Locked: even the right password gets the same answer as a wrong one
+	code, response := login(t, "lockme", "Secret-Pass-123", "Test Hospital")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "Invalid credentials", response["error"])
+
+	var lockouts int64
+	config.DB.Model(&models.AuditEvent{}).Where("event = ? AND subject_id = ?", models.AuditStaffLockedOut, staff.ID).Count(&lockouts)
+	assert.Equal(t, int64(1), lockouts)
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/staff/%d/unlock", staff.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAdmin))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	code, _ = login(t, "lockme", "Secret-Pass-123", "Test Hospital")
+	assert.Equal(t, http.StatusOK, code)
+
+	req, _ = http.NewRequest("GET", "/audit/events?event="+models.AuditStaffUnlocked, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken(models.RoleAuditor))
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var audit map[string][]models.AuditEvent
+	json.Unmarshal(w.Body.Bytes(), &audit)
+	require.NotEmpty(t, audit["events"])
+	assert.Equal(t, staff.ID, *audit["events"][0].SubjectID)
+}
+
+func TestLoginStaff_ProgressiveDelay(t *testing.T) {
+	config.LoginDelayBase = time.Hour
+	defer func() { config.LoginDelayBase = 0 }()
+
+	createTestStaff(t, "slowdown", "Secret-Pass-123", models.RoleNurse)
+
+	code, _ := login(t, "slowdown", "wrong", "Test Hospital")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Inside the back-off window the right password is not even checked
+	code, _ = login(t, "slowdown", "Secret-Pass-123", "Test Hospital")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestLoginStaff_IPThrottle(t *testing.T) {
+	oldMax := config.LoginIPMaxFailures
+	config.LoginIPMaxFailures = 2
+	loginIPThrottle = &ipThrottle{failures: map[string][]time.Time{}}
+	defer func() { config.LoginIPMaxFailures = oldMax }()
+
+	attempt := func(password string) int {
+		body, _ := json.Marshal(models.StaffInput{Username: "testuser", Password: password, Hospital: "Test Hospital"})
+		req, _ := http.NewRequest("POST", "/staff/login", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "203.0.113.9:4321"
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, attempt("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, attempt("wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, attempt("Secret-Pass-123"))
+
+	// Other clients are not affected
+	code, _ := login(t, "testuser", "Secret-Pass-123", "Test Hospital")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Clients whose failures left the window are forgotten
+	loginIPThrottle.failures["198.51.100.7"] = []time.Time{time.Now().Add(-2 * config.LoginIPWindow)}
+	loginIPThrottle.swept = time.Time{}
+	loginIPThrottle.fail("203.0.113.10")
+	assert.NotContains(t, loginIPThrottle.failures, "198.51.100.7")
+}
+
+// postJSON sends an optionally authenticated JSON request and decodes the response
+func postJSON(method, path, token string, payload any) (int, map[string]any) {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	var response map[string]any
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestMFA_VoluntaryEnrollmentAndLogin(t *testing.T) {
+	createTestStaff(t, "mfauser", "Secret-Pass-123", models.RoleDoctor)
+
+	code, tokens := login(t, "mfauser", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+	accessToken := tokens["token"].(string)
+
+	code, enrollment := postJSON("POST", "/staff/mfa/enroll", accessToken, nil)
+	require.Equal(t, http.StatusOK, code)
+	secret := enrollment["secret"].(string)
+	assert.Contains(t, enrollment["provisioning_uri"], "otpauth://totp/")
+
+	step := utils.TOTPStep(time.Now())
+	totp, _ := utils.TOTPCode(secret, step)
+	code, activation := postJSON("POST", "/staff/mfa/activate", accessToken, models.MFACodeInput{Code: totp})
+	require.Equal(t, http.StatusOK, code)
+	recoveryCodes := activation["recovery_codes"].([]any)
+	assert.Len(t, recoveryCodes, 10)
+
+	// Password alone now only yields a challenge
+	code, challenge := login(t, "mfauser", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, challenge["mfa_required"])
+	assert.Nil(t, challenge["token"])
+	mfaToken := challenge["mfa_token"].(string)
+
+	// The challenge is not an access token
+	code, _ = postJSON("POST", "/patient/search", mfaToken, PatientSearchInput{NationalID: "1000000123453"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// The code used for activation cannot be replayed
+	code, _ = postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: mfaToken, Code: totp})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	next, _ := utils.TOTPCode(secret, step+1)
+	code, tokens = postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: mfaToken, Code: next})
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, tokens["token"])
+
+	// The challenge token is single use
+	code, _ = postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: mfaToken, RecoveryCode: recoveryCodes[0].(string)})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Recovery codes work once
+	_, challenge = login(t, "mfauser", "Secret-Pass-123", "Test Hospital")
+	code, _ = postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: challenge["mfa_token"].(string), RecoveryCode: recoveryCodes[0].(string)})
+	assert.Equal(t, http.StatusOK, code)
+	_, challenge = login(t, "mfauser", "Secret-Pass-123", "Test Hospital")
+	code, _ = postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: challenge["mfa_token"].(string), RecoveryCode: recoveryCodes[0].(string)})
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestMFA_EnforcedByHospital(t *testing.T) {
+	var other models.Hospital
+	require.NoError(t, config.DB.Where("name = ?", "Other Hospital").First(&other).Error)
+	requireMFA := true
+	code, _ := postJSON("PATCH", fmt.Sprintf("/admin/hospitals/%d", other.ID), adminToken(models.RoleSystemAdmin), models.HospitalUpdateInput{RequireMFA: &requireMFA})
+	require.Equal(t, http.StatusOK, code)
+
+	hashed, _ := utils.HashPassword("Secret-Pass-123")
+	require.NoError(t, config.DB.Create(&models.Staff{Username: "enforced", Password: hashed, Role: models.RoleNurse, HospitalID: other.ID}).Error)
+
+	code, challenge := login(t, "enforced", "Secret-Pass-123", "Other Hospital")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, challenge["mfa_enrollment_required"])
+	mfaToken := challenge["mfa_token"].(string)
+
+	code, _ = postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: mfaToken, Code: "000000"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, enrollment := postJSON("POST", "/staff/login/mfa/enroll", "", models.MFAChallengeInput{MFAToken: mfaToken})
+	require.Equal(t, http.StatusOK, code)
+	totp, _ := utils.TOTPCode(enrollment["secret"].(string), utils.TOTPStep(time.Now()))
+
+	code, tokens := postJSON("POST", "/staff/login/mfa", "", models.MFALoginInput{MFAToken: mfaToken, Code: totp})
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, tokens["token"])
+	assert.Len(t, tokens["recovery_codes"], 10)
+}
+
+func TestCreateStaff_WeakPasswordRejected(t *testing.T) {
+	utils.SetPasswordPolicy(&utils.PasswordPolicy{
+		MinLength:    12,
+		RequireUpper: true,
+		RequireLower: true,
+		RequireDigit: true,
+		Denylist:     map[string]struct{}{"password123!": {}},
+	})
+	defer utils.SetPasswordPolicy(nil)
+
+	for _, password := range []string{"short1A", "alllowercase123", "Password123!", "Weakling-Pass-1"} {
+		code, response := postJSON("POST", "/staff/create", adminToken(models.RoleAdmin), models.StaffCreateInput{
+			Username: "weakling",
+			Password: password,
+		})
+		assert.Equal(t, http.StatusBadRequest, code, password)
+		assert.NotEmpty(t, response["violations"], password)
+	}
+}
+
+func TestChangePassword_PolicyAndHistory(t *testing.T) {
+	createTestStaff(t, "changer", "Original-Pass-1", models.RoleNurse)
+	_, tokens := login(t, "changer", "Original-Pass-1", "Test Hospital")
+	accessToken := tokens["token"].(string)
+
+	code, _ := postJSON("POST", "/staff/password", accessToken, models.PasswordChangeInput{CurrentPassword: "wrong", NewPassword: "Second-Pass-22"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = postJSON("POST", "/staff/password", accessToken, models.PasswordChangeInput{CurrentPassword: "Original-Pass-1", NewPassword: "weak"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, changed := postJSON("POST", "/staff/password", accessToken, models.PasswordChangeInput{CurrentPassword: "Original-Pass-1", NewPassword: "Second-Pass-22"})
+	require.Equal(t, http.StatusOK, code)
+
+	// Access tokens from before the change are refused, the new one is not
+	code, _ = postJSON("POST", "/patient/search", accessToken, PatientSearchInput{NationalID: "1234567890121"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	accessToken = changed["token"].(string)
+	code, _ = postJSON("POST", "/patient/search", accessToken, PatientSearchInput{NationalID: "1234567890121"})
+	assert.NotEqual(t, http.StatusUnauthorized, code)
+
+	// Going back to the original password is a reuse
+	code, response := postJSON("POST", "/staff/password", accessToken, models.PasswordChangeInput{CurrentPassword: "Second-Pass-22", NewPassword: "Original-Pass-1"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, response["violations"], "must not reuse a recent password")
+
+	// The refresh token from before the change no longer works
+	code, _ = refresh(tokens["refresh_token"].(string))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = login(t, "changer", "Second-Pass-22", "Test Hospital")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestPasswordReset_SingleUse(t *testing.T) {
+	staff := createTestStaff(t, "forgetful", "Forgotten-Pass-1", models.RoleNurse)
+
+	code, issued := postJSON("POST", fmt.Sprintf("/staff/%d/password-reset", staff.ID), adminToken(models.RoleAdmin), nil)
+	require.Equal(t, http.StatusOK, code)
+	resetToken := issued["reset_token"].(string)
+
+	code, _ = postJSON("POST", "/staff/password/reset", "", models.PasswordResetInput{Token: resetToken, NewPassword: "Forgotten-Pass-1"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = postJSON("POST", "/staff/password/reset", "", models.PasswordResetInput{Token: resetToken, NewPassword: "Remembered-Pass-2"})
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = postJSON("POST", "/staff/password/reset", "", models.PasswordResetInput{Token: resetToken, NewPassword: "Another-Pass-333"})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = login(t, "forgetful", "Remembered-Pass-2", "Test Hospital")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestManagedStaff_SystemAdminNeedsSystemAdmin(t *testing.T) {
+	root := createTestStaff(t, "hospital-root", "Root-Secret-2026", models.RoleSystemAdmin)
+
+	for _, action := range []string{"password-reset", "revoke-sessions", "unlock"} {
+		code, _ := postJSON("POST", fmt.Sprintf("/staff/%d/%s", root.ID, action), adminToken(models.RoleAdmin), nil)
+		assert.Equal(t, http.StatusForbidden, code, action)
+	}
+	code, _ := postJSON("POST", fmt.Sprintf("/staff/%d/password-reset", root.ID), adminToken(models.RoleSystemAdmin), nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestLoginStaff_UpgradesOutdatedHash(t *testing.T) {
+	staff := createTestStaff(t, "oldhash", "Legacy-Pass-123", models.RoleNurse)
+
+	utils.SetPasswordHasher(utils.Argon2idHasher{Time: 1, Memory: 8 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16})
+	defer utils.SetPasswordHasher(utils.BcryptHasher{Cost: bcrypt.MinCost})
+
+	code, _ := login(t, "oldhash", "Legacy-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+
+	var upgraded models.Staff
+	require.NoError(t, config.DB.First(&upgraded, staff.ID).Error)
+	assert.True(t, strings.HasPrefix(upgraded.Password, "$argon2id$"))
+
+	// The upgraded hash keeps working
+	code, _ = login(t, "oldhash", "Legacy-Pass-123", "Test Hospital")
+	assert.Equal(t, http.StatusOK, code)
+}
+
 func TestLoginStaff_InvalidCredentials(t *testing.T) {
     // Test with wrong password
     input := models.StaffInput{
@@ -110,7 +789,7 @@ func TestLoginStaff_InvalidCredentials(t *testing.T) {
 func TestLoginStaff_NonexistentHospital(t *testing.T) {
     input := models.StaffInput{
         Username: "testuser",
-        Password: "secret123",
+        Password: "Secret-Pass-123",
         Hospital: "Nonexistent Hospital",
     }
 
@@ -128,7 +807,7 @@ func TestSearchPatient_ValidSearch(t *testing.T) {
 	patient := models.Patient{
 		FirstNameEN: "John",
 		LastNameEN:  "Doe",
-		NationalID:  "12345",
+		NationalID:  "1000000123453",
 		HospitalID:  1,
 	}
 	config.DB.Create(&patient)
@@ -136,7 +815,7 @@ func TestSearchPatient_ValidSearch(t *testing.T) {
 		ID: 1,
 		Name: "Test Hospital",
 	}
-	token, err := utils.GenerateJWT(patient.FirstNameEN, hospital)
+	token, err := utils.GenerateJWT(models.Staff{Username: patient.FirstNameEN, Role: models.RoleDoctor}, hospital)
 	if err != nil {
 		t.Error("Token generation failed")
 		return
@@ -169,7 +848,7 @@ func TestSearchPatient_ExternalFetch(t *testing.T) {
 	patient := models.Patient{
 		FirstNameEN: "John",
 		LastNameEN:  "Doe",
-		NationalID:  "12345",
+		NationalID:  "1000000123453",
 		HospitalID:  1,
 	}
 	config.DB.Create(&patient)
@@ -177,14 +856,14 @@ func TestSearchPatient_ExternalFetch(t *testing.T) {
 		ID: 1,
 		Name: "Test Hospital",
 	}
-	token, err := utils.GenerateJWT(patient.FirstNameEN, hospital)
+	token, err := utils.GenerateJWT(models.Staff{Username: patient.FirstNameEN, Role: models.RoleDoctor}, hospital)
 	if err != nil {
 		t.Error("Token generation failed")
 		return
 	}
 	w := httptest.NewRecorder()
 	input := PatientSearchInput{
-		NationalID: "98765",
+		NationalID: "1000000987652",
 	}
 	body, _ := json.Marshal(input)
 	req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
@@ -202,7 +881,7 @@ func TestSearchPatient_MissingRequiredFields(t *testing.T) {
 		ID: 1,
 		Name: "Test Hospital",
 	}
-	token, err := utils.GenerateJWT("John", hospital)
+	token, err := utils.GenerateJWT(models.Staff{Username: "John", Role: models.RoleDoctor}, hospital)
 	if err != nil {
 		t.Error("Token generation failed")
 		return
@@ -223,7 +902,7 @@ func TestSearchPatient_MissingRequiredFields(t *testing.T) {
 		t.Fatalf("Failed to unmarshal response: %v", err)
 	}
 	// Check that the error message is correct
-	assert.Equal(t, "At least national_id or passport_id must be provided", response["error"])
+	assert.Equal(t, "At least national_id, passport_id or hn must be provided, or one of: last_name + date_of_birth; first_name + phone_number; first_name + email", response["error"])
 }
 
 func TestSearchPatient_InvalidJSON(t *testing.T) {
@@ -232,7 +911,7 @@ func TestSearchPatient_InvalidJSON(t *testing.T) {
 		Name: "Test Hospital",
 	}
 
-	token, err := utils.GenerateJWT("John", hospital)
+	token, err := utils.GenerateJWT(models.Staff{Username: "John", Role: models.RoleDoctor}, hospital)
 	if err != nil {
 		t.Error("Token generation failed")
 		return
@@ -249,7 +928,7 @@ func TestSearchPatient_InvalidJSON(t *testing.T) {
 func TestSearchPatient_MissingTokenClaims(t *testing.T) {
     // Create a request without setting the hospital in context
     w := httptest.NewRecorder()
-    input := PatientSearchInput{NationalID: "12345"}
+    input := PatientSearchInput{NationalID: "1000000123453"}
     body, _ := json.Marshal(input)
     req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
     req.Header.Set("Content-Type", "application/json")
@@ -273,7 +952,7 @@ func TestSearchPatient_PassportIDSearch(t *testing.T) {
     config.DB.Create(&patient)
 
     hospital := models.Hospital{ID: 1, Name: "Test Hospital"}
-    token, _ := utils.GenerateJWT("testuser", hospital)
+    token, _ := utils.GenerateJWT(models.Staff{Username: "testuser", Role: models.RoleDoctor}, hospital)
 
     w := httptest.NewRecorder()
     input := PatientSearchInput{PassportID: "P98765"}
@@ -302,20 +981,22 @@ func (m *MockHTTPTransport) RoundTrip(req *http.Request) (*http.Response, error)
 func TestSearchPatient_ExternalAPISuccess(t *testing.T) {
     // Setup
     hospital := models.Hospital{ID: 1, Name: "Test Hospital"}
-    token, _ := utils.GenerateJWT("testuser", hospital)
+    token, _ := utils.GenerateJWT(models.Staff{Username: "testuser", Role: models.RoleDoctor}, hospital)
 
     // Create a custom HTTP client with our mock transport
     mockTransport := &MockHTTPTransport{
         RoundTripFunc: func(req *http.Request) (*http.Response, error) {
             // Verify the request URL
-            assert.Contains(t, req.URL.String(), "hospital-a.api.co.th/patient/search/98765")
+            assert.Contains(t, req.URL.String(), "hospital-a.api.co.th/patient/search/1000000987652")
+            assert.Equal(t, "upstream-key", req.Header.Get("X-API-Key"))
 
             // Create mock response
             externalPatient := models.PatientExternal{
                 FirstNameEN: "External",
                 LastNameEN:  "Patient",
-                NationalID: "98765",
-                PatientHN:  "Test Hospital",
+                NationalID: "1000000987652",
+                PatientHN:  "HN-98765",
+                HospitalCode: "TEST",
                 // Add other required fields
                 FirstNameTH:  "ชื่อ",
                 LastNameTH:   "นามสกุล",
@@ -334,13 +1015,12 @@ func TestSearchPatient_ExternalAPISuccess(t *testing.T) {
     }
 
     // Replace the default transport with our mock
-    oldTransport := http.DefaultTransport
-    http.DefaultTransport = mockTransport
-    defer func() { http.DefaultTransport = oldTransport }()
+    upstream.Transport = mockTransport
+    defer func() { upstream.Transport = nil }()
 
     // Test
     w := httptest.NewRecorder()
-    input := PatientSearchInput{NationalID: "98765"}
+    input := PatientSearchInput{NationalID: "1000000987652"}
     body, _ := json.Marshal(input)
     req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
     req.Header.Set("Content-Type", "application/json")
@@ -357,15 +1037,17 @@ func TestSearchPatient_ExternalAPISuccess(t *testing.T) {
 
     // Verify patient was stored in DB
     var patient models.Patient
-    result := config.DB.Where("national_id = ?", "98765").First(&patient)
+    result := config.DB.Where("national_id = ?", "1000000987652").First(&patient)
     assert.Nil(t, result.Error)
     assert.Equal(t, "External", patient.FirstNameEN)
+    require.NotNil(t, patient.HN)
+    assert.Equal(t, "HN-98765", *patient.HN)
 }
 
 func TestSearchPatient_ExternalAPIError(t *testing.T) {
     // Setup
     hospital := models.Hospital{ID: 1, Name: "Test Hospital"}
-    token, _ := utils.GenerateJWT("testuser", hospital)
+    token, _ := utils.GenerateJWT(models.Staff{Username: "testuser", Role: models.RoleDoctor}, hospital)
 
     // Create a custom HTTP client with our mock transport
     mockTransport := &MockHTTPTransport{
@@ -375,13 +1057,12 @@ func TestSearchPatient_ExternalAPIError(t *testing.T) {
     }
 
     // Replace the default transport with our mock
-    oldTransport := http.DefaultTransport
-    http.DefaultTransport = mockTransport
-    defer func() { http.DefaultTransport = oldTransport }()
+    upstream.Transport = mockTransport
+    defer func() { upstream.Transport = nil }()
 
     // Test
     w := httptest.NewRecorder()
-    input := PatientSearchInput{NationalID: "90909"}
+    input := PatientSearchInput{NationalID: "1000000909091"}
     body, _ := json.Marshal(input)
     req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
     req.Header.Set("Content-Type", "application/json")
@@ -391,12 +1072,930 @@ func TestSearchPatient_ExternalAPIError(t *testing.T) {
     assert.Equal(t, http.StatusInternalServerError, w.Code)
 }
 
+func TestSearchPatient_ExternalAPINotFound(t *testing.T) {
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	code, _ := postJSON("POST", "/patient/search", adminToken(models.RoleDoctor), PatientSearchInput{NationalID: "1000000404045"})
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSearchPatient_ExternalAPITimeout(t *testing.T) {
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			return nil, context.DeadlineExceeded
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	code, _ := postJSON("POST", "/patient/search", adminToken(models.RoleDoctor), PatientSearchInput{NationalID: "1000000504040"})
+	assert.Equal(t, http.StatusGatewayTimeout, code)
+}
+
+func TestSearchPatient_CircuitOpen(t *testing.T) {
+	oldThreshold := config.UpstreamBreakerFailureThreshold
+	config.UpstreamBreakerFailureThreshold = 2
+	upstream.ResetBreakers()
+	defer func() {
+		config.UpstreamBreakerFailureThreshold = oldThreshold
+		upstream.ResetBreakers()
+	}()
+
+	calls := 0
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			calls++
+			return nil, fmt.Errorf("connection refused")
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	token := adminToken(models.RoleDoctor)
+	for i := 0; i < 2; i++ {
+		code, _ := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000604044"})
+		require.Equal(t, http.StatusInternalServerError, code)
+	}
+	callsBeforeOpen := calls
+
+	code, resp := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000604044"})
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, ErrorCodeUpstreamUnavailable, resp["code"])
+	assert.Equal(t, callsBeforeOpen, calls)
+
+	code, resp = postJSON("GET", "/admin/upstreams/status", adminToken(models.RoleSystemAdmin), nil)
+	require.Equal(t, http.StatusOK, code)
+	first := resp["upstreams"].([]any)[0].(map[string]any)
+	assert.Equal(t, "TEST", first["hospital_code"])
+	assert.Equal(t, upstream.StateOpen, first["breaker"].(map[string]any)["state"])
+
+	//metrics need the metrics token, not a staff token
+	for _, authorization := range []string{"", "Bearer wrong-token", "Bearer " + adminToken(models.RoleSystemAdmin)} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", authorization)
+		testRouter.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer test-metrics-token")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `upstream_circuit_state{hospital="TEST"} 1`)
+}
+
+func TestSearchPatient_Federated(t *testing.T) {
+	rootToken := adminToken(models.RoleSystemAdmin)
+	noRetries := 0
+	hospitalIDs := map[string]uint{}
+	for _, h := range []models.HospitalInput{
+		{Name: "Federated B", Code: "FEDB", BaseURL: "https://hospital-b.example", MaxRetries: &noRetries},
+		{Name: "Federated C", Code: "FEDC", BaseURL: "https://hospital-c.example", MaxRetries: &noRetries},
+	} {
+		code, resp := postJSON("POST", "/admin/hospitals", rootToken, h)
+		require.Equal(t, http.StatusOK, code)
+		hospitalIDs[h.Code] = uint(resp["hospital"].(map[string]any)["ID"].(float64))
+	}
+
+	staff := createTestStaff(t, "federated", "Secret-Pass-123", models.RoleDoctor)
+	for _, id := range hospitalIDs {
+		code, _ := postJSON("POST", fmt.Sprintf("/admin/staff/%d/hospital-access", staff.ID), rootToken, models.HospitalAccessInput{HospitalID: id})
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, tokens := login(t, "federated", "Secret-Pass-123", "Test Hospital")
+	require.Equal(t, http.StatusOK, code)
+	token := tokens["token"].(string)
+
+	oldTimeout := config.FederatedSearchTimeout
+	config.FederatedSearchTimeout = 200 * time.Millisecond
+	defer func() { config.FederatedSearchTimeout = oldTimeout }()
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			hospitalCode := map[string]string{"hospital-a.api.co.th": "TEST", "hospital-b.example": "FEDB"}[req.URL.Host]
+			if hospitalCode == "" {
+				//hospital C hangs until the search deadline
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			}
+			body, _ := json.Marshal(models.PatientExternal{FirstNameEN: "Federated", NationalID: "1000000707072", PatientHN: "HN-70707", HospitalCode: hospitalCode})
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	code, resp := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000707072", Federated: true})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, resp["partial"])
+	patients := resp["patients"].([]any)
+	require.Len(t, patients, 2)
+	statuses := map[string]string{}
+	for _, s := range resp["sources"].([]any) {
+		source := s.(map[string]any)
+		statuses[source["hospital_code"].(string)] = source["status"].(string)
+	}
+	assert.Equal(t, map[string]string{"TEST": SourceOK, "FEDB": SourceOK, "FEDC": SourceTimeout}, statuses)
+	assert.Equal(t, OriginUpstream, patients[0].(map[string]any)["Source"].(map[string]any)["origin"])
+
+	//the second search is answered from the local copies
+	code, resp = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000707072", Federated: true})
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp["patients"].([]any), 2)
+
+	//without a grant the hospital is no longer searched
+	code, _ = postJSON("DELETE", fmt.Sprintf("/admin/staff/%d/hospital-access/id%%3E0", staff.ID), rootToken, nil)
+	assert.Equal(t, http.StatusNotFound, code, "ids are numbers, never SQL")
+	code, _ = postJSON("DELETE", fmt.Sprintf("/admin/staff/%d/hospital-access/%d", staff.ID, hospitalIDs["FEDC"]), rootToken, nil)
+	require.Equal(t, http.StatusOK, code)
+	code, resp = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000707072", Federated: true})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, resp["partial"])
+	assert.Len(t, resp["sources"].([]any), 2)
+}
+
+func TestSearchPatient_UpstreamMissIsNegativelyCached(t *testing.T) {
+	calls := 0
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			calls++
+			//a record with nothing in it but the hospital
+			body := []byte(`{"hospital_code":"TEST"}`)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	var before int64
+	config.DB.Model(&models.Patient{}).Count(&before)
+
+	token := adminToken(models.RoleDoctor)
+	code, _ := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000808081"})
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000808081"})
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, 1, calls, "the second miss must be answered from the negative cache")
+
+	var after int64
+	config.DB.Model(&models.Patient{}).Count(&after)
+	assert.Equal(t, before, after, "no blank patient may be stored")
+
+	//once the entry expires the hospital system is asked again
+	config.DB.Model(&models.NegativeLookup{}).Where("value = ?", "1000000808081").Update("expires_at", time.Now().Add(-time.Second))
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000808081"})
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, 2, calls)
+}
+
+// cachedPatient stores a patient of the test hospital as if fetched upstream at fetchedAt.
+func cachedPatient(t *testing.T, nationalID string, fetchedAt time.Time, etag string) models.Patient {
+	patient := models.Patient{FirstNameEN: "Cached", LastNameEN: "Patient", NationalID: nationalID, PhoneNumber: "0811111111", HospitalID: 1, FetchedAt: &fetchedAt, SourceETag: etag}
+	require.NoError(t, config.DB.Create(&patient).Error)
+	return patient
+}
+
+func searchWithHeaders(token string, input PatientSearchInput) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(input)
+	req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	return w
+}
+
+func TestSearchPatient_StaleCopyIsRevalidated(t *testing.T) {
+	upstream.ResetBreakers()
+	defer upstream.ResetBreakers()
+	status, calls := http.StatusNotModified, 0
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			calls++
+			header := make(http.Header)
+			if status == http.StatusNotModified {
+				assert.Equal(t, `"v1"`, req.Header.Get("If-None-Match"))
+				return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(nil)), Header: header}, nil
+			}
+			header.Set("ETag", `"v2"`)
+			body := []byte(`{"first_name_en":"Cached","last_name_en":"Patient","national_id":"1000000737371","phone_number":"0822222222","hospital_code":"TEST","version":"2"}`)
+			return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(body)), Header: header}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	token := adminToken(models.RoleDoctor)
+	expired := time.Now().Add(-48 * time.Hour)
+	patient := cachedPatient(t, "1000000737371", expired, `"v1"`)
+
+	//fresh copies are served without asking the hospital
+	config.DB.Model(&patient).Update("fetched_at", time.Now())
+	code, _ := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000737371"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, calls)
+
+	//unchanged at the source: only fetched_at moves
+	config.DB.Model(&patient).Update("fetched_at", expired)
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000737371"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, calls)
+	config.DB.First(&patient, patient.ID)
+	assert.True(t, patient.FetchedAt.After(expired))
+	assert.Nil(t, patient.EnterprisePatientID)
+
+	//changed at the source: the updated record is served and stored
+	config.DB.Model(&patient).Update("fetched_at", expired)
+	status = http.StatusOK
+	code, response := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000737371"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "0822222222", response["patients"].([]any)[0].(map[string]any)["PhoneNumber"])
+	config.DB.First(&patient, patient.ID)
+	assert.Equal(t, `"v2"`, patient.SourceETag)
+	assert.Equal(t, "2", patient.SourceVersion)
+	assert.NotNil(t, patient.EnterprisePatientID, "a new phone number is matched again")
+
+	//hospital system down: the stale copy is served and flagged
+	config.DB.Model(&patient).Update("fetched_at", expired)
+	status = http.StatusServiceUnavailable
+	w := searchWithHeaders(token, PatientSearchInput{NationalID: "1000000737371"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "stale", w.Header().Get("X-Cache"))
+
+	//gone at the source: the copy is dropped
+	status = http.StatusNotFound
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000737371"})
+	assert.Equal(t, http.StatusNotFound, code)
+	var count int64
+	config.DB.Unscoped().Model(&models.Patient{}).Where("national_id = ?", "1000000737371").Count(&count)
+	assert.Zero(t, count)
+
+	//back at the source: the patient is cached again, not refused as deleted
+	config.DB.Where("value = ?", "1000000737371").Delete(&models.NegativeLookup{})
+	status = http.StatusOK
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000737371"})
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestSearchPatient_StaleWhileRevalidateAndRefreshAhead(t *testing.T) {
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			body := []byte(`{"first_name_en":"Cached","last_name_en":"Patient","national_id":"` + path.Base(req.URL.Path) + `","phone_number":"0833333333","hospital_code":"TEST"}`)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+	config.DB.Model(&models.Hospital{}).Where("id = ?", 1).Update("cache_stale_while_revalidate", true)
+	defer config.DB.Model(&models.Hospital{}).Where("id = ?", 1).Update("cache_stale_while_revalidate", false)
+
+	token := adminToken(models.RoleDoctor)
+	for _, tc := range []struct {
+		nationalID string
+		age        time.Duration
+		header     string
+	}{
+		{"1000000747473", 48 * time.Hour, "stale"}, // past the 24h TTL
+		{"1000000757576", 20 * time.Hour, ""},      // past 80% of it
+	} {
+		patient := cachedPatient(t, tc.nationalID, time.Now().Add(-tc.age), "")
+		w := searchWithHeaders(token, PatientSearchInput{NationalID: tc.nationalID})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, tc.header, w.Header().Get("X-Cache"))
+		assert.Contains(t, w.Body.String(), "0811111111", "the cached copy is served without waiting")
+
+		backgroundRefreshes.Wait()
+		config.DB.First(&patient, patient.ID)
+		assert.Equal(t, "0833333333", patient.PhoneNumber)
+		assert.WithinDuration(t, time.Now(), *patient.FetchedAt, time.Minute)
+	}
+}
+
+func TestSearchPatient_SynchronousRefreshesAreLimited(t *testing.T) {
+	var calls atomic.Int32
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			body := []byte(`{"first_name_en":"Budget","last_name_en":"Stale","date_of_birth":"1960-04-05","national_id":"` + path.Base(req.URL.Path) + `","phone_number":"0844444444","hospital_code":"TEST"}`)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+	defer func(limit int) { config.CacheSyncRefreshLimit = limit }(config.CacheSyncRefreshLimit)
+	config.CacheSyncRefreshLimit = 1
+
+	expired := time.Now().Add(-48 * time.Hour)
+	birth := models.NewPartialDate(time.Date(1960, 4, 5, 0, 0, 0, 0, time.UTC), models.DatePrecisionDay)
+	for _, nationalID := range []string{"1000000777771", "1000000788889"} {
+		patient := models.Patient{FirstNameEN: "Budget", LastNameEN: "Stale", NationalID: nationalID, DateOfBirth: birth, PhoneNumber: "0811111111", HospitalID: 1, FetchedAt: &expired}
+		require.NoError(t, config.DB.Create(&patient).Error)
+	}
+
+	//one copy is refreshed before answering, the other is served stale
+	w := searchWithHeaders(adminToken(models.RoleDoctor), PatientSearchInput{LastName: "Stale", DateOfBirth: "1960-04-05"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "stale", w.Header().Get("X-Cache"))
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "0844444444"))
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "0811111111"))
+
+	backgroundRefreshes.Wait()
+	assert.Equal(t, int32(2), calls.Load())
+	var refreshed int64
+	config.DB.Model(&models.Patient{}).Where("last_name_en = ? AND phone_number = ?", "Stale", "0844444444").Count(&refreshed)
+	assert.Equal(t, int64(2), refreshed)
+}
+
+func TestSearchPatient_ByHN(t *testing.T) {
+	hn := "HN-76767"
+	fetchedAt := time.Now()
+	patient := models.Patient{FirstNameEN: "Numbered", LastNameEN: "Patient", HN: &hn, HospitalID: 1, FetchedAt: &fetchedAt}
+	require.Equal(t, CodedError{}, storeInDB(&patient))
+
+	token := adminToken(models.RoleDoctor)
+	code, resp := postJSON("POST", "/patient/search", token, PatientSearchInput{HN: hn})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, hn, resp["patients"].([]any)[0].(map[string]any)["HN"])
+
+	//the same HN fetched again replaces the cached record instead of duplicating it
+	again := models.Patient{FirstNameEN: "Renamed", LastNameEN: "Patient", NationalID: "1000000767679", HN: &hn, HospitalID: 1, FetchedAt: &fetchedAt}
+	require.Equal(t, CodedError{}, storeInDB(&again))
+	var stored []models.Patient
+	config.DB.Where("hn = ?", hn).Find(&stored)
+	require.Len(t, stored, 1)
+	assert.Equal(t, "Renamed", stored[0].FirstNameEN)
+
+	//the reference API cannot look patients up by HN
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			t.Error("no request expected")
+			return nil, fmt.Errorf("unexpected request")
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{HN: "HN-00000"})
+	assert.Equal(t, http.StatusNotImplemented, code)
+}
+
+func TestPatientRecords_CRUD(t *testing.T) {
+	token := adminToken(models.RoleRegistration)
+	input := models.PatientInput{
+		FirstNameEN: "Somchai", LastNameEN: "Jaidee", FirstNameTH: "สมชาย", LastNameTH: "ใจดี",
+		DateOfBirth: "1985-04-12", NationalID: "1101700203450", HN: "HN-CRUD-1",
+		PhoneNumber: "081-234-5678", Email: "somchai@example.com", Gender: "m",
+	}
+	code, resp := postJSON("POST", "/patients", token, input)
+	require.Equal(t, http.StatusOK, code)
+	created := resp["patient"].(map[string]any)
+	assert.Equal(t, "081-234-5678", created["PhoneNumber"], "kept as given")
+	assert.Equal(t, "M", created["Gender"])
+	path := fmt.Sprintf("/patients/%v", created["ID"])
+
+	code, _ = postJSON("POST", "/patients", token, input)
+	assert.Equal(t, http.StatusConflict, code, "identifiers are unique within the hospital")
+
+	code, resp = postJSON("GET", path, adminToken(models.RoleNurse), nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HN-CRUD-1", resp["patient"].(map[string]any)["HN"])
+
+	//phone numbers and emails match whatever way they are written
+	for _, search := range []PatientSearchInput{
+		{NationalID: "1101700203450", PhoneNumber: "+66 81 234 5678"},
+		{NationalID: "1101700203450", PhoneNumber: "0812345678", Email: " Somchai@Example.COM"},
+	} {
+		code, resp = postJSON("POST", "/patient/search", token, search)
+		require.Equal(t, http.StatusOK, code)
+		assert.Len(t, resp["patients"], 1)
+	}
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1101700203450", PhoneNumber: "call me"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	email := "not-an-email"
+	code, resp = postJSON("PATCH", path, token, models.PatientUpdateInput{Email: &email})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, []any{"email must be a valid address"}, resp["violations"])
+	email = ""
+	code, resp = postJSON("PATCH", path, token, models.PatientUpdateInput{Email: &email})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", resp["patient"].(map[string]any)["Email"])
+
+	//other hospitals cannot see the record
+	otherToken, _ := utils.GenerateJWT(models.Staff{Username: "other", Role: models.RoleRegistration}, models.Hospital{ID: 2})
+	code, _ = postJSON("GET", path, otherToken, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = postJSON("DELETE", path, otherToken, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = postJSON("DELETE", path, adminToken(models.RoleNurse), nil)
+	assert.Equal(t, http.StatusForbidden, code, "nurses may read but not write")
+
+	//ids are numbers, never SQL
+	for _, id := range []string{"abc", "1%20OR%201=1", "id%3E0"} {
+		code, _ = postJSON("GET", "/patients/"+id, token, nil)
+		assert.Equal(t, http.StatusNotFound, code, id)
+	}
+
+	code, _ = postJSON("DELETE", path, token, nil)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = postJSON("GET", path, token, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{HN: "HN-CRUD-1"})
+	assert.NotEqual(t, http.StatusOK, code, "deleted patients are not searchable")
+	var deleted models.Patient
+	require.NoError(t, config.DB.Unscoped().First(&deleted, created["ID"]).Error)
+	assert.True(t, deleted.DeletedAt.Valid)
+}
+
+func TestCreatePatient_Validation(t *testing.T) {
+	code, resp := postJSON("POST", "/patients", adminToken(models.RoleRegistration), models.PatientInput{
+		FirstNameEN: "R2D2", NationalID: "12345", DateOfBirth: "2999-01-01", Gender: "X", PhoneNumber: "12",
+	})
+	require.Equal(t, http.StatusBadRequest, code)
+	assert.ElementsMatch(t, []any{
+		"national_id must be 13 digits with a valid check digit",
+		"a first and last name, in English or Thai, is required",
+		"first_name_en must not contain digits or control characters",
+		"date_of_birth must be between 1900 and today",
+		"phone_number must be an international number starting with + or a national number starting with 0",
+		"gender must be M or F",
+	}, resp["violations"])
+
+	//copies of hospital system records are not edited here
+	cached := cachedPatient(t, "3101500123459", time.Now(), "")
+	name := "Changed"
+	code, _ = postJSON("PATCH", fmt.Sprintf("/patients/%d", cached.ID), adminToken(models.RoleRegistration), models.PatientUpdateInput{FirstNameEN: &name})
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestSearchPatient_IdentifierValidation(t *testing.T) {
+	calls := 0
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			calls++
+			//the hospital system answers with a mistyped national ID
+			body := []byte(`{"first_name_en":"Typo","last_name_en":"Patient","national_id":"1000000606065","hospital_code":"TEST"}`)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	token := adminToken(models.RoleDoctor)
+	code, resp := postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000606066"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "national_id must be 13 digits with a valid check digit", resp["error"])
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{PassportID: "123456789", PassportCountry: "THA"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Zero(t, calls, "invalid identifiers never reach the hospital system")
+
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1-0000-00606-06-3"})
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, 1, calls)
+
+	//separators are dropped before the local lookup
+	cachedPatient(t, "1000000616069", time.Now(), "")
+	code, resp = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1 0000 00616 06 9"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1000000616069", resp["patients"].([]any)[0].(map[string]any)["NationalID"])
+}
+
+func TestSearchPatient_DateOfBirthAndAge(t *testing.T) {
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	//only the year of birth is known, written in the Buddhist Era
+	code, resp := postJSON("POST", "/patients", adminToken(models.RoleRegistration), models.PatientInput{
+		FirstNameEN: "Partial", LastNameEN: "Date", NationalID: "1000000626269", DateOfBirth: "2528",
+	})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1985", resp["patient"].(map[string]any)["DateOfBirth"])
+
+	token := adminToken(models.RoleDoctor)
+	years := time.Now().Year() - 1985
+	for _, tc := range []struct {
+		input PatientSearchInput
+		found bool
+	}{
+		{PatientSearchInput{DateOfBirth: "12 เม.ย. 2528"}, true},
+		{PatientSearchInput{DateOfBirth: "1985-04"}, true},
+		{PatientSearchInput{DateOfBirth: "1990-01-01"}, false},
+		{PatientSearchInput{AgeMin: intPtr(years - 1), AgeMax: intPtr(years)}, true},
+		{PatientSearchInput{AgeMin: intPtr(years + 1)}, false},
+		{PatientSearchInput{AgeMax: intPtr(years - 2)}, false},
+	} {
+		tc.input.NationalID = "1000000626269"
+		code, _ := postJSON("POST", "/patient/search", token, tc.input)
+		if tc.found {
+			assert.Equal(t, http.StatusOK, code, "%+v", tc.input)
+		} else {
+			assert.Equal(t, http.StatusNotFound, code, "%+v", tc.input)
+		}
+		config.DB.Where("1 = 1").Delete(&models.NegativeLookup{})
+	}
+
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000626269", DateOfBirth: "31/04/2528"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000626269", AgeMin: intPtr(50), AgeMax: intPtr(40)})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestSearchPatient_Names(t *testing.T) {
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	registration := adminToken(models.RoleRegistration)
+	code, _ := postJSON("POST", "/patients", registration, models.PatientInput{
+		FirstNameTH: "สมชาย", LastNameTH: "ใจดี", FirstNameEN: "Somchai", LastNameEN: "Jaidee", NationalID: "1000000636361",
+	})
+	require.Equal(t, http.StatusOK, code)
+	//registered in Thai only
+	code, _ = postJSON("POST", "/patients", registration, models.PatientInput{
+		FirstNameTH: "วิชัย", LastNameTH: "ใจดี", NationalID: "1000000646367",
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	token := adminToken(models.RoleDoctor)
+	for _, tc := range []struct {
+		input PatientSearchInput
+		found bool
+	}{
+		{PatientSearchInput{NationalID: "1000000636361", FirstName: "สมชาย", LastName: "ใจดี"}, true},
+		{PatientSearchInput{NationalID: "1000000636361", FirstName: "Somchai", LastName: "Jaidee"}, true},
+		{PatientSearchInput{NationalID: "1000000636361", FirstName: "สมชาย", LastName: "Jaidee"}, true},
+		{PatientSearchInput{NationalID: "1000000636361", FirstName: "วิชัย"}, false},
+		{PatientSearchInput{NationalID: "1000000646367", FirstName: "Wichai"}, false},
+		{PatientSearchInput{NationalID: "1000000646367", FirstName: "wichai", LastName: "CHAIDI", CrossScript: true}, true},
+		{PatientSearchInput{NationalID: "1000000636361", FirstName: "somchai", LastName: "ใจดี", CrossScript: true}, true},
+		{PatientSearchInput{NationalID: "1000000636361", FirstName: "Somsak", CrossScript: true}, false},
+	} {
+		code, _ := postJSON("POST", "/patient/search", token, tc.input)
+		if tc.found {
+			assert.Equal(t, http.StatusOK, code, "%+v", tc.input)
+		} else {
+			assert.Equal(t, http.StatusNotFound, code, "%+v", tc.input)
+		}
+		config.DB.Where("1 = 1").Delete(&models.NegativeLookup{})
+	}
+}
+
+func TestSearchPatient_NameMatchModes(t *testing.T) {
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	code, _ := postJSON("POST", "/patients", adminToken(models.RoleRegistration), models.PatientInput{
+		FirstNameTH: "สมชาย", LastNameTH: "ใจดี", FirstNameEN: "Somchai", LastNameEN: "Jaidee", NationalID: "1000000656567",
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	token := adminToken(models.RoleDoctor)
+	for _, tc := range []struct {
+		input PatientSearchInput
+		found bool
+	}{
+		{PatientSearchInput{NameMatch: NameMatchPrefix, FirstName: " som ", LastName: "JAI"}, true},
+		{PatientSearchInput{NameMatch: NameMatchPrefix, FirstName: "สม"}, true},
+		{PatientSearchInput{NameMatch: NameMatchPrefix, FirstName: "chai"}, false},
+		{PatientSearchInput{NameMatch: NameMatchPrefix, FirstName: "som%"}, false},
+		{PatientSearchInput{NameMatch: NameMatchFuzzy, FirstName: "somchia"}, true},
+		{PatientSearchInput{NameMatch: NameMatchFuzzy, FirstName: "Wichai"}, false},
+		//without pg_trgm names sharing a trigram are compared, whatever their first letter
+		{PatientSearchInput{NameMatch: NameMatchFuzzy, FirstName: "Tomchai"}, true},
+		{PatientSearchInput{NameMatch: NameMatchFuzzy, FirstName: "Xyz"}, false},
+		{PatientSearchInput{NameMatch: NameMatchPhonetic, FirstName: "Somchay", LastName: "Jaidy"}, true},
+		{PatientSearchInput{NameMatch: NameMatchPhonetic, FirstName: "สมชาย"}, true},
+		{PatientSearchInput{NameMatch: NameMatchPhonetic, FirstName: "Wichai"}, false},
+	} {
+		tc.input.NationalID = "1000000656567"
+		code, resp := postJSON("POST", "/patient/search", token, tc.input)
+		if !tc.found {
+			assert.Equal(t, http.StatusNotFound, code, "%+v", tc.input)
+		} else if assert.Equal(t, http.StatusOK, code, "%+v", tc.input) {
+			score := resp["patients"].([]any)[0].(map[string]any)["MatchScore"]
+			assert.Greater(t, score, 0.0, "%+v", tc.input)
+		}
+		config.DB.Where("1 = 1").Delete(&models.NegativeLookup{})
+	}
+
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{NationalID: "1000000656567", NameMatch: "sounds-like"})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestRankByName(t *testing.T) {
+	ranked := rankByName([]models.Patient{
+		{ID: 1, FirstNameEN: "Somchia", LastNameEN: "Jaidee"},
+		{ID: 2, FirstNameEN: "Wichai", LastNameEN: "Jaidee"},
+		{ID: 3, FirstNameEN: "Somchai", LastNameEN: "Jaidee"},
+	}, PatientSearchInput{FirstName: "somchai", LastName: "Jaidee", NameMatch: NameMatchFuzzy})
+	require.Len(t, ranked, 2)
+	assert.Equal(t, uint(3), ranked[0].ID)
+	assert.Equal(t, 1.0, ranked[0].MatchScore)
+	assert.Equal(t, uint(1), ranked[1].ID)
+	assert.Less(t, ranked[1].MatchScore, 1.0)
+}
+
+func TestSearchPatient_Demographic(t *testing.T) {
+	calls := 0
+	upstream.Transport = &MockHTTPTransport{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil)), Header: make(http.Header)}, nil
+		},
+	}
+	defer func() { upstream.Transport = nil }()
+
+	//a walk-in patient registered without identity documents
+	code, _ := postJSON("POST", "/patients", adminToken(models.RoleRegistration), models.PatientInput{
+		FirstNameEN: "Walkin", LastNameEN: "Patient", HN: "HN-WALKIN-1", DateOfBirth: "1990-06-15", PhoneNumber: "089-111-2222",
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	token := adminToken(models.RoleDoctor)
+	code, resp := postJSON("POST", "/patient/search", token, PatientSearchInput{LastName: "Patient", DateOfBirth: "15/06/1990"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HN-WALKIN-1", resp["patients"].([]any)[0].(map[string]any)["HN"])
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{FirstName: "Walkin", PhoneNumber: "+66891112222"})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{FirstName: "Walkin", PhoneNumber: "0899999999"})
+	assert.Equal(t, http.StatusNotFound, code)
+	code, resp = postJSON("POST", "/patient/search", token, PatientSearchInput{FirstName: "Walkin", Federated: true})
+	assert.Equal(t, http.StatusBadRequest, code, "a first name alone is not enough")
+	assert.Contains(t, resp["error"], "last_name + date_of_birth")
+	code, resp = postJSON("POST", "/patient/search", token, PatientSearchInput{LastName: "Patient", DateOfBirth: "1990", Federated: true})
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp["patients"], 1)
+	assert.Zero(t, calls, "hospital systems are only searched by identifier")
+
+	config.SearchDemographicRules = "last_name+age"
+	defer func() { config.SearchDemographicRules = "last_name+date_of_birth;first_name+phone_number;first_name+email" }()
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{LastName: "Patient", DateOfBirth: "1990-06-15"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postJSON("POST", "/patient/search", token, PatientSearchInput{LastName: "Patient", AgeMin: intPtr(18)})
+	assert.Equal(t, http.StatusOK, code)
+	config.SearchDemographicRules = "none"
+	code, resp = postJSON("POST", "/patient/search", token, PatientSearchInput{LastName: "Patient", AgeMin: intPtr(18)})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "At least national_id, passport_id or hn must be provided", resp["error"])
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func TestListHospitals_Pagination(t *testing.T) {
+	token := adminToken(models.RoleSystemAdmin)
+	for _, code := range []string{"PAGE1", "PAGE2", "PAGE3"} {
+		status, _ := postJSON("POST", "/admin/hospitals", token, models.HospitalInput{Name: code + " Hospital", Code: code})
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	var ids []float64
+	path := "/admin/hospitals?limit=2&include_total=true&fields=ID,Code"
+	for {
+		code, resp := postJSON("GET", path, token, nil)
+		require.Equal(t, http.StatusOK, code)
+		hospitals := resp["hospitals"].([]any)
+		assert.LessOrEqual(t, len(hospitals), 2)
+		for _, hospital := range hospitals {
+			assert.Len(t, hospital, 2, "only the fields asked for")
+			ids = append(ids, hospital.(map[string]any)["ID"].(float64))
+		}
+		total := resp["total"].(float64)
+		cursor, more := resp["next_cursor"].(string)
+		if !more {
+			assert.Len(t, ids, int(total))
+			break
+		}
+		path = "/admin/hospitals?limit=2&include_total=true&fields=ID,Code&cursor=" + cursor
+	}
+	assert.IsIncreasing(t, ids)
+
+	code, resp := postJSON("GET", "/admin/hospitals?sort=-code&limit=3", token, nil)
+	require.Equal(t, http.StatusOK, code)
+	var codes []string
+	for _, hospital := range resp["hospitals"].([]any) {
+		codes = append(codes, hospital.(map[string]any)["Code"].(string))
+	}
+	assert.IsDecreasing(t, codes)
+
+	for _, query := range []string{"limit=0", "limit=101", "sort=base_url", "cursor=nonsense", "fields=Nope", "include_total=maybe"} {
+		code, _ := postJSON("GET", "/admin/hospitals?"+query, token, nil)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+	//a cursor only continues the sort it was issued for
+	_, resp = postJSON("GET", "/admin/hospitals?limit=1", token, nil)
+	code, _ = postJSON("GET", "/admin/hospitals?sort=code&cursor="+resp["next_cursor"].(string), token, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestSearchPatient_Pagination(t *testing.T) {
+	registration := adminToken(models.RoleRegistration)
+	for i, dateOfBirth := range []string{"1985-01-10", "1985-07-04", "1985-03-22"} {
+		code, _ := postJSON("POST", "/patients", registration, models.PatientInput{
+			FirstNameEN: "Page", LastNameEN: "Pager", HN: fmt.Sprintf("HN-PAGE-%d", i), DateOfBirth: dateOfBirth,
+		})
+		require.Equal(t, http.StatusOK, code)
+	}
+	token := adminToken(models.RoleDoctor)
+	search := PatientSearchInput{LastName: "Pager", DateOfBirth: "1985"}
+
+	code, resp := postJSON("POST", "/patient/search?limit=2&sort=-date_of_birth&include_total=true&fields=HN", token, search)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{map[string]any{"HN": "HN-PAGE-1"}, map[string]any{"HN": "HN-PAGE-2"}}, resp["patients"])
+	assert.Equal(t, 3.0, resp["total"])
+	code, resp = postJSON("POST", "/patient/search?limit=2&sort=-date_of_birth&fields=HN&cursor="+resp["next_cursor"].(string), token, search)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{map[string]any{"HN": "HN-PAGE-0"}}, resp["patients"])
+	assert.NotContains(t, resp, "next_cursor")
+
+	code, _ = postJSON("POST", "/patient/search?sort=score", token, search)
+	assert.Equal(t, http.StatusBadRequest, code, "only ranked searches sort by score")
+	ranked := PatientSearchInput{FirstName: "Pag", LastName: "Pager", DateOfBirth: "1985", NameMatch: NameMatchPrefix}
+	code, _ = postJSON("POST", "/patient/search?sort=last_name", token, ranked)
+	assert.Equal(t, http.StatusBadRequest, code, "ranked searches sort by score only")
+	seen := map[string]bool{}
+	path := "/patient/search?limit=1"
+	for range 3 {
+		code, resp = postJSON("POST", path, token, ranked)
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, resp["patients"], 1)
+		seen[resp["patients"].([]any)[0].(map[string]any)["HN"].(string)] = true
+		if cursor, more := resp["next_cursor"].(string); more {
+			path = "/patient/search?limit=1&cursor=" + cursor
+		}
+	}
+	assert.Len(t, seen, 3)
+	assert.NotContains(t, resp, "next_cursor")
+
+	search.Federated = true
+	code, resp = postJSON("POST", "/patient/search?limit=1&fields=HN,Source", token, search)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp["patients"], 1)
+	assert.Equal(t, "local", resp["patients"].([]any)[0].(map[string]any)["Source"].(map[string]any)["origin"])
+	assert.Equal(t, 3.0, resp["sources"].([]any)[0].(map[string]any)["count"], "counted over every page")
+	assert.Contains(t, resp, "next_cursor")
+}
+
+// storeElsewhere stores a copy fetched from the system of another hospital.
+func storeElsewhere(t *testing.T, hospitalID uint, patient models.Patient) models.Patient {
+	patient.HospitalID = hospitalID
+	normalizePatient(&patient)
+	require.Equal(t, CodedError{}, storeInDB(&patient))
+	return patient
+}
+
+func TestMasterPatientIndex(t *testing.T) {
+	other := models.Hospital{Name: "MPI Hospital", Code: "MPI"}
+	require.NoError(t, config.DB.Create(&other).Error)
+	registration, admin := adminToken(models.RoleRegistration), adminToken(models.RoleAdmin)
+
+	//the same national ID is the same person
+	elsewhere := storeElsewhere(t, other.ID, models.Patient{FirstNameEN: "Anan", LastNameEN: "Srisuk", NationalID: "1000000666562", HN: hospitalNumber("MPI-1")})
+	require.NotNil(t, elsewhere.EnterprisePatientID)
+	code, resp := postJSON("POST", "/patients", registration, models.PatientInput{FirstNameEN: "Anan", LastNameEN: "Srisuk", NationalID: "1000000666562", HN: "HN-MPI-1"})
+	require.Equal(t, http.StatusOK, code)
+	linked := resp["patient"].(map[string]any)
+	assert.Equal(t, float64(*elsewhere.EnterprisePatientID), linked["EnterprisePatientID"])
+
+	//only records of hospitals the caller may access are shown
+	code, resp = postJSON("GET", fmt.Sprintf("/mpi/enterprise-patients/%d", *elsewhere.EnterprisePatientID), adminToken(models.RoleDoctor), nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp["patients"], 1)
+	assert.Equal(t, linked["ID"], resp["patients"].([]any)[0].(map[string]any)["ID"])
+
+	//alike but not certainly the same person: queued for review
+	elsewhere = storeElsewhere(t, other.ID, models.Patient{FirstNameEN: "Somchay", LastNameEN: "Mitmak", DateOfBirth: models.NewPartialDate(time.Date(1985, 1, 1, 0, 0, 0, 0, time.UTC), models.DatePrecisionYear), HN: hospitalNumber("MPI-2")})
+	code, resp = postJSON("POST", "/patients", registration, models.PatientInput{FirstNameEN: "Somchai", LastNameEN: "Mitmak", DateOfBirth: "1985-03-22", HN: "HN-MPI-2"})
+	require.Equal(t, http.StatusOK, code)
+	local := resp["patient"].(map[string]any)
+	assert.NotEqual(t, float64(*elsewhere.EnterprisePatientID), local["EnterprisePatientID"])
+
+	code, resp = postJSON("GET", "/mpi/reviews", admin, nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp["reviews"], 1)
+	review := resp["reviews"].([]any)[0].(map[string]any)
+	assert.Equal(t, "pending", review["Status"])
+	assert.NotContains(t, review, "Patient", "records of hospitals the steward may not access are left out")
+	assert.Equal(t, float64(elsewhere.ID), review["PatientID"])
+	assert.Equal(t, "Somchai", review["Candidate"].(map[string]any)["FirstNameEN"])
+
+	//a steward granted access to the other hospital sees both records
+	steward := models.Staff{Username: "mpi-steward", Role: models.RoleAdmin, HospitalID: 1}
+	require.NoError(t, config.DB.Create(&steward).Error)
+	require.NoError(t, config.DB.Create(&models.StaffHospitalAccess{StaffID: steward.ID, HospitalID: other.ID}).Error)
+	stewardToken, _ := utils.GenerateJWT(steward, models.Hospital{ID: 1, Name: "Test Hospital"})
+	code, resp = postJSON("GET", "/mpi/reviews", stewardToken, nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Somchay", resp["reviews"].([]any)[0].(map[string]any)["Patient"].(map[string]any)["FirstNameEN"])
+	reviewPath := fmt.Sprintf("/mpi/reviews/%v/resolve", review["ID"])
+
+	code, _ = postJSON("POST", reviewPath, adminToken(models.RoleDoctor), models.MatchReviewDecisionInput{Decision: "link"})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = postJSON("POST", "/mpi/reviews/id%3E0/resolve", admin, models.MatchReviewDecisionInput{Decision: "link"})
+	assert.Equal(t, http.StatusNotFound, code, "ids are numbers, never SQL")
+	code, _ = postJSON("POST", reviewPath, admin, models.MatchReviewDecisionInput{Decision: "maybe"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postJSON("POST", reviewPath, admin, models.MatchReviewDecisionInput{Decision: "link"})
+	require.Equal(t, http.StatusOK, code)
+	code, _ = postJSON("POST", reviewPath, admin, models.MatchReviewDecisionInput{Decision: "reject"})
+	assert.Equal(t, http.StatusConflict, code)
+	code, resp = postJSON("GET", fmt.Sprintf("/patients/%v", local["ID"]), registration, nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(*elsewhere.EnterprisePatientID), resp["patient"].(map[string]any)["EnterprisePatientID"])
+
+	//unlinked records stay apart, even when indexed again
+	unlinkPath := fmt.Sprintf("/mpi/links/%v", local["ID"])
+	code, resp = postJSON("DELETE", unlinkPath, admin, nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, float64(*elsewhere.EnterprisePatientID), resp["enterprise_patient_id"])
+	code, _ = postJSON("DELETE", unlinkPath, admin, nil)
+	assert.Equal(t, http.StatusConflict, code)
+	phone := "081-999-0000"
+	code, _ = postJSON("PATCH", fmt.Sprintf("/patients/%v", local["ID"]), registration, models.PatientUpdateInput{PhoneNumber: &phone})
+	require.Equal(t, http.StatusOK, code)
+	code, resp = postJSON("GET", "/mpi/reviews", admin, nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp["reviews"])
+	code, resp = postJSON("GET", "/mpi/reviews?status=rejected&include_total=true", admin, nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp["reviews"], 1)
+	assert.Equal(t, 1.0, resp["total"])
+
+	//and are linked again only by hand, by a steward who may access both records
+	code, _ = postJSON("POST", "/mpi/links", admin, models.PatientLinkInput{PatientID: uint(local["ID"].(float64)), OtherPatientID: elsewhere.ID})
+	assert.Equal(t, http.StatusNotFound, code)
+	code, resp = postJSON("POST", "/mpi/links", stewardToken, models.PatientLinkInput{PatientID: uint(local["ID"].(float64)), OtherPatientID: elsewhere.ID})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(*elsewhere.EnterprisePatientID), resp["enterprise_patient_id"], "the older enterprise patient is kept")
+	code, _ = postJSON("POST", "/mpi/links", admin, models.PatientLinkInput{PatientID: elsewhere.ID, OtherPatientID: uint(local["ID"].(float64))})
+	assert.Equal(t, http.StatusNotFound, code, "the first record must be the caller's hospital's")
+}
+
+func TestMatchCandidates_IdentifierMatchesAreNotLimited(t *testing.T) {
+	other := models.Hospital{Name: "Blocking Hospital", Code: "BLOCK"}
+	require.NoError(t, config.DB.Create(&other).Error)
+	birth := models.NewPartialDate(time.Date(1901, 2, 3, 0, 0, 0, 0, time.UTC), models.DatePrecisionDay)
+	blocked := make([]models.Patient, maxMatchCandidates+1)
+	for i := range blocked {
+		blocked[i] = models.Patient{FirstNameEN: "Blocked", LastNameEN: "Candidate", DateOfBirth: birth, HospitalID: other.ID}
+	}
+	require.NoError(t, config.DB.Create(&blocked).Error)
+	same := models.Patient{FirstNameEN: "Same", LastNameEN: "Person", NationalID: "1000000676762", HospitalID: other.ID}
+	require.NoError(t, config.DB.Create(&same).Error)
+	defer config.DB.Unscoped().Where("hospital_id = ?", other.ID).Delete(&models.Patient{})
+
+	//the record sharing the national ID comes after every record sharing the birth date
+	candidates, err := matchCandidates(config.DB, models.Patient{ID: same.ID + 1, NationalID: "1000000676762", DateOfBirth: birth, HospitalID: 1})
+	require.NoError(t, err)
+	assert.Len(t, candidates, maxMatchCandidates+1)
+	assert.Equal(t, same.ID, candidates[0].ID)
+}
+
+func TestStoreInDB_RejectsBlankPatient(t *testing.T) {
+	assert.NotEqual(t, CodedError{}, storeInDB(&models.Patient{HospitalID: 1}))
+	assert.NotEqual(t, CodedError{}, storeInDB(&models.Patient{HospitalID: 1, NationalID: "1111"}))
+}
+
+func TestStoreInDB_KeepsLocalAndDeletedRecords(t *testing.T) {
+	fetchedAt := time.Now()
+
+	//a record registered here is not overwritten by the hospital system's copy
+	localHN := "HN-LOCAL-1"
+	local := models.Patient{FirstNameEN: "Registered", LastNameEN: "Here", HN: &localHN, HospitalID: 1}
+	require.NoError(t, config.DB.Create(&local).Error)
+	fetched := models.Patient{FirstNameEN: "Fetched", LastNameEN: "There", HN: &localHN, HospitalID: 1, FetchedAt: &fetchedAt}
+	require.Equal(t, CodedError{}, storeInDB(&fetched))
+	assert.Equal(t, local.ID, fetched.ID)
+	assert.Equal(t, "Registered", fetched.FirstNameEN)
+	var stored models.Patient
+	config.DB.First(&stored, local.ID)
+	assert.Equal(t, "Registered", stored.FirstNameEN)
+	assert.Nil(t, stored.FetchedAt)
+
+	//a deleted copy stays deleted
+	deletedHN := "HN-DELETED-1"
+	deleted := models.Patient{FirstNameEN: "Deleted", LastNameEN: "Copy", HN: &deletedHN, HospitalID: 1, FetchedAt: &fetchedAt}
+	require.Equal(t, CodedError{}, storeInDB(&deleted))
+	require.NoError(t, config.DB.Delete(&deleted).Error)
+	again := models.Patient{FirstNameEN: "Deleted", LastNameEN: "Copy", HN: &deletedHN, HospitalID: 1, FetchedAt: &fetchedAt}
+	assert.Equal(t, http.StatusConflict, storeInDB(&again).Code)
+	assert.ErrorIs(t, config.DB.First(&models.Patient{}, deleted.ID).Error, gorm.ErrRecordNotFound)
+}
+
 func TestSearchPatient_ExternalAPIWrongHospital(t *testing.T) {
     // Setup
 	config.DB.Where("1 = 1").Delete(&models.Patient{})
 
     hospital := models.Hospital{ID: 1, Name: "Wrong Test Hospital"}
-    token, _ := utils.GenerateJWT("testuser", hospital)
+    token, _ := utils.GenerateJWT(models.Staff{Username: "testuser", Role: models.RoleDoctor}, hospital)
 
     // Create a custom HTTP client with our mock transport
     mockTransport := &MockHTTPTransport{
@@ -404,8 +2003,9 @@ func TestSearchPatient_ExternalAPIWrongHospital(t *testing.T) {
             externalPatient := models.PatientExternal{
                 FirstNameEN: "External",
                 LastNameEN:  "Patient",
-                NationalID: "90987",
-                PatientHN:  "Different Hospital",
+                NationalID: "1000000909872",
+                PatientHN:  "HN-90987",
+                HospitalCode: "OTHER",
                 FirstNameTH:  "ชื่อ",
                 LastNameTH:   "นามสกุล",
                 DateOfBirth:  "2000-01-01",
@@ -423,13 +2023,12 @@ func TestSearchPatient_ExternalAPIWrongHospital(t *testing.T) {
     }
 
     // Replace the default transport with our mock
-    oldTransport := http.DefaultTransport
-    http.DefaultTransport = mockTransport
-    defer func() { http.DefaultTransport = oldTransport }()
+    upstream.Transport = mockTransport
+    defer func() { upstream.Transport = nil }()
 
     // Test
     w := httptest.NewRecorder()
-    input := PatientSearchInput{NationalID: "98765"}
+    input := PatientSearchInput{NationalID: "1000000987652"}
     body, _ := json.Marshal(input)
     req, _ := http.NewRequest("POST", "/patient/search", bytes.NewBuffer(body))
     req.Header.Set("Content-Type", "application/json")
@@ -452,8 +2051,8 @@ func TestStoreInDB_Failure(t *testing.T) {
     config.DB = db
     
     // Should fail due to missing required fields
-    stored := storeInDB(invalidPatient)
-    assert.False(t, stored)
+    stored := storeInDB(&invalidPatient)
+    assert.NotEqual(t, CodedError{}, stored)
 }
 
 // Test LoginStaff staff not found
@@ -487,13 +2086,12 @@ func TestGetClaimsFromToken_InvalidType(t *testing.T) {
 
 // Test callExternalAPI response parse error
 func TestCallExternalAPI_ParseError(t *testing.T) {
-    claims := &utils.Claims{HospitalName: "Test Hospital"}
+    claims := &utils.Claims{HospitalID: 1, HospitalName: "Test Hospital"}
     
     // Setup mock transport with invalid JSON
-    oldTransport := http.DefaultTransport
-    defer func() { http.DefaultTransport = oldTransport }()
+    defer func() { upstream.Transport = nil }()
     
-    http.DefaultTransport = &MockHTTPTransport{
+    upstream.Transport = &MockHTTPTransport{
         RoundTripFunc: func(req *http.Request) (*http.Response, error) {
             return &http.Response{
                 StatusCode: http.StatusOK,
@@ -502,6 +2100,6 @@ func TestCallExternalAPI_ParseError(t *testing.T) {
         },
     }
     
-    _, err := callExternalAPI(PatientSearchInput{NationalID: "123"}, claims)
+    _, err := callExternalAPI(context.Background(), PatientSearchInput{NationalID: "123"}, claims)
     assert.Equal(t, http.StatusInternalServerError, err.Code)
 }
\ No newline at end of file
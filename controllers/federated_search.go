@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/upstream"
+	"agnos-hospital-middleware/utils"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Per-source outcomes of a federated search.
+const (
+	SourceOK          = "ok"
+	SourceNotFound    = "not_found"
+	SourceSkipped     = "skipped" // no upstream system configured, or it cannot do the lookup
+	SourceDenied      = "denied"
+	SourceTimeout     = "timeout"
+	SourceUnavailable = "unavailable"
+	SourceError       = "error"
+)
+
+// Patient origins in a federated search.
+const (
+	OriginLocal    = "local"
+	OriginUpstream = "upstream"
+	// a recent upstream miss, not asked again
+	OriginNegativeCache = "negative_cache"
+)
+
+// PatientProvenance tells which hospital a federated result belongs to and
+// whether it came from the local database or the hospital system.
+type PatientProvenance struct {
+	HospitalID   uint   `json:"hospital_id"`
+	HospitalCode string `json:"hospital_code"`
+	Origin       string `json:"origin"`
+}
+
+type FederatedPatient struct {
+	models.Patient
+	Source PatientProvenance
+}
+
+type SourceStatus struct {
+	HospitalID   uint   `json:"hospital_id"`
+	HospitalCode string `json:"hospital_code"`
+	Status       string `json:"status"`
+	Origin       string `json:"origin,omitempty"`
+	Count        int    `json:"count"`
+	Error        string `json:"error,omitempty"`
+	ErrorCode    string `json:"code,omitempty"`
+}
+
+type upstreamResult struct {
+	index    int
+	patients []models.Patient
+	err      CodedError
+}
+
+/*
+-> collect the hospitals the caller may search: their own plus granted ones
+-> one local query across all of them, a page at a time
+-> on the first page, hospitals without a local match are asked concurrently under one deadline
+-> store what the hospital systems returned
+-> answer with the page, the hospital systems' results, their provenance and a status per hospital
+*/
+func searchFederated(c *gin.Context, claims *utils.Claims, input PatientSearchInput, page pageRequest) {
+	hospitals, err := accessibleHospitals(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load hospitals"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.FederatedSearchTimeout)
+	defer cancel()
+
+	hospitalIDs := make([]uint, len(hospitals))
+	for i, hospital := range hospitals {
+		hospitalIDs[i] = hospital.ID
+	}
+	if page.cursor == nil {
+		//what the hospital systems return now is on this page only, later pages leave it out
+		config.DB.Unscoped().Model(&models.Patient{}).Select("COALESCE(MAX(id), 0)").Scan(&page.maxID)
+	}
+	matches := localMatchCounts(hospitalIDs, input, page)
+	local, localPage := fetchFromLocalHospitals(hospitalIDs, input, page)
+	hospitalsByID := map[uint]models.Hospital{}
+	for _, hospital := range hospitals {
+		hospitalsByID[hospital.ID] = hospital
+	}
+
+	patients := []FederatedPatient{}
+	for _, patient := range local {
+		hospital := hospitalsByID[patient.HospitalID]
+		//never wait on a refresh here, the deadline is for hospitals without a copy
+		if cacheStateOf(patient, hospital, time.Now()) != cacheFresh {
+			refreshInBackground(hospital, patient)
+		}
+		patients = append(patients, FederatedPatient{Patient: patient, Source: provenance(hospital, OriginLocal)})
+	}
+
+	statuses := make([]SourceStatus, len(hospitals))
+	results := make(chan upstreamResult, len(hospitals))
+	pending := 0
+	for i, hospital := range hospitals {
+		statuses[i] = SourceStatus{HospitalID: hospital.ID, HospitalCode: hospital.Code}
+		if matches[hospital.ID] > 0 {
+			statuses[i].Status, statuses[i].Origin, statuses[i].Count = SourceOK, OriginLocal, matches[hospital.ID]
+			continue
+		}
+		if !hasIdentifier(input) {
+			//hospital systems are only searched by identifier
+			statuses[i].Status, statuses[i].Origin = SourceNotFound, OriginLocal
+			continue
+		}
+		if page.cursor != nil {
+			//asked on the first page
+			statuses[i].Status = SourceSkipped
+			continue
+		}
+		if !hospital.Enabled || hospital.BaseURL == "" {
+			statuses[i].Status = SourceSkipped
+			continue
+		}
+		if negativeLookupHit(hospital.ID, input) {
+			statuses[i].Status, statuses[i].Origin = SourceNotFound, OriginNegativeCache
+			continue
+		}
+		source, sourceErr := upstreamSource(hospital)
+		if sourceErr != (CodedError{}) {
+			statuses[i].Status, statuses[i].Origin, statuses[i].Error = SourceError, OriginUpstream, sourceErr.Error
+			continue
+		}
+		pending++
+		go func(index int, hospital models.Hospital, source upstream.PatientSource) {
+			found, err := searchSource(ctx, hospital, source, input)
+			results <- upstreamResult{index: index, patients: found, err: err}
+		}(i, hospital, source)
+	}
+
+	//wait for the hospital systems, but never past the deadline
+	var answered []upstreamResult
+collect:
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			answered = append(answered, result)
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	for _, result := range answered {
+		status := &statuses[result.index]
+		status.Origin = OriginUpstream
+		hospital := hospitals[result.index]
+		if result.err != (CodedError{}) {
+			status.Status, status.Error, status.ErrorCode = sourceStatusFor(result.err), result.err.Error, result.err.ErrorCode
+			if status.Status == SourceNotFound {
+				recordNegativeLookup(hospital.ID, input)
+			}
+			continue
+		}
+		for _, patient := range result.patients {
+			if err := storeInDB(&patient); err != (CodedError{}) {
+				status.Status, status.Error = SourceError, err.Error
+				break
+			}
+			patients = append(patients, FederatedPatient{Patient: patient, Source: provenance(hospital, OriginUpstream)})
+			status.Count++
+		}
+		if status.Status == "" {
+			status.Status = SourceOK
+		}
+	}
+
+	partial, anyAnswered := false, false
+	for i := range statuses {
+		if statuses[i].Status == "" {
+			statuses[i].Status, statuses[i].Origin, statuses[i].Error = SourceTimeout, OriginUpstream, "No answer before the search deadline"
+		}
+		switch statuses[i].Status {
+		case SourceOK, SourceNotFound:
+			anyAnswered = true
+		case SourceSkipped:
+		default:
+			partial = true
+		}
+	}
+
+	if !anyAnswered && partial {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "No hospital system answered", "sources": statuses})
+		return
+	}
+
+	respondPage(c, gin.H{"message": "Success", "sources": statuses, "partial": partial}, "patients", patients, page, localPage)
+}
+
+// localMatchCounts counts a search's local matches per hospital, over all
+// pages.
+func localMatchCounts(hospitalIDs []uint, input PatientSearchInput, page pageRequest) map[uint]int {
+	counts := map[uint]int{}
+	query := localPatientQuery(hospitalIDs, input, page)
+	if rankedNameSearch(input) {
+		var patients []models.Patient
+		query.Order("id").Limit(maxRankedCandidates).Find(&patients)
+		for _, patient := range rankByName(patients, input) {
+			counts[patient.HospitalID]++
+		}
+		return counts
+	}
+	var rows []struct {
+		HospitalID uint
+		Matches    int
+	}
+	query.Model(&models.Patient{}).Select("hospital_id, COUNT(*) AS matches").Group("hospital_id").Scan(&rows)
+	for _, row := range rows {
+		counts[row.HospitalID] = row.Matches
+	}
+	return counts
+}
+
+// accessibleHospitals returns the caller's own hospital and those granted to
+// them through StaffHospitalAccess.
+func accessibleHospitals(claims *utils.Claims) ([]models.Hospital, error) {
+	db := config.DB
+
+	hospitalIDs := []uint{claims.HospitalID}
+	if claims.StaffID != 0 {
+		var granted []uint
+		if err := db.Model(&models.StaffHospitalAccess{}).Where("staff_id = ?", claims.StaffID).Pluck("hospital_id", &granted).Error; err != nil {
+			return nil, err
+		}
+		hospitalIDs = append(hospitalIDs, granted...)
+	}
+
+	var hospitals []models.Hospital
+	err := db.Where("id IN ?", hospitalIDs).Order("id").Find(&hospitals).Error
+	return hospitals, err
+}
+
+func provenance(hospital models.Hospital, origin string) PatientProvenance {
+	return PatientProvenance{HospitalID: hospital.ID, HospitalCode: hospital.Code, Origin: origin}
+}
+
+func sourceStatusFor(err CodedError) string {
+	switch err.Code {
+	case http.StatusNotFound:
+		return SourceNotFound
+	case http.StatusForbidden:
+		return SourceDenied
+	case http.StatusGatewayTimeout:
+		return SourceTimeout
+	case http.StatusServiceUnavailable:
+		return SourceUnavailable
+	case http.StatusNotImplemented:
+		return SourceSkipped
+	}
+	return SourceError
+}
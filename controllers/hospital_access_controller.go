@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+var hospitalAccessList = listSpec{
+	sorts:       map[string]string{"id": "id", "hospital_id": "hospital_id", "created_at": "created_at"},
+	defaultSort: "hospital_id",
+	item:        models.StaffHospitalAccess{},
+}
+
+// ListHospitalAccess lists the extra hospitals a staff member may search.
+func ListHospitalAccess(c *gin.Context) {
+	staff, findErr := findManagedStaff(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+	page, pageErr := parsePage(c, hospitalAccessList)
+	if pageErr != (CodedError{}) {
+		c.JSON(pageErr.Code, gin.H{"error": pageErr.Error})
+		return
+	}
+
+	grants, result, err := paginate[models.StaffHospitalAccess](config.DB.Where("staff_id = ?", staff.ID), page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list hospital access"})
+		return
+	}
+
+	respondPage(c, gin.H{}, "hospital_access", grants, page, result)
+}
+
+/*
+-> only system administrators reach here (see routes)
+-> the hospital must exist and not be the staff member's own
+-> granting twice is a no-op
+*/
+func GrantHospitalAccess(c *gin.Context) {
+	var input models.HospitalAccessInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, findErr := findManagedStaff(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	db := config.DB
+
+	var hospital models.Hospital
+	if err := db.First(&hospital, input.HospitalID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hospital not found"})
+		return
+	}
+	if hospital.ID == staff.HospitalID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Staff already have access to their own hospital"})
+		return
+	}
+
+	grant := models.StaffHospitalAccess{StaffID: staff.ID, HospitalID: hospital.ID}
+	if claims, err := getClaimsFromToken(c); err == (CodedError{}) && claims.StaffID != 0 {
+		grantedBy := claims.StaffID
+		grant.GrantedByID = &grantedBy
+	}
+	result := db.Where("staff_id = ? AND hospital_id = ?", staff.ID, hospital.ID).FirstOrCreate(&grant)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant hospital access"})
+		return
+	}
+	if result.RowsAffected > 0 {
+		recordAudit(c, models.AuditHospitalAccessGranted, staff.HospitalID, &staff.ID, fmt.Sprintf("hospital %s", hospital.Code))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Hospital access granted", "hospital_access": grant})
+}
+
+func RevokeHospitalAccess(c *gin.Context) {
+	staff, findErr := findManagedStaff(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	hospitalID, err := strconv.ParseUint(c.Param("hospital_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hospital access not found"})
+		return
+	}
+
+	result := config.DB.Where("staff_id = ? AND hospital_id = ?", staff.ID, hospitalID).Delete(&models.StaffHospitalAccess{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke hospital access"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hospital access not found"})
+		return
+	}
+	recordAudit(c, models.AuditHospitalAccessRevoked, staff.HospitalID, &staff.ID, fmt.Sprintf("hospital %d", hospitalID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Hospital access revoked"})
+}
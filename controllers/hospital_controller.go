@@ -0,0 +1,292 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/upstream"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var hospitalCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{1,31}$`)
+
+/*
+-> only system administrators reach here (see routes)
+-> validate the code and upstream settings
+-> reject duplicate names and codes
+-> push to DB
+*/
+func CreateHospital(c *gin.Context) {
+	var input models.HospitalInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hospital := models.Hospital{
+		Name:                      input.Name,
+		Code:                      strings.ToUpper(strings.TrimSpace(input.Code)),
+		BaseURL:                   input.BaseURL,
+		Adapter:                   input.Adapter,
+		AdapterConfig:             input.AdapterConfig,
+		AuthMethod:                input.AuthMethod,
+		AuthCredential:            input.AuthCredential,
+		ConnectTimeoutMs:          input.ConnectTimeoutMs,
+		TimeoutMs:                 input.TimeoutMs,
+		MaxRetries:                2,
+		CacheTTLSeconds:           86400,
+		CacheRefreshAheadPercent:  80,
+		CacheStaleWhileRevalidate: input.CacheStaleWhileRevalidate,
+		Enabled:                   true,
+	}
+	if hospital.AuthMethod == "" {
+		hospital.AuthMethod = models.HospitalAuthNone
+	}
+	if hospital.Adapter == "" {
+		hospital.Adapter = models.HospitalAdapterStandard
+	}
+	if hospital.ConnectTimeoutMs == 0 {
+		hospital.ConnectTimeoutMs = 3000
+	}
+	if hospital.TimeoutMs == 0 {
+		hospital.TimeoutMs = 10000
+	}
+	if input.MaxRetries != nil {
+		hospital.MaxRetries = *input.MaxRetries
+	}
+	if input.CacheTTLSeconds != nil {
+		hospital.CacheTTLSeconds = *input.CacheTTLSeconds
+	}
+	if input.CacheRefreshAheadPercent != nil {
+		hospital.CacheRefreshAheadPercent = *input.CacheRefreshAheadPercent
+	}
+	if input.Enabled != nil {
+		hospital.Enabled = *input.Enabled
+	}
+	if err := validateHospital(hospital); err != (CodedError{}) {
+		c.JSON(err.Code, gin.H{"error": err.Error})
+		return
+	}
+
+	db := config.DB
+
+	var existing int64
+	db.Model(&models.Hospital{}).Where("name = ? OR code = ?", hospital.Name, hospital.Code).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Hospital already exists"})
+		return
+	}
+
+	//select all columns so an explicit enabled=false is not replaced by the column default
+	if err := db.Select("*").Create(&hospital).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create hospital"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Hospital created", "hospital": hospital})
+}
+
+var hospitalList = listSpec{
+	sorts:       map[string]string{"id": "id", "name": "name", "code": "code"},
+	defaultSort: "id",
+	item:        models.Hospital{},
+}
+
+func ListHospitals(c *gin.Context) {
+	page, pageErr := parsePage(c, hospitalList)
+	if pageErr != (CodedError{}) {
+		c.JSON(pageErr.Code, gin.H{"error": pageErr.Error})
+		return
+	}
+
+	hospitals, result, err := paginate[models.Hospital](config.DB, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list hospitals"})
+		return
+	}
+
+	respondPage(c, gin.H{}, "hospitals", hospitals, page, result)
+}
+
+func GetHospital(c *gin.Context) {
+	hospital, findErr := findHospital(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"hospital": hospital})
+}
+
+/*
+-> only system administrators reach here (see routes)
+-> apply the fields present in the input
+-> validate the result
+*/
+func UpdateHospital(c *gin.Context) {
+	var input models.HospitalUpdateInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	db := config.DB
+
+	hospital, findErr := findHospital(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	if input.Name != nil {
+		hospital.Name = *input.Name
+	}
+	if input.BaseURL != nil {
+		hospital.BaseURL = *input.BaseURL
+	}
+	if input.Adapter != nil {
+		hospital.Adapter = *input.Adapter
+	}
+	if input.AdapterConfig != nil {
+		hospital.AdapterConfig = *input.AdapterConfig
+	}
+	if input.AuthMethod != nil {
+		hospital.AuthMethod = *input.AuthMethod
+	}
+	if input.AuthCredential != nil {
+		hospital.AuthCredential = *input.AuthCredential
+	}
+	if input.ConnectTimeoutMs != nil {
+		hospital.ConnectTimeoutMs = *input.ConnectTimeoutMs
+	}
+	if input.TimeoutMs != nil {
+		hospital.TimeoutMs = *input.TimeoutMs
+	}
+	if input.MaxRetries != nil {
+		hospital.MaxRetries = *input.MaxRetries
+	}
+	if input.CacheTTLSeconds != nil {
+		hospital.CacheTTLSeconds = *input.CacheTTLSeconds
+	}
+	if input.CacheRefreshAheadPercent != nil {
+		hospital.CacheRefreshAheadPercent = *input.CacheRefreshAheadPercent
+	}
+	if input.CacheStaleWhileRevalidate != nil {
+		hospital.CacheStaleWhileRevalidate = *input.CacheStaleWhileRevalidate
+	}
+	if input.Enabled != nil {
+		hospital.Enabled = *input.Enabled
+	}
+	if input.RequireMFA != nil {
+		hospital.RequireMFA = *input.RequireMFA
+	}
+	if err := validateHospital(hospital); err != (CodedError{}) {
+		c.JSON(err.Code, gin.H{"error": err.Error})
+		return
+	}
+
+	var existing int64
+	db.Model(&models.Hospital{}).Where("(name = ? OR code = ?) AND id <> ?", hospital.Name, hospital.Code, hospital.ID).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Hospital already exists"})
+		return
+	}
+
+	if err := db.Save(&hospital).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update hospital"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Hospital updated", "hospital": hospital})
+}
+
+/*
+-> only system administrators reach here (see routes)
+-> refuse while staff or patients still belong to the hospital, disable it instead
+*/
+func DeleteHospital(c *gin.Context) {
+	db := config.DB
+
+	hospital, findErr := findHospital(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	var staffCount, patientCount int64
+	db.Model(&models.Staff{}).Where("hospital_id = ?", hospital.ID).Count(&staffCount)
+	//deleted patients are kept and still reference the hospital
+	db.Unscoped().Model(&models.Patient{}).Where("hospital_id = ?", hospital.ID).Count(&patientCount)
+	if staffCount > 0 || patientCount > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Hospital still has staff or patients, disable it instead"})
+		return
+	}
+
+	if err := db.Delete(&hospital).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete hospital"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Hospital deleted"})
+}
+
+// findHospital loads the hospital in the :id parameter.
+func findHospital(c *gin.Context) (models.Hospital, CodedError) {
+	var hospital models.Hospital
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return hospital, CodedError{Code: http.StatusNotFound, Error: "Hospital not found"}
+	}
+	if err := config.DB.First(&hospital, id).Error; err != nil {
+		return hospital, CodedError{Code: http.StatusNotFound, Error: "Hospital not found"}
+	}
+	return hospital, CodedError{}
+}
+
+func validateHospital(hospital models.Hospital) CodedError {
+	if strings.TrimSpace(hospital.Name) == "" {
+		return CodedError{Code: http.StatusBadRequest, Error: "Hospital name is required"}
+	}
+	if !hospitalCodePattern.MatchString(hospital.Code) {
+		return CodedError{Code: http.StatusBadRequest, Error: "Hospital code must be 2-32 characters of A-Z, 0-9, _ or -"}
+	}
+	if hospital.BaseURL != "" {
+		parsed, err := url.Parse(hospital.BaseURL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return CodedError{Code: http.StatusBadRequest, Error: "base_url must be an absolute http(s) URL"}
+		}
+	}
+	if !models.ValidHospitalAuthMethod(hospital.AuthMethod) {
+		return CodedError{Code: http.StatusBadRequest, Error: "Invalid auth_method"}
+	}
+	if hospital.AuthMethod != models.HospitalAuthNone && hospital.AuthCredential == "" {
+		return CodedError{Code: http.StatusBadRequest, Error: "auth_credential is required for this auth_method"}
+	}
+	if hospital.AuthMethod == models.HospitalAuthBasic && !strings.Contains(hospital.AuthCredential, ":") {
+		return CodedError{Code: http.StatusBadRequest, Error: "auth_credential for basic auth must be user:password"}
+	}
+	if hospital.ConnectTimeoutMs <= 0 || hospital.ConnectTimeoutMs > 60000 {
+		return CodedError{Code: http.StatusBadRequest, Error: "connect_timeout_ms must be between 1 and 60000"}
+	}
+	if hospital.TimeoutMs <= 0 || hospital.TimeoutMs > 120000 {
+		return CodedError{Code: http.StatusBadRequest, Error: "timeout_ms must be between 1 and 120000"}
+	}
+	if hospital.MaxRetries < 0 || hospital.MaxRetries > 5 {
+		return CodedError{Code: http.StatusBadRequest, Error: "max_retries must be between 0 and 5"}
+	}
+	if hospital.CacheTTLSeconds < 0 {
+		return CodedError{Code: http.StatusBadRequest, Error: "cache_ttl_seconds must not be negative"}
+	}
+	if hospital.CacheRefreshAheadPercent < 0 || hospital.CacheRefreshAheadPercent > 99 {
+		return CodedError{Code: http.StatusBadRequest, Error: "cache_refresh_ahead_percent must be between 0 and 99"}
+	}
+	if _, err := upstream.ForHospital(hospital); err != nil {
+		return CodedError{Code: http.StatusBadRequest, Error: "Invalid adapter: " + err.Error()}
+	}
+	return CodedError{}
+}
@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JWKS publishes the public signing keys so other services can verify the
+// tokens issued here without sharing a secret.
+func JWKS(c *gin.Context) {
+	keys, err := utils.JWKS()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load signing keys"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/utils"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ipThrottle counts failed logins per client IP in a sliding window. It is
+// in-memory, so each instance of the service keeps its own counts. IPs whose
+// failures have all left the window are swept once per window.
+type ipThrottle struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	swept    time.Time
+}
+
+var loginIPThrottle = &ipThrottle{failures: map[string][]time.Time{}}
+
+func (t *ipThrottle) blocked(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.recent(ip, time.Now())) >= config.LoginIPMaxFailures
+}
+
+func (t *ipThrottle) fail(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.failures[ip] = append(t.recent(ip, now), now)
+	if now.Sub(t.swept) >= config.LoginIPWindow {
+		for other := range t.failures {
+			t.recent(other, now)
+		}
+		t.swept = now
+	}
+}
+
+// recent drops failures outside the window. Callers must hold mu.
+func (t *ipThrottle) recent(ip string, now time.Time) []time.Time {
+	kept := t.failures[ip][:0]
+	for _, at := range t.failures[ip] {
+		if now.Sub(at) < config.LoginIPWindow {
+			kept = append(kept, at)
+		}
+	}
+	if len(kept) == 0 {
+		delete(t.failures, ip)
+		return nil
+	}
+	t.failures[ip] = kept
+	return kept
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// burnPasswordCheck runs a hash comparison against a throwaway hash so that
+// unknown users and locked accounts take as long to reject as a wrong password.
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = utils.HashPassword("not-a-real-password")
+	})
+	utils.CheckPasswordHash(password, dummyHash)
+}
+
+// loginDelay is how long after the last failure the next attempt must wait.
+func loginDelay(failures int) time.Duration {
+	if failures <= 0 || config.LoginDelayBase <= 0 {
+		return 0
+	}
+	delay := config.LoginDelayBase
+	for i := 1; i < failures && delay < config.LoginDelayMax; i++ {
+		delay *= 2
+	}
+	if delay > config.LoginDelayMax {
+		delay = config.LoginDelayMax
+	}
+	return delay
+}
+
+// loginBlocked reports whether the account may not attempt a login right now,
+// either because it is locked or because it is still inside its back-off delay.
+func loginBlocked(staff models.Staff, now time.Time) bool {
+	if staff.LockedUntil != nil && now.Before(*staff.LockedUntil) {
+		return true
+	}
+	if staff.LastFailedLoginAt != nil && now.Before(staff.LastFailedLoginAt.Add(loginDelay(staff.FailedLoginAttempts))) {
+		return true
+	}
+	return false
+}
+
+// registerFailedLogin bumps the failure counter and locks the account once it
+// reaches the threshold. The counter restarts after a lockout so the account
+// gets a fresh set of attempts when the lock expires.
+func registerFailedLogin(c *gin.Context, staff models.Staff) {
+	now := time.Now()
+	db := config.DB
+
+	db.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+		"failed_login_attempts": gorm.Expr("failed_login_attempts + 1"),
+		"last_failed_login_at":  now,
+	})
+
+	var attempts int
+	db.Model(&models.Staff{}).Where("id = ?", staff.ID).Select("failed_login_attempts").Scan(&attempts)
+	if attempts < config.LoginLockoutThreshold {
+		return
+	}
+
+	lockedUntil := now.Add(config.LoginLockoutDuration)
+	db.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+		"failed_login_attempts": 0,
+		"last_failed_login_at":  nil,
+		"locked_until":          lockedUntil,
+	})
+	recordAudit(c, models.AuditStaffLockedOut, staff.HospitalID, &staff.ID,
+		fmt.Sprintf("locked until %s after %d failed attempts", lockedUntil.Format(time.RFC3339), attempts))
+}
+
+func clearFailedLogins(staff models.Staff) {
+	if staff.FailedLoginAttempts == 0 && staff.LastFailedLoginAt == nil && staff.LockedUntil == nil {
+		return
+	}
+	config.DB.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+		"failed_login_attempts": 0,
+		"last_failed_login_at":  nil,
+		"locked_until":          nil,
+	})
+}
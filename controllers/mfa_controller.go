@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const recoveryCodeCount = 10
+
+/*
+Second step of a login for staff with MFA, or in a hospital that requires it.
+-> validate the single-use challenge token from the password step
+-> enrolled staff: check the TOTP code or a recovery code
+-> staff enrolling during login: confirm the pending secret and enable MFA
+-> failures count towards the account lockout
+-> Generate access and refresh tokens
+*/
+func LoginMFA(c *gin.Context) {
+	var input models.MFALoginInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, hospital, challenge, fetchErr := loadMFAChallenge(input.MFAToken)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	if loginBlocked(staff, time.Now()) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	var recoveryCodes []string
+	switch {
+	case staff.MFAEnabled:
+		if !verifySecondFactor(c, staff, input.Code, input.RecoveryCode) {
+			registerFailedLogin(c, staff)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+			return
+		}
+	case staff.MFAPendingSecret != "":
+		codes, ok := activateMFA(c, staff, input.Code)
+		if !ok {
+			registerFailedLogin(c, staff)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+			return
+		}
+		recoveryCodes = codes
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA enrollment required, call /staff/login/mfa/enroll first"})
+		return
+	}
+	clearFailedLogins(staff)
+
+	//the challenge token is single use
+	if err := revokeJTI(challenge.ID, challenge.ExpiresAt.Time); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+		return
+	}
+
+	tokens, err := issueTokens(config.DB, staff, hospital, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+		return
+	}
+	if recoveryCodes != nil {
+		tokens["recovery_codes"] = recoveryCodes
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+/*
+Enrollment during login, for staff of a hospital that requires MFA but who
+have not set it up yet. Only allowed before MFA is enabled.
+*/
+func LoginMFAEnroll(c *gin.Context) {
+	var input models.MFAChallengeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, _, _, fetchErr := loadMFAChallenge(input.MFAToken)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	respondWithEnrollment(c, staff)
+}
+
+// EnrollMFA starts voluntary enrollment for the authenticated staff member.
+func EnrollMFA(c *gin.Context) {
+	staff, fetchErr := currentStaff(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	respondWithEnrollment(c, staff)
+}
+
+// ActivateMFA confirms enrollment with a first code and returns recovery codes.
+func ActivateMFA(c *gin.Context) {
+	var input models.MFACodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, fetchErr := currentStaff(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	if staff.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+		return
+	}
+	if staff.MFAPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Call /staff/mfa/enroll first"})
+		return
+	}
+
+	codes, ok := activateMFA(c, staff, input.Code)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "MFA enabled", "recovery_codes": codes})
+}
+
+/*
+-> refuse when the hospital enforces MFA
+-> require the password again
+-> clear the secret and recovery codes
+*/
+func DisableMFA(c *gin.Context) {
+	var input models.MFADisableInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, fetchErr := currentStaff(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	if staff.Hospital.RequireMFA {
+		c.JSON(http.StatusForbidden, gin.H{"error": "MFA is required by your hospital"})
+		return
+	}
+	if match, _ := utils.CheckPasswordHash(input.Password, staff.Password); !match {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+			"mfa_enabled":        false,
+			"mfa_secret":         "",
+			"mfa_pending_secret": "",
+			"mfa_last_step":      0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("staff_id = ?", staff.ID).Delete(&models.MFARecoveryCode{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable MFA"})
+		return
+	}
+	recordAudit(c, models.AuditMFADisabled, staff.HospitalID, &staff.ID, "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "MFA disabled"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, given a current TOTP code.
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var input models.MFACodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, fetchErr := currentStaff(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	if !staff.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA is not enabled"})
+		return
+	}
+	if !verifySecondFactor(c, staff, input.Code, "") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(config.DB, staff.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// loadMFAChallenge validates an MFA challenge token and loads its staff member.
+func loadMFAChallenge(tokenStr string) (models.Staff, models.Hospital, *utils.Claims, CodedError) {
+	invalid := CodedError{Code: http.StatusUnauthorized, Error: "Invalid or expired MFA token"}
+
+	claims, err := utils.ValidateMFAToken(tokenStr)
+	if err != nil || models.IsTokenRevoked(config.DB, claims.ID, claims.StaffID, claims.IssuedAtTime()) {
+		return models.Staff{}, models.Hospital{}, nil, invalid
+	}
+
+	var staff models.Staff
+	if err := config.DB.Preload("Hospital").First(&staff, claims.StaffID).Error; err != nil {
+		return models.Staff{}, models.Hospital{}, nil, invalid
+	}
+	return staff, staff.Hospital, claims, CodedError{}
+}
+
+// currentStaff loads the authenticated staff member with their hospital.
+func currentStaff(c *gin.Context) (models.Staff, CodedError) {
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		return models.Staff{}, fetchErr
+	}
+
+	var staff models.Staff
+	if err := config.DB.Preload("Hospital").First(&staff, claims.StaffID).Error; err != nil {
+		return models.Staff{}, CodedError{Code: http.StatusUnauthorized, Error: "Staff not found"}
+	}
+	return staff, CodedError{}
+}
+
+// respondWithEnrollment stores a new pending secret and returns it with the
+// provisioning URI to render as a QR code.
+func respondWithEnrollment(c *gin.Context, staff models.Staff) {
+	if staff.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate MFA secret"})
+		return
+	}
+	if err := config.DB.Model(&models.Staff{}).Where("id = ?", staff.ID).Update("mfa_pending_secret", secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store MFA secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": utils.TOTPProvisioningURI(config.MFAIssuer, staff.Username, secret),
+	})
+}
+
+// activateMFA checks a code against the pending secret and, if it matches,
+// enables MFA and issues the first set of recovery codes.
+func activateMFA(c *gin.Context, staff models.Staff, code string) ([]string, bool) {
+	step, ok := utils.ValidateTOTP(staff.MFAPendingSecret, code, time.Now(), 0)
+	if !ok {
+		return nil, false
+	}
+
+	var codes []string
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+			"mfa_enabled":        true,
+			"mfa_secret":         staff.MFAPendingSecret,
+			"mfa_pending_secret": "",
+			"mfa_last_step":      step,
+		}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, staff.ID)
+		return err
+	})
+	if err != nil {
+		return nil, false
+	}
+	recordAudit(c, models.AuditMFAEnabled, staff.HospitalID, &staff.ID, "")
+	return codes, true
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func verifySecondFactor(c *gin.Context, staff models.Staff, code, recoveryCode string) bool {
+	if code != "" {
+		step, ok := utils.ValidateTOTP(staff.MFASecret, code, time.Now(), staff.MFALastStep)
+		if !ok {
+			return false
+		}
+		//only advance the last step, so a concurrent request cannot reuse the code
+		result := config.DB.Model(&models.Staff{}).
+			Where("id = ? AND mfa_last_step < ?", staff.ID, step).
+			Update("mfa_last_step", step)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	if recoveryCode != "" {
+		hash := utils.HashToken(normalizeRecoveryCode(recoveryCode))
+		result := config.DB.Model(&models.MFARecoveryCode{}).
+			Where("staff_id = ? AND code_hash = ? AND used_at IS NULL", staff.ID, hash).
+			Update("used_at", time.Now())
+		if result.Error != nil || result.RowsAffected != 1 {
+			return false
+		}
+		recordAudit(c, models.AuditMFARecoveryUse, staff.HospitalID, &staff.ID, "")
+		return true
+	}
+
+	return false
+}
+
+func replaceRecoveryCodes(db *gorm.DB, staffID uint) ([]string, error) {
+	if err := db.Where("staff_id = ?", staffID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		//10 base32 characters shown as xxxxx-xxxxx
+		code := strings.ToLower(secret[:5] + "-" + secret[5:10])
+		stored := models.MFARecoveryCode{StaffID: staffID, CodeHash: utils.HashToken(normalizeRecoveryCode(code))}
+		if err := db.Create(&stored).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
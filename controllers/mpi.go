@@ -0,0 +1,353 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/mpi"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxMatchCandidates bounds the records a patient is compared with that share
+// no identifier with it.
+const maxMatchCandidates = 500
+
+func mpiThresholds() mpi.Thresholds {
+	return mpi.Thresholds{Link: config.MPILinkThreshold, Review: config.MPIReviewThreshold}
+}
+
+type scoredCandidate struct {
+	candidate models.Patient
+	result    mpi.Result
+}
+
+/*
+-> compare the patient with the records of other hospitals that share something with it
+-> pairs a person rejected are left alone
+-> a record joins the enterprise patient of its best match, records without one join it
+-> a match linked to another enterprise patient, and a possible match, are queued for review
+-> a record matching nobody gets an enterprise patient of its own
+*/
+func indexPatient(db *gorm.DB, patient *models.Patient) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		candidates, err := matchCandidates(tx, *patient)
+		if err != nil {
+			return err
+		}
+		rejected, err := rejectedPairs(tx, patient.ID)
+		if err != nil {
+			return err
+		}
+
+		var matches, possible []scoredCandidate
+		for _, candidate := range candidates {
+			if rejected[candidate.ID] || sameEnterprisePatient(*patient, candidate) {
+				continue
+			}
+			result := mpi.Compare(*patient, candidate, mpiThresholds())
+			switch result.Decision {
+			case mpi.Match:
+				matches = append(matches, scoredCandidate{candidate, result})
+			case mpi.PossibleMatch:
+				possible = append(possible, scoredCandidate{candidate, result})
+			}
+		}
+		//identifiers first, then the best scores
+		sort.SliceStable(matches, func(i, j int) bool {
+			if ruled := matches[i].result.Rule != ""; ruled != (matches[j].result.Rule != "") {
+				return ruled
+			}
+			return matches[i].result.Score > matches[j].result.Score
+		})
+
+		for _, match := range matches {
+			candidate := match.candidate
+			switch {
+			case patient.EnterprisePatientID == nil && candidate.EnterprisePatientID == nil:
+				id, err := newEnterprisePatient(tx)
+				if err != nil {
+					return err
+				}
+				if err := setEnterprisePatient(tx, candidate.ID, id); err != nil {
+					return err
+				}
+				if err := setEnterprisePatient(tx, patient.ID, id); err != nil {
+					return err
+				}
+				patient.EnterprisePatientID = &id
+			case patient.EnterprisePatientID == nil:
+				if err := setEnterprisePatient(tx, patient.ID, *candidate.EnterprisePatientID); err != nil {
+					return err
+				}
+				patient.EnterprisePatientID = candidate.EnterprisePatientID
+			case candidate.EnterprisePatientID == nil:
+				if err := setEnterprisePatient(tx, candidate.ID, *patient.EnterprisePatientID); err != nil {
+					return err
+				}
+			case *candidate.EnterprisePatientID != *patient.EnterprisePatientID:
+				//merging two people's records is for a person to decide
+				possible = append(possible, match)
+			}
+		}
+		for _, match := range possible {
+			if err := queueMatchReview(tx, patient.ID, match.candidate.ID, match.result); err != nil {
+				return err
+			}
+		}
+
+		if patient.EnterprisePatientID == nil {
+			id, err := newEnterprisePatient(tx)
+			if err != nil {
+				return err
+			}
+			if err := setEnterprisePatient(tx, patient.ID, id); err != nil {
+				return err
+			}
+			patient.EnterprisePatientID = &id
+		}
+		return nil
+	})
+}
+
+// IndexUnlinkedPatients adds the records stored before the master patient
+// index to it, oldest first.
+func IndexUnlinkedPatients() error {
+	var ids []uint
+	if err := config.DB.Model(&models.Patient{}).Where("enterprise_patient_id IS NULL").Order("id").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var patient models.Patient
+		if err := config.DB.First(&patient, id).Error; err != nil {
+			return err
+		}
+		//linked meanwhile as another record's match
+		if patient.EnterprisePatientID != nil {
+			continue
+		}
+		if err := indexPatient(config.DB, &patient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexPatientOrLog indexes a patient that is already saved; the record
+// stays unlinked, to be indexed on the next start, if that fails.
+func indexPatientOrLog(patient *models.Patient) {
+	if err := indexPatient(config.DB, patient); err != nil {
+		log.Printf("failed to index patient %d: %v", patient.ID, err)
+	}
+}
+
+// matchingKeysChanged reports whether a record changed in a field it is
+// matched by, so it may match other records now.
+func matchingKeysChanged(before, after models.Patient) bool {
+	return before.NationalID != after.NationalID || before.PassportID != after.PassportID ||
+		before.PassportCountry != after.PassportCountry || before.PhoneE164 != after.PhoneE164 ||
+		before.FirstNameEN != after.FirstNameEN || before.FirstNameRTGS != after.FirstNameRTGS ||
+		before.LastNameEN != after.LastNameEN || before.LastNameRTGS != after.LastNameRTGS ||
+		before.LastNameSoundex != after.LastNameSoundex || before.DateOfBirth.String() != after.DateOfBirth.String()
+}
+
+// matchCandidates returns the records of other hospitals that share an
+// identifier, phone number, last name or its sound, or date of birth with the
+// patient. Records sharing an identifier are always returned; the others are
+// bounded by maxMatchCandidates.
+func matchCandidates(db *gorm.DB, patient models.Patient) ([]models.Patient, error) {
+	others := db.Where("hospital_id <> ? AND id <> ?", patient.HospitalID, patient.ID).Session(&gorm.Session{})
+
+	var candidates []models.Patient
+	conditions, args := anyColumnEquals(map[string]string{
+		"national_id": patient.NationalID,
+		"passport_id": patient.PassportID,
+	})
+	if len(conditions) > 0 {
+		err := others.Where("("+strings.Join(conditions, " OR ")+")", args...).
+			Order("id").Find(&candidates).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conditions, args = anyColumnEquals(map[string]string{
+		"phone_e164":        patient.PhoneE164,
+		"last_name_soundex": patient.LastNameSoundex,
+		"last_name_rtgs":    patient.LastNameRTGS,
+	})
+	if patient.DateOfBirth.Precision == models.DatePrecisionDay {
+		conditions = append(conditions, "date_of_birth_value = ?")
+		args = append(args, patient.DateOfBirth.Value)
+	}
+	if len(conditions) == 0 {
+		return candidates, nil
+	}
+	query := others.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	if len(candidates) > 0 {
+		found := make([]uint, len(candidates))
+		for i, candidate := range candidates {
+			found[i] = candidate.ID
+		}
+		query = query.Where("id NOT IN ?", found)
+	}
+	var blocked []models.Patient
+	err := query.Order("id").Limit(maxMatchCandidates).Find(&blocked).Error
+	return append(candidates, blocked...), err
+}
+
+// anyColumnEquals returns an equality condition for each column with a value.
+func anyColumnEquals(values map[string]string) ([]string, []any) {
+	var conditions []string
+	var args []any
+	for column, value := range values {
+		if value != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	return conditions, args
+}
+
+// rejectedPairs returns the records a person decided are not the patient.
+func rejectedPairs(db *gorm.DB, patientID uint) (map[uint]bool, error) {
+	var reviews []models.MatchReview
+	err := db.Where("status = ? AND (patient_id = ? OR candidate_id = ?)", models.MatchReviewRejected, patientID, patientID).Find(&reviews).Error
+	rejected := map[uint]bool{}
+	for _, review := range reviews {
+		rejected[review.PatientID+review.CandidateID-patientID] = true
+	}
+	return rejected, err
+}
+
+func sameEnterprisePatient(a, b models.Patient) bool {
+	return a.EnterprisePatientID != nil && b.EnterprisePatientID != nil && *a.EnterprisePatientID == *b.EnterprisePatientID
+}
+
+func newEnterprisePatient(db *gorm.DB) (uint, error) {
+	enterprise := models.EnterprisePatient{}
+	err := db.Create(&enterprise).Error
+	return enterprise.ID, err
+}
+
+// setEnterprisePatient links a record. Links are the index's, not a change to
+// the record, so UpdatedAt is kept.
+func setEnterprisePatient(db *gorm.DB, patientID, enterprisePatientID uint) error {
+	return db.Model(&models.Patient{}).Where("id = ?", patientID).UpdateColumn("enterprise_patient_id", enterprisePatientID).Error
+}
+
+// reviewPair orders a pair of records as MatchReview stores them.
+func reviewPair(a, b uint) (uint, uint) {
+	return min(a, b), max(a, b)
+}
+
+// queueMatchReview queues a pair for review unless it is already queued or
+// decided.
+func queueMatchReview(db *gorm.DB, a, b uint, result mpi.Result) error {
+	patientID, candidateID := reviewPair(a, b)
+	review := models.MatchReview{PatientID: patientID, CandidateID: candidateID, Score: result.Score, Rule: result.Rule, Status: models.MatchReviewPending}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&review).Error
+}
+
+// decideMatchReview records a decision on a pair, queued or not.
+func decideMatchReview(db *gorm.DB, a, b uint, status string, staffID *uint) error {
+	patientID, candidateID := reviewPair(a, b)
+	now := time.Now()
+	review := models.MatchReview{PatientID: patientID, CandidateID: candidateID, Status: status, ReviewedByID: staffID, ReviewedAt: &now}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "patient_id"}, {Name: "candidate_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "reviewed_by_id", "reviewed_at"}),
+	}).Create(&review).Error
+}
+
+// linkPatients puts two records, and every record linked to either, in one
+// enterprise patient, the older one when both have one. Both records are read
+// again, locked, inside the transaction; errPatientGone means one of them was
+// deleted meanwhile.
+func linkPatients(db *gorm.DB, a, b models.Patient, staffID *uint) (uint, error) {
+	var target uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current []models.Patient
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", []uint{a.ID, b.ID}).Order("id").Find(&current).Error
+		if err != nil {
+			return err
+		}
+		if len(current) != 2 {
+			return errPatientGone
+		}
+		a, b = current[0], current[1]
+		switch {
+		case a.EnterprisePatientID == nil && b.EnterprisePatientID == nil:
+			id, err := newEnterprisePatient(tx)
+			if err != nil {
+				return err
+			}
+			target = id
+		case a.EnterprisePatientID == nil:
+			target = *b.EnterprisePatientID
+		case b.EnterprisePatientID == nil:
+			target = *a.EnterprisePatientID
+		default:
+			target = min(*a.EnterprisePatientID, *b.EnterprisePatientID)
+			merged := max(*a.EnterprisePatientID, *b.EnterprisePatientID)
+			if merged != target {
+				//soft deleted records move too, they are still that person
+				err := tx.Unscoped().Model(&models.Patient{}).Where("enterprise_patient_id = ?", merged).UpdateColumn("enterprise_patient_id", target).Error
+				if err != nil {
+					return err
+				}
+				if err := tx.Delete(&models.EnterprisePatient{}, merged).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for _, patient := range []models.Patient{a, b} {
+			if err := setEnterprisePatient(tx, patient.ID, target); err != nil {
+				return err
+			}
+		}
+		return decideMatchReview(tx, a.ID, b.ID, models.MatchReviewLinked, staffID)
+	})
+	return target, err
+}
+
+var errPatientGone = errors.New("patient was deleted")
+
+// unlinkPatient moves a record out of its enterprise patient into one of its
+// own, and rejects its pairs with the records it leaves so they are not linked
+// again. It reports false when the record was not linked to any other.
+func unlinkPatient(db *gorm.DB, patient models.Patient, staffID *uint) (uint, bool, error) {
+	if patient.EnterprisePatientID == nil {
+		return 0, false, nil
+	}
+	var others []models.Patient
+	if err := db.Where("enterprise_patient_id = ? AND id <> ?", *patient.EnterprisePatientID, patient.ID).Find(&others).Error; err != nil {
+		return 0, false, err
+	}
+	if len(others) == 0 {
+		return *patient.EnterprisePatientID, false, nil
+	}
+
+	var id uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if id, err = newEnterprisePatient(tx); err != nil {
+			return err
+		}
+		if err := setEnterprisePatient(tx, patient.ID, id); err != nil {
+			return err
+		}
+		for _, other := range others {
+			if err := decideMatchReview(tx, patient.ID, other.ID, models.MatchReviewRejected, staffID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return id, true, err
+}
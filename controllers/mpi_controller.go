@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+-> the records of an enterprise patient in the hospitals the caller may access
+-> one without records there is not found
+*/
+func GetEnterprisePatient(c *gin.Context) {
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Enterprise patient not found"})
+		return
+	}
+	hospitals, err := accessibleHospitals(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load hospitals"})
+		return
+	}
+	hospitalIDs := make([]uint, len(hospitals))
+	for i, hospital := range hospitals {
+		hospitalIDs[i] = hospital.ID
+	}
+
+	var patients []models.Patient
+	if err := config.DB.Where("enterprise_patient_id = ? AND hospital_id IN ?", id, hospitalIDs).Order("id").Find(&patients).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load enterprise patient"})
+		return
+	}
+	if len(patients) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Enterprise patient not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enterprise_patient_id": id, "patients": patients})
+}
+
+/*
+-> MPI stewards only (see routes)
+-> the first record belongs to the caller's hospital, the other to any hospital the caller may access
+-> both, with every record linked to either, become one enterprise patient
+*/
+func LinkPatients(c *gin.Context) {
+	var input models.PatientLinkInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	if input.PatientID == input.OtherPatientID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A patient cannot be linked to itself"})
+		return
+	}
+
+	var patient, other models.Patient
+	if err := config.DB.Where("hospital_id = ?", claims.HospitalID).First(&patient, input.PatientID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+	accessible, err := accessibleHospitalIDs(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load hospitals"})
+		return
+	}
+	//records of hospitals the caller may not access are not found either
+	if err := config.DB.First(&other, input.OtherPatientID).Error; err != nil || !accessible[other.HospitalID] {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Other patient not found"})
+		return
+	}
+
+	id, err := linkPatients(config.DB, patient, other, staffIDOf(claims.StaffID))
+	if errors.Is(err, errPatientGone) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link patients"})
+		return
+	}
+	recordAudit(c, models.AuditPatientsLinked, claims.HospitalID, nil, fmt.Sprintf("patients %d and %d, enterprise patient %d", patient.ID, other.ID, id))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Patients linked", "enterprise_patient_id": id})
+}
+
+/*
+-> MPI stewards only (see routes)
+-> the record belongs to the caller's hospital and is linked to others
+-> it becomes an enterprise patient of its own, never linked to them again automatically
+*/
+func UnlinkPatient(c *gin.Context) {
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	patient, findErr := findHospitalPatient(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	id, unlinked, err := unlinkPatient(config.DB, patient, staffIDOf(claims.StaffID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink patient"})
+		return
+	}
+	if !unlinked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Patient is not linked to other records"})
+		return
+	}
+	recordAudit(c, models.AuditPatientUnlinked, claims.HospitalID, nil, fmt.Sprintf("patient %d left enterprise patient %d", patient.ID, *patient.EnterprisePatientID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Patient unlinked", "enterprise_patient_id": id})
+}
+
+// MatchReviewView is a match review as a steward sees it: records of
+// hospitals they may not access are left out, only their IDs are shown.
+type MatchReviewView struct {
+	models.MatchReview
+	Patient   *models.Patient `json:",omitempty"`
+	Candidate *models.Patient `json:",omitempty"`
+}
+
+var matchReviewList = listSpec{
+	sorts:       map[string]string{"id": "id", "score": "score", "created_at": "created_at"},
+	defaultSort: "-score",
+	item:        MatchReviewView{},
+}
+
+/*
+-> MPI stewards only (see routes)
+-> reviews involving a record of the caller's hospital, pending unless ?status= says otherwise
+-> one page at a time (see pagination.go), with the records of hospitals the caller may access
+*/
+func ListMatchReviews(c *gin.Context) {
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	page, pageErr := parsePage(c, matchReviewList)
+	if pageErr != (CodedError{}) {
+		c.JSON(pageErr.Code, gin.H{"error": pageErr.Error})
+		return
+	}
+	status := c.DefaultQuery("status", models.MatchReviewPending)
+	switch status {
+	case models.MatchReviewPending, models.MatchReviewLinked, models.MatchReviewRejected:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, linked or rejected"})
+		return
+	}
+
+	accessible, err := accessibleHospitalIDs(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load hospitals"})
+		return
+	}
+	query := hospitalMatchReviews(claims.HospitalID).Where("status = ?", status).Preload("Patient").Preload("Candidate")
+	reviews, result, err := paginate[models.MatchReview](query, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list match reviews"})
+		return
+	}
+
+	views := make([]MatchReviewView, len(reviews))
+	for i, review := range reviews {
+		views[i] = matchReviewView(review, accessible)
+	}
+	respondPage(c, gin.H{}, "reviews", views, page, result)
+}
+
+/*
+-> MPI stewards only (see routes)
+-> a pending review involving a record of the caller's hospital
+-> link: the two records become one enterprise patient; reject: they are never linked automatically
+*/
+func ResolveMatchReview(c *gin.Context) {
+	var input models.MatchReviewDecisionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Decision != "link" && input.Decision != "reject" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "decision must be link or reject"})
+		return
+	}
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Match review not found"})
+		return
+	}
+	var review models.MatchReview
+	if err := hospitalMatchReviews(claims.HospitalID).Preload("Patient").Preload("Candidate").Where("id = ?", id).First(&review).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Match review not found"})
+		return
+	}
+	if review.Status != models.MatchReviewPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Match review already resolved"})
+		return
+	}
+
+	staffID := staffIDOf(claims.StaffID)
+	details := fmt.Sprintf("match review %d of patients %d and %d", review.ID, review.PatientID, review.CandidateID)
+	if input.Decision == "link" {
+		if review.Patient.ID == 0 || review.Candidate.ID == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "A patient of this review was deleted"})
+			return
+		}
+		id, err := linkPatients(config.DB, review.Patient, review.Candidate, staffID)
+		if errors.Is(err, errPatientGone) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A patient of this review was deleted"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link patients"})
+			return
+		}
+		recordAudit(c, models.AuditPatientsLinked, claims.HospitalID, nil, fmt.Sprintf("%s, enterprise patient %d", details, id))
+	} else {
+		if err := decideMatchReview(config.DB, review.PatientID, review.CandidateID, models.MatchReviewRejected, staffID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject match review"})
+			return
+		}
+		recordAudit(c, models.AuditMatchReviewRejected, claims.HospitalID, nil, details)
+	}
+
+	accessible, err := accessibleHospitalIDs(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load hospitals"})
+		return
+	}
+	config.DB.Preload("Patient").Preload("Candidate").First(&review, review.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Match review resolved", "review": matchReviewView(review, accessible)})
+}
+
+// matchReviewView shows the records of a review the caller may access.
+// Deleted records are absent either way.
+func matchReviewView(review models.MatchReview, accessible map[uint]bool) MatchReviewView {
+	view := MatchReviewView{MatchReview: review}
+	if review.Patient.ID != 0 && accessible[review.Patient.HospitalID] {
+		view.Patient = &review.Patient
+	}
+	if review.Candidate.ID != 0 && accessible[review.Candidate.HospitalID] {
+		view.Candidate = &review.Candidate
+	}
+	return view
+}
+
+// accessibleHospitalIDs returns the hospitals of accessibleHospitals as a set.
+func accessibleHospitalIDs(claims *utils.Claims) (map[uint]bool, error) {
+	hospitals, err := accessibleHospitals(claims)
+	ids := map[uint]bool{}
+	for _, hospital := range hospitals {
+		ids[hospital.ID] = true
+	}
+	return ids, err
+}
+
+// hospitalMatchReviews selects the reviews involving a record of a hospital.
+// Either record may have been deleted since; it is then absent from the review.
+func hospitalMatchReviews(hospitalID uint) *gorm.DB {
+	patients := config.DB.Unscoped().Model(&models.Patient{}).Select("id").Where("hospital_id = ?", hospitalID)
+	return config.DB.Where("(patient_id IN (?) OR candidate_id IN (?))", patients, patients)
+}
+
+// staffIDOf is the acting staff member, nil for bootstrap tokens.
+func staffIDOf(staffID uint) *uint {
+	if staffID == 0 {
+		return nil
+	}
+	return &staffID
+}
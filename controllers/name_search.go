@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/names"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// How PatientSearchInput names are matched.
+const (
+	NameMatchExact = "exact"
+	// case-insensitive, the name starts with the search term
+	NameMatchPrefix = "prefix"
+	// trigram similarity of at least config.NameSimilarityThreshold
+	NameMatchFuzzy = "fuzzy"
+	// same Soundex code as the English name
+	NameMatchPhonetic = "phonetic"
+)
+
+// maxRankedCandidates bounds the matches of a search ranked by name that are
+// loaded and ranked; beyond it the best of the first ones are returned.
+const maxRankedCandidates = 1000
+
+// nameTerm is a name searched for and the column family (first_name,
+// middle_name or last_name) it is searched in.
+type nameTerm struct {
+	column string
+	name   string
+}
+
+func nameTerms(input PatientSearchInput) []nameTerm {
+	var terms []nameTerm
+	for _, term := range []nameTerm{{"first_name", input.FirstName}, {"middle_name", input.MiddleName}, {"last_name", input.LastName}} {
+		if term.name != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// nameExpressions are the columns a name is compared with: _th or _en by the
+// script it is written in, or with cross_script the romanised Thai name and
+// the English name. Phonetic matches are on English names only. comparedAs
+// is the name in the form they hold, lower case for all but exact matches.
+func nameExpressions(term nameTerm, input PatientSearchInput) (expressions []string, comparedAs string) {
+	exact := input.NameMatch == "" || input.NameMatch == NameMatchExact
+	switch {
+	case input.NameMatch == NameMatchPhonetic:
+		return []string{"LOWER(" + term.column + "_en)"}, names.Key(term.name)
+	case input.CrossScript:
+		return []string{term.column + "_rtgs", "LOWER(" + term.column + "_en)"}, names.Key(term.name)
+	case names.IsThai(term.name):
+		return []string{term.column + "_th"}, term.name
+	case exact:
+		return []string{term.column + "_en"}, term.name
+	default:
+		return []string{"LOWER(" + term.column + "_en)"}, strings.ToLower(term.name)
+	}
+}
+
+// whereNameMatches keeps patients whose name matches term under the search's
+// name_match mode. Fuzzy matches are only narrowed to the threshold here when
+// Postgres can compute trigram similarity; elsewhere to the names that may
+// share a trigram with the term, and rankByName applies the threshold.
+func whereNameMatches(query *gorm.DB, term nameTerm, input PatientSearchInput) *gorm.DB {
+	expressions, name := nameExpressions(term, input)
+	var conditions []string
+	var args []any
+	switch input.NameMatch {
+	case NameMatchPrefix:
+		for _, expression := range expressions {
+			conditions = append(conditions, expression+` LIKE ? ESCAPE '\'`)
+			args = append(args, likePrefix(name))
+		}
+	case NameMatchFuzzy:
+		if !trigramsAvailable() {
+			patterns := trigramPatterns(name)
+			if len(patterns) == 0 {
+				//nothing left of the name to be similar to
+				return query.Where("1 = 0")
+			}
+			for _, expression := range expressions {
+				for _, pattern := range patterns {
+					conditions = append(conditions, expression+` LIKE ? ESCAPE '\'`)
+					args = append(args, pattern)
+				}
+			}
+			break
+		}
+		for _, expression := range expressions {
+			conditions = append(conditions, "similarity("+expression+", ?) >= ?")
+			args = append(args, name, config.NameSimilarityThreshold)
+		}
+	case NameMatchPhonetic:
+		code := names.Soundex(names.Key(term.name))
+		if code == "" {
+			//nothing to sound alike, and patients without an English name have no code either
+			return query.Where("1 = 0")
+		}
+		return query.Where(term.column+"_soundex = ?", code)
+	default:
+		for _, expression := range expressions {
+			conditions = append(conditions, expression+" = ?")
+			args = append(args, name)
+		}
+	}
+	return query.Where("("+strings.Join(conditions, " OR ")+")", args...)
+}
+
+// likePrefix is a LIKE pattern for the values starting with prefix.
+func likePrefix(prefix string) string {
+	return likeEscape(prefix) + "%"
+}
+
+func likeEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// trigramPatterns are LIKE patterns for the names that may share a trigram
+// with name: those starting with its first letter, ending with its last two,
+// or containing any three letters in a row of one of its words, or a whole
+// word shorter than that.
+func trigramPatterns(name string) []string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+	if len(words) == 0 {
+		return nil
+	}
+	first, last := []rune(words[0]), []rune(words[len(words)-1])
+	patterns := []string{likePrefix(string(first[:1])), "%" + likeEscape(string(last[max(len(last)-2, 0):]))}
+	for _, word := range words {
+		letters := []rune(word)
+		if len(letters) < 3 {
+			patterns = append(patterns, "%"+likeEscape(word)+"%")
+		}
+		for i := 0; i+3 <= len(letters); i++ {
+			patterns = append(patterns, "%"+likeEscape(string(letters[i:i+3]))+"%")
+		}
+	}
+	return patterns
+}
+
+// rankByName scores the patients of a search whose names are not matched
+// exactly: each name searched for scores its trigram similarity to the
+// patient's name, and MatchScore is their mean. Fuzzy matches below the
+// threshold are dropped. Patients are returned best first.
+func rankByName(patients []models.Patient, input PatientSearchInput) []models.Patient {
+	if !rankedNameSearch(input) {
+		return patients
+	}
+	terms := nameTerms(input)
+
+	ranked := patients[:0]
+	for _, patient := range patients {
+		total, matched := 0.0, true
+		for _, term := range terms {
+			_, name := nameExpressions(term, input)
+			score := 0.0
+			for _, value := range patientNames(patient, term, input) {
+				score = max(score, names.Similarity(name, value))
+			}
+			if input.NameMatch == NameMatchFuzzy && score < config.NameSimilarityThreshold {
+				matched = false
+			}
+			total += score
+		}
+		if matched {
+			patient.MatchScore = total / float64(len(terms))
+			ranked = append(ranked, patient)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].MatchScore > ranked[j].MatchScore })
+	return ranked
+}
+
+// rankedNameSearch reports whether a search's results are ranked by name.
+func rankedNameSearch(input PatientSearchInput) bool {
+	return input.NameMatch != "" && input.NameMatch != NameMatchExact && len(nameTerms(input)) > 0
+}
+
+// pageByScore pages ranked patients as paginate pages rows: best first, then
+// by ID.
+func pageByScore(ranked []models.Patient, page pageRequest) ([]models.Patient, pageResult) {
+	var result pageResult
+	if page.includeTotal {
+		total := int64(len(ranked))
+		result.total = &total
+	}
+	start := 0
+	if page.cursor != nil {
+		var score float64
+		if err := json.Unmarshal(page.cursor.Value, &score); err != nil {
+			return nil, result
+		}
+		for start < len(ranked) && (ranked[start].MatchScore > score || ranked[start].MatchScore == score && ranked[start].ID <= page.cursor.ID) {
+			start++
+		}
+	}
+	end := min(start+page.limit, len(ranked))
+	if end < len(ranked) {
+		last := ranked[end-1]
+		result.nextCursor, _ = encodeCursor(page, last.MatchScore, last.ID)
+	}
+	return ranked[start:end], result
+}
+
+// patientNames returns the values of the columns nameExpressions compares
+// term with.
+func patientNames(patient models.Patient, term nameTerm, input PatientSearchInput) []string {
+	th, en, rtgs := patient.FirstNameTH, patient.FirstNameEN, patient.FirstNameRTGS
+	switch term.column {
+	case "middle_name":
+		th, en, rtgs = patient.MiddleNameTH, patient.MiddleNameEN, patient.MiddleNameRTGS
+	case "last_name":
+		th, en, rtgs = patient.LastNameTH, patient.LastNameEN, patient.LastNameRTGS
+	}
+	switch {
+	case input.NameMatch == NameMatchPhonetic:
+		return []string{en}
+	case input.CrossScript:
+		return []string{rtgs, en}
+	case names.IsThai(term.name):
+		return []string{th}
+	default:
+		return []string{en}
+	}
+}
+
+var trigramSupport struct {
+	once      sync.Once
+	available bool
+}
+
+// trigramsAvailable reports whether the database is Postgres with the pg_trgm
+// extension installed. Elsewhere fuzzy names are compared in process.
+func trigramsAvailable() bool {
+	trigramSupport.once.Do(func() {
+		if config.DB.Dialector.Name() != "postgres" {
+			return
+		}
+		var installed int64
+		config.DB.Raw("SELECT COUNT(*) FROM pg_extension WHERE extname = 'pg_trgm'").Scan(&installed)
+		trigramSupport.available = installed > 0
+	})
+	return trigramSupport.available
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// List endpoints read their pagination, sort and field selection from the
+// query string:
+//
+//	limit          page size, 1 to config.PageSizeMax
+//	cursor         next_cursor of the previous page, opaque to clients
+//	sort           a sort key of the endpoint, prefixed with - for descending
+//	include_total  true to also count every match
+//	fields         comma separated JSON fields to return of each item
+//
+// Pages are keyset paginated on the sort key then ID, so rows added or
+// removed between requests never shift a page.
+
+// listSpec describes a list endpoint.
+type listSpec struct {
+	// sort keys and their columns; an empty column is sorted in process
+	sorts       map[string]string
+	defaultSort string
+	// an item of the list, for the fields it has
+	item any
+}
+
+type pageRequest struct {
+	limit        int
+	sort         string // as requested, e.g. -date_of_birth
+	column       string
+	descending   bool
+	cursor       *pageCursor
+	includeTotal bool
+	fields       []string
+	// when set, patients added after this ID are left out, see searchFederated
+	maxID uint
+}
+
+// pageCursor points after the last item of a page.
+type pageCursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+	MaxID uint            `json:"max,omitempty"`
+}
+
+type pageResult struct {
+	nextCursor string
+	total      *int64
+}
+
+func parsePage(c *gin.Context, spec listSpec) (pageRequest, CodedError) {
+	page := pageRequest{limit: min(config.PageSizeDefault, config.PageSizeMax), sort: spec.defaultSort}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > config.PageSizeMax {
+			return page, CodedError{Code: http.StatusBadRequest, Error: fmt.Sprintf("limit must be between 1 and %d", config.PageSizeMax)}
+		}
+		page.limit = limit
+	}
+
+	if raw := c.Query("sort"); raw != "" {
+		page.sort = raw
+	}
+	column, ok := spec.sorts[strings.TrimPrefix(page.sort, "-")]
+	if !ok {
+		keys := make([]string, 0, len(spec.sorts))
+		for key := range spec.sorts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return page, CodedError{Code: http.StatusBadRequest, Error: "sort must be one of " + strings.Join(keys, ", ")}
+	}
+	page.column, page.descending = column, strings.HasPrefix(page.sort, "-")
+
+	if raw := c.Query("cursor"); raw != "" {
+		var cursor pageCursor
+		decoded, err := base64.RawURLEncoding.DecodeString(raw)
+		if err == nil {
+			err = json.Unmarshal(decoded, &cursor)
+		}
+		if err != nil || cursor.Sort != page.sort {
+			return page, CodedError{Code: http.StatusBadRequest, Error: "Invalid cursor"}
+		}
+		page.cursor, page.maxID = &cursor, cursor.MaxID
+	}
+
+	if raw := c.Query("include_total"); raw != "" {
+		includeTotal, err := strconv.ParseBool(raw)
+		if err != nil {
+			return page, CodedError{Code: http.StatusBadRequest, Error: "include_total must be true or false"}
+		}
+		page.includeTotal = includeTotal
+	}
+
+	if raw := c.Query("fields"); raw != "" {
+		known := jsonFieldNames(reflect.TypeOf(spec.item))
+		for _, field := range strings.Split(raw, ",") {
+			field = strings.TrimSpace(field)
+			if !known[field] {
+				return page, CodedError{Code: http.StatusBadRequest, Error: fmt.Sprintf("Unknown field %q", field)}
+			}
+			page.fields = append(page.fields, field)
+		}
+	}
+	return page, CodedError{}
+}
+
+// paginate loads one page of query, counting every match first if asked.
+func paginate[T any](query *gorm.DB, page pageRequest) ([]T, pageResult, error) {
+	var result pageResult
+	var model T
+	query = query.Model(&model).Session(&gorm.Session{})
+
+	if page.includeTotal {
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			return nil, result, err
+		}
+		result.total = &total
+	}
+
+	stmt := &gorm.Statement{DB: query}
+	if err := stmt.Parse(&model); err != nil {
+		return nil, result, err
+	}
+	sortField := stmt.Schema.LookUpField(page.column)
+	idField := stmt.Schema.LookUpField("id")
+	if sortField == nil || idField == nil {
+		return nil, result, fmt.Errorf("cannot sort %s by %q", stmt.Schema.Name, page.column)
+	}
+
+	if page.cursor != nil {
+		var err error
+		if query, err = afterCursor(query, page, sortField); err != nil {
+			return nil, result, err
+		}
+	}
+	direction := "ASC"
+	if page.descending {
+		direction = "DESC"
+	}
+	if page.column == "id" {
+		query = query.Order("id " + direction)
+	} else {
+		//rows without a value come last either way
+		query = query.Order(page.column + " IS NULL").Order(page.column + " " + direction).Order("id")
+	}
+
+	var rows []T
+	if err := query.Limit(page.limit + 1).Find(&rows).Error; err != nil {
+		return nil, result, err
+	}
+	if len(rows) > page.limit {
+		rows = rows[:page.limit]
+		last := reflect.ValueOf(&rows[len(rows)-1]).Elem()
+		value, _ := sortField.ValueOf(context.Background(), last)
+		id, _ := idField.ValueOf(context.Background(), last)
+		cursor, err := encodeCursor(page, value, uint(reflect.ValueOf(id).Uint()))
+		if err != nil {
+			return nil, result, err
+		}
+		result.nextCursor = cursor
+	}
+	return rows, result, nil
+}
+
+// afterCursor keeps the rows after the cursor in the page's order.
+func afterCursor(query *gorm.DB, page pageRequest, sortField *schema.Field) (*gorm.DB, error) {
+	cursor := page.cursor
+	after := ">"
+	if page.descending {
+		after = "<"
+	}
+	if page.column == "id" {
+		return query.Where("id "+after+" ?", cursor.ID), nil
+	}
+	if string(cursor.Value) == "null" {
+		return query.Where(page.column+" IS NULL AND id > ?", cursor.ID), nil
+	}
+	value := reflect.New(sortField.FieldType)
+	if err := json.Unmarshal(cursor.Value, value.Interface()); err != nil {
+		return nil, err
+	}
+	column := page.column
+	return query.Where("("+column+" "+after+" ? OR ("+column+" = ? AND id > ?) OR "+column+" IS NULL)",
+		value.Elem().Interface(), value.Elem().Interface(), cursor.ID), nil
+}
+
+func encodeCursor(page pageRequest, value any, id uint) (string, error) {
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(pageCursor{Sort: page.sort, Value: encodedValue, ID: id, MaxID: page.maxID})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+// respondPage answers with a page of items under key, only their selected
+// fields, and where the next page starts.
+func respondPage[T any](c *gin.Context, body gin.H, key string, items []T, page pageRequest, result pageResult) {
+	body[key] = selectFields(items, page.fields)
+	if result.nextCursor != "" {
+		body["next_cursor"] = result.nextCursor
+	}
+	if result.total != nil {
+		body["total"] = *result.total
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// selectFields keeps only the given JSON fields of each item, or all of them
+// when none are given.
+func selectFields[T any](items []T, fields []string) any {
+	if len(fields) == 0 {
+		if items == nil {
+			return []T{}
+		}
+		return items
+	}
+	selected := make([]map[string]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		var all map[string]json.RawMessage
+		encoded, _ := json.Marshal(item)
+		json.Unmarshal(encoded, &all)
+		picked := map[string]json.RawMessage{}
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				picked[field] = value
+			}
+		}
+		selected = append(selected, picked)
+	}
+	return selected
+}
+
+// jsonFieldNames returns the JSON names of a struct's fields, including
+// those of embedded structs.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case !field.IsExported() || name == "-":
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			for embedded := range jsonFieldNames(field.Type) {
+				names[embedded] = true
+			}
+		case name == "":
+			names[field.Name] = true
+		default:
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/utils"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/*
+-> verify the current password
+-> apply the policy and the reuse rule to the new one
+-> store it, keeping the old hash in the history
+-> revoke every token so other sessions have to log in again
+-> answer with a new pair, the caller's session goes on
+*/
+func ChangePassword(c *gin.Context) {
+	var input models.PasswordChangeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	staff, fetchErr := currentStaff(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	if match, _ := utils.CheckPasswordHash(input.CurrentPassword, staff.Password); !match {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if err := checkNewPassword(staff, input.NewPassword); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+		return setPassword(tx, staff, input.NewPassword)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	revokeStaffSessions(staff.ID)
+	revokeStaffAccessTokens(staff.ID)
+	recordAudit(c, models.AuditPasswordChanged, staff.HospitalID, &staff.ID, "")
+
+	tokens, err := issueTokens(config.DB, staff, staff.Hospital, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+		return
+	}
+	tokens["message"] = "Password changed"
+	c.JSON(http.StatusOK, tokens)
+}
+
+/*
+-> only administrators reach here (see routes)
+-> invalidate earlier reset tokens of the staff member
+-> create a single-use token, returned once, to hand over out of band
+*/
+func IssuePasswordReset(c *gin.Context) {
+	staff, fetchErr := findManagedStaff(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+	claims, _ := getClaimsFromToken(c)
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+	now := time.Now()
+	reset := models.PasswordResetToken{
+		TokenHash:   utils.HashToken(token),
+		StaffID:     staff.ID,
+		CreatedByID: claims.StaffID,
+		ExpiresAt:   now.Add(config.PasswordResetTTL),
+	}
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PasswordResetToken{}).
+			Where("staff_id = ? AND used_at IS NULL", staff.ID).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&reset).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+	recordAudit(c, models.AuditPasswordResetIssued, staff.HospitalID, &staff.ID, "")
+
+	c.JSON(http.StatusOK, gin.H{"reset_token": token, "expires_at": reset.ExpiresAt})
+}
+
+/*
+-> look up an unused, unexpired reset token
+-> apply the policy and the reuse rule
+-> store the password, burn the token, clear any lockout, revoke sessions
+*/
+func ResetPassword(c *gin.Context) {
+	var input models.PasswordResetInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	db := config.DB
+
+	var reset models.PasswordResetToken
+	if err := db.Where("token_hash = ? AND used_at IS NULL", utils.HashToken(input.Token)).First(&reset).Error; err != nil ||
+		time.Now().After(reset.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	var staff models.Staff
+	if err := db.First(&staff, reset.StaffID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if err := checkNewPassword(staff, input.NewPassword); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		//conditional update so the token cannot be used twice concurrently
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errResetTokenUsed
+		}
+		if err := setPassword(tx, staff, input.NewPassword); err != nil {
+			return err
+		}
+		return tx.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+			"failed_login_attempts": 0,
+			"last_failed_login_at":  nil,
+			"locked_until":          nil,
+		}).Error
+	})
+	if errors.Is(err, errResetTokenUsed) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	revokeStaffSessions(staff.ID)
+	revokeStaffAccessTokens(staff.ID)
+	recordAudit(c, models.AuditPasswordResetCompleted, staff.HospitalID, &staff.ID, "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset"})
+}
+
+var errResetTokenUsed = errors.New("reset token already used")
+
+// checkNewPassword applies the policy and, for an existing account, refuses
+// the current password and the ones kept in the history.
+func checkNewPassword(staff models.Staff, password string) error {
+	if err := utils.CurrentPasswordPolicy().Validate(password, staff.Username); err != nil {
+		return err
+	}
+	if staff.ID == 0 || config.PasswordHistory <= 0 {
+		return nil
+	}
+
+	reused := &utils.PasswordPolicyError{Violations: []string{"must not reuse a recent password"}}
+	if match, _ := utils.CheckPasswordHash(password, staff.Password); match {
+		return reused
+	}
+
+	var history []models.PasswordHistory
+	if err := config.DB.Where("staff_id = ?", staff.ID).
+		Order("id DESC").Limit(config.PasswordHistory - 1).
+		Find(&history).Error; err != nil {
+		return err
+	}
+	for _, previous := range history {
+		if match, _ := utils.CheckPasswordHash(password, previous.Hash); match {
+			return reused
+		}
+	}
+	return nil
+}
+
+// setPassword stores a new password and moves the old hash into the history,
+// dropping entries beyond what the reuse rule looks at.
+func setPassword(tx *gorm.DB, staff models.Staff, password string) error {
+	hashed, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Create(&models.PasswordHistory{StaffID: staff.ID, Hash: staff.Password}).Error; err != nil {
+		return err
+	}
+	var keep []uint
+	if err := tx.Model(&models.PasswordHistory{}).Where("staff_id = ?", staff.ID).
+		Order("id DESC").Limit(config.PasswordHistory).Pluck("id", &keep).Error; err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		if err := tx.Where("staff_id = ? AND id NOT IN ?", staff.ID, keep).Delete(&models.PasswordHistory{}).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&models.Staff{}).Where("id = ?", staff.ID).Update("password", hashed).Error
+}
+
+func respondPasswordError(c *gin.Context, err error) {
+	var policyErr *utils.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet the policy", "violations": policyErr.Violations})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password"})
+}
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/upstream"
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The local patients table is a read-through cache of the hospital systems:
+// a search is answered locally when possible, otherwise upstream, and only
+// complete records are written back. Misses are remembered separately in
+// NegativeLookup so they never turn into patient rows. Cached copies age
+// under their hospital's freshness policy and are refreshed from upstream.
+
+// lookupKey returns the identifier a search is keyed on for negative caching.
+func lookupKey(input PatientSearchInput) (string, string) {
+	if input.NationalID != "" {
+		return models.IdentifierNationalID, input.NationalID
+	}
+	if input.PassportID != "" {
+		return models.IdentifierPassportID, input.PassportID
+	}
+	if input.HN != "" {
+		return models.IdentifierHN, input.HN
+	}
+	return "", ""
+}
+
+// negativeLookupHit reports whether the hospital recently had no patient for
+// the searched identifier.
+func negativeLookupHit(hospitalID uint, input PatientSearchInput) bool {
+	identifier, value := lookupKey(input)
+	if identifier == "" || config.NegativeLookupTTL <= 0 {
+		return false
+	}
+	var count int64
+	config.DB.Model(&models.NegativeLookup{}).
+		Where("hospital_id = ? AND identifier = ? AND value = ? AND expires_at > ?", hospitalID, identifier, value, time.Now()).
+		Count(&count)
+	return count > 0
+}
+
+// recordNegativeLookup remembers an upstream miss for NegativeLookupTTL and
+// drops expired entries while at it.
+func recordNegativeLookup(hospitalID uint, input PatientSearchInput) {
+	identifier, value := lookupKey(input)
+	if identifier == "" || config.NegativeLookupTTL <= 0 {
+		return
+	}
+	db := config.DB
+	now := time.Now()
+	db.Where("expires_at <= ?", now).Delete(&models.NegativeLookup{})
+
+	lookup := models.NegativeLookup{HospitalID: hospitalID, Identifier: identifier, Value: value, ExpiresAt: now.Add(config.NegativeLookupTTL)}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hospital_id"}, {Name: "identifier"}, {Name: "value"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+	}).Create(&lookup).Error
+	if err != nil {
+		log.Printf("failed to record negative lookup: %v", err)
+	}
+}
+
+// clearNegativeLookups forgets misses for a patient that now exists.
+func clearNegativeLookups(tx *gorm.DB, patient models.Patient) error {
+	identifiers := map[string]string{models.IdentifierNationalID: patient.NationalID, models.IdentifierPassportID: patient.PassportID}
+	if patient.HN != nil {
+		identifiers[models.IdentifierHN] = *patient.HN
+	}
+	for identifier, value := range identifiers {
+		if value == "" {
+			continue
+		}
+		if err := tx.Where("hospital_id = ? AND identifier = ? AND value = ?", patient.HospitalID, identifier, value).Delete(&models.NegativeLookup{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBlankPatient reports whether a record lacks what makes it a patient: an
+// identifier and a name.
+func isBlankPatient(patient models.Patient) bool {
+	if strings.TrimSpace(patient.NationalID) == "" && strings.TrimSpace(patient.PassportID) == "" && patient.HN == nil {
+		return true
+	}
+	return strings.TrimSpace(patient.FirstNameEN+patient.LastNameEN+patient.FirstNameTH+patient.LastNameTH) == ""
+}
+
+// answersSearch reports whether an upstream record is a complete patient for
+// the identifier that was searched, i.e. safe to cache under it.
+func answersSearch(patient models.Patient, input PatientSearchInput) bool {
+	if isBlankPatient(patient) {
+		return false
+	}
+	if input.NationalID != "" && patient.NationalID != input.NationalID {
+		return false
+	}
+	if input.PassportID != "" && patient.PassportID != input.PassportID {
+		return false
+	}
+	if input.PassportCountry != "" && patient.PassportCountry != "" && patient.PassportCountry != input.PassportCountry {
+		return false
+	}
+	if input.HN != "" && (patient.HN == nil || *patient.HN != input.HN) {
+		return false
+	}
+	return true
+}
+
+// Freshness of a cached patient under its hospital's policy.
+type cacheState int
+
+const (
+	cacheFresh cacheState = iota
+	// still fresh, but close enough to expiry to refresh in the background
+	cacheRefreshAhead
+	cacheStale
+)
+
+// cacheStateOf classifies a cached copy. Records that were not fetched from
+// upstream, and hospitals without a TTL, are always fresh.
+func cacheStateOf(patient models.Patient, hospital models.Hospital, now time.Time) cacheState {
+	if patient.FetchedAt == nil || hospital.CacheTTLSeconds <= 0 {
+		return cacheFresh
+	}
+	ttl := time.Duration(hospital.CacheTTLSeconds) * time.Second
+	age := now.Sub(*patient.FetchedAt)
+	if age >= ttl {
+		return cacheStale
+	}
+	if hospital.CacheRefreshAheadPercent > 0 && age >= ttl*time.Duration(hospital.CacheRefreshAheadPercent)/100 {
+		return cacheRefreshAhead
+	}
+	return cacheFresh
+}
+
+// revalidate applies the hospital's freshness policy to its cached patients.
+// Stale copies are refreshed before answering, together and up to
+// config.CacheSyncRefreshLimit of them within config.CacheSyncRefreshTimeout;
+// the others, or all of them under stale-while-revalidate, are served as they
+// are and refreshed afterwards. Copies nearing expiry are refreshed in the
+// background. A copy the hospital no longer has is dropped. stale reports
+// whether any copy is served past its TTL.
+func revalidate(ctx context.Context, hospitalID uint, patients []models.Patient) (served []models.Patient, stale bool, err CodedError) {
+	var hospital models.Hospital
+	if dbErr := config.DB.First(&hospital, hospitalID).Error; dbErr != nil {
+		return patients, false, CodedError{}
+	}
+	//without a hospital system the local copy is all there is
+	if !hospital.Enabled || hospital.BaseURL == "" {
+		return patients, false, CodedError{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.CacheSyncRefreshTimeout)
+	defer cancel()
+	now := time.Now()
+	states := make([]cacheState, len(patients))
+	//refreshed before answering, by index
+	synchronous := make([]bool, len(patients))
+	refreshed := make([]models.Patient, len(patients))
+	refreshErrs := make([]CodedError, len(patients))
+	var refreshes sync.WaitGroup
+	budget := config.CacheSyncRefreshLimit
+	for i, patient := range patients {
+		states[i] = cacheStateOf(patient, hospital, now)
+		switch {
+		case states[i] == cacheRefreshAhead:
+			refreshInBackground(hospital, patient)
+		case states[i] == cacheStale && !hospital.CacheStaleWhileRevalidate && budget > 0:
+			budget--
+			synchronous[i] = true
+			refreshes.Add(1)
+			go func() {
+				defer refreshes.Done()
+				refreshed[i], refreshErrs[i] = refreshPatient(ctx, hospital, patient)
+			}()
+		case states[i] == cacheStale:
+			refreshInBackground(hospital, patient)
+		}
+	}
+	refreshes.Wait()
+
+	for i, patient := range patients {
+		switch {
+		case states[i] != cacheStale:
+			served = append(served, patient)
+		case !synchronous[i]:
+			served, stale = append(served, patient), true
+		case refreshErrs[i] == (CodedError{}):
+			served = append(served, refreshed[i])
+		case refreshErrs[i].Code == http.StatusNotFound:
+		default:
+			//the hospital system is unreachable, the stale copy beats no answer
+			served, stale = append(served, patient), true
+		}
+	}
+	if len(served) == 0 {
+		return nil, false, CodedError{Code: http.StatusNotFound, Error: "Patient not found"}
+	}
+	return served, stale, CodedError{}
+}
+
+// refreshPatient asks the hospital system for the current version of a cached
+// patient, conditionally on its entity tag, and updates the local copy. A
+// patient the hospital no longer has is removed from the cache.
+func refreshPatient(ctx context.Context, hospital models.Hospital, patient models.Patient) (models.Patient, CodedError) {
+	source, sourceErr := upstreamSource(hospital)
+	if sourceErr != (CodedError{}) {
+		return patient, sourceErr
+	}
+	var input PatientSearchInput
+	switch {
+	case patient.NationalID != "":
+		input.NationalID = patient.NationalID
+	case patient.PassportID != "":
+		input.PassportID, input.PassportCountry = patient.PassportID, patient.PassportCountry
+	case patient.HN != nil:
+		input.HN = *patient.HN
+	}
+	found, err := searchSource(upstream.WithIfNoneMatch(ctx, patient.SourceETag), hospital, source, input)
+	db := config.DB
+	switch {
+	case err.Code == http.StatusNotModified:
+		return touchPatient(patient, patient.SourceETag)
+	case err.Code == http.StatusNotFound:
+		if dbErr := evictPatient(db, patient); dbErr != nil {
+			log.Printf("failed to drop patient %d from the cache: %v", patient.ID, dbErr)
+		}
+		return patient, err
+	case err != (CodedError{}):
+		return patient, err
+	}
+
+	current := found[0]
+	//same record version at the source, only the copy's age resets
+	if current.SourceVersion != "" && current.SourceVersion == patient.SourceVersion {
+		return touchPatient(patient, current.SourceETag)
+	}
+	before := patient
+	dbErr := db.Model(&patient).Select(
+		"first_name_th", "middle_name_th", "last_name_th",
+		"first_name_en", "middle_name_en", "last_name_en",
+		"first_name_rtgs", "middle_name_rtgs", "last_name_rtgs",
+		"first_name_soundex", "middle_name_soundex", "last_name_soundex",
+		"date_of_birth_value", "date_of_birth_precision", "national_id", "passport_id", "passport_country", "hn",
+		"phone_number", "phone_e164", "email", "email_normalized", "gender",
+		"fetched_at", "source_etag", "source_version",
+	).Updates(&current).Error
+	if dbErr != nil {
+		return patient, CodedError{Code: http.StatusInternalServerError, Error: "Error saving patient to database"}
+	}
+	if dbErr := db.First(&patient, patient.ID).Error; dbErr != nil {
+		return patient, CodedError{Code: http.StatusInternalServerError, Error: "Error loading patient from database"}
+	}
+	if matchingKeysChanged(before, patient) {
+		indexPatientOrLog(&patient)
+	}
+	return patient, CodedError{}
+}
+
+// evictPatient removes a cached copy for good, with the match reviews that
+// name it. It is not soft-deleted: a soft-deleted row means staff deleted the
+// patient, and storeInDB would refuse to cache the patient again.
+func evictPatient(db *gorm.DB, patient models.Patient) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("patient_id = ? OR candidate_id = ?", patient.ID, patient.ID).Delete(&models.MatchReview{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&patient).Error
+	})
+}
+
+// touchPatient marks an unchanged copy as fetched now, leaving UpdatedAt as
+// the record did not change.
+func touchPatient(patient models.Patient, etag string) (models.Patient, CodedError) {
+	now := time.Now()
+	err := config.DB.Model(&patient).UpdateColumns(map[string]any{"fetched_at": now, "source_etag": etag}).Error
+	if err != nil {
+		return patient, CodedError{Code: http.StatusInternalServerError, Error: "Error saving patient to database"}
+	}
+	patient.FetchedAt, patient.SourceETag = &now, etag
+	return patient, CodedError{}
+}
+
+var (
+	// patient IDs with a background refresh in flight
+	refreshing sync.Map
+	// lets tests wait for background refreshes
+	backgroundRefreshes sync.WaitGroup
+)
+
+// refreshInBackground refreshes a cached patient without holding up the
+// request. Only one refresh per patient runs at a time.
+func refreshInBackground(hospital models.Hospital, patient models.Patient) {
+	if _, running := refreshing.LoadOrStore(patient.ID, struct{}{}); running {
+		return
+	}
+	backgroundRefreshes.Add(1)
+	go func() {
+		defer backgroundRefreshes.Done()
+		defer refreshing.Delete(patient.ID)
+		ctx, cancel := context.WithTimeout(context.Background(), config.CacheRefreshTimeout)
+		defer cancel()
+		_, err := refreshPatient(ctx, hospital, patient)
+		if err != (CodedError{}) && err.Code != http.StatusNotFound {
+			log.Printf("background refresh of patient %d failed: %s", patient.ID, err.Error)
+		}
+	}()
+}
@@ -4,32 +4,58 @@ import (
 	"agnos-hospital-middleware/config"
 	"agnos-hospital-middleware/models"
 	"agnos-hospital-middleware/utils"
+	"agnos-hospital-middleware/upstream"
+	"agnos-hospital-middleware/validation"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PatientSearchInput struct {
 	NationalID  string `json:"national_id"`
 	PassportID  string `json:"passport_id"`
-	FirstName   string `json:"first_name"`
+	PassportCountry string `json:"passport_country"` // optional issuing country of passport_id
+	HN          string `json:"hn"` // hospital number
+	FirstName   string `json:"first_name"` // matched in the script it is written in
 	MiddleName  string `json:"middle_name"`
 	LastName    string `json:"last_name"`
-	DateOfBirth string `json:"date_of_birth"`
+	CrossScript bool   `json:"cross_script"` // match names in Thai or English through their romanisation
+	NameMatch   string `json:"name_match"`   // exact (default), prefix, fuzzy or phonetic
+	DateOfBirth string `json:"date_of_birth"` // see validation.ParseDate; partial dates match any day within them
+	AgeMin      *int   `json:"age_min"`
+	AgeMax      *int   `json:"age_max"`
 	PhoneNumber string `json:"phone_number"`
 	Email       string `json:"email"`
+	Federated   bool   `json:"federated"` // search every hospital the caller may access
 }
 
+// CodedError carries an HTTP status and message. ErrorCode, when set, is a
+// stable machine readable code returned alongside the message.
 type CodedError struct {
-	Code  int
-	Error string
+	Code      int
+	Error     string
+	ErrorCode string
 }
 
+// Machine readable error codes.
+const (
+	ErrorCodeUpstreamUnavailable = "upstream_unavailable"
+)
+
 /*
-First search for the patient in local db, and return in a slice
-If not available, fetch from external API and save in DB, then append to the slice and return
+First search for the patient in local db, and return a page of them (see pagination.go)
+Cached copies are refreshed per the hospital's freshness policy
+Searches without an identifier end here: hospital systems are only asked by identifier
+If not available on the first page and not a recent upstream miss, fetch from external API
+Save complete records in DB, remember misses as negative lookups, then return
 */
 func SearchPatient(c *gin.Context) {
 
@@ -40,9 +66,23 @@ func SearchPatient(c *gin.Context) {
 		return
 	}
 
-	// Validate that at least one field is provided for searching
-	if input.NationalID == "" && input.PassportID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "At least national_id or passport_id must be provided"})
+	if err := normalizeSearchInput(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Validate that enough is provided for searching: an identifier or demographics per the rules
+	demographic := !hasIdentifier(input)
+	if demographic && !meetsDemographicRules(input) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": demographicRulesError()})
+		return
+	}
+	var item any = models.Patient{}
+	if input.Federated {
+		item = FederatedPatient{}
+	}
+	page, pageErr := parsePage(c, patientSearchList(input, item))
+	if pageErr != (CodedError{}) {
+		c.JSON(pageErr.Code, gin.H{"error": pageErr.Error})
 		return
 	}
 
@@ -52,98 +92,438 @@ func SearchPatient(c *gin.Context) {
 		return
 	}
 
-	var patients []models.Patient
-	patients = fetchFromLocal(claims, input)
+	if input.Federated {
+		searchFederated(c, claims, input, page)
+		return
+	}
 
-	if len(patients) == 0 {
-		internalPatient, err := callExternalAPI(input, claims)
+	patients, result := fetchFromLocal(claims, input, page)
+
+	if len(patients) > 0 {
+		var stale bool
+		var err CodedError
+		patients, stale, err = revalidate(c.Request.Context(), claims.HospitalID, patients)
 		if err != (CodedError{}) {
-			c.JSON(err.Code, gin.H{"error": err.Error})
+			respondCodedError(c, err)
 			return
-		} else if internalPatient != (models.Patient{}) {
-			patients = append(patients, internalPatient)
 		}
-		// Store in DB
-		stored := storeInDB(internalPatient)
-		if !stored {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving patient to database"})
+		if stale {
+			c.Header("X-Cache", "stale")
+		}
+	}
+
+	if len(patients) == 0 && demographic && page.cursor == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+
+	//later pages are local only, the first one already asked the hospital system
+	if len(patients) == 0 && page.cursor == nil {
+		if negativeLookupHit(claims.HospitalID, input) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+			return
+		}
+		externalPatients, err := callExternalAPI(c.Request.Context(), input, claims)
+		if err.Code == http.StatusNotFound {
+			recordNegativeLookup(claims.HospitalID, input)
+		}
+		if err != (CodedError{}) {
+			respondCodedError(c, err)
 			return
 		}
+		// Store in DB
+		for _, internalPatient := range externalPatients {
+			if err := storeInDB(&internalPatient); err != (CodedError{}) {
+				respondCodedError(c, err)
+				return
+			}
+			patients = append(patients, internalPatient)
+		}
+		//what the hospital system returned is a single page
+		result = pageResult{}
+		if page.includeTotal {
+			total := int64(len(patients))
+			result.total = &total
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":      "Success",
-		"patients": patients,
+	respondPage(c, gin.H{"message": "Success"}, "patients", patients, page, result)
+}
+
+// normalizeSearchInput validates the identifiers searched for before they
+// reach a query or a hospital system's URL. Phone numbers and emails are
+// brought to the form they are matched by.
+func normalizeSearchInput(input *PatientSearchInput) error {
+	var err error
+	if input.NationalID != "" {
+		if input.NationalID, err = validation.NationalID(input.NationalID); err != nil {
+			return err
+		}
+	}
+	if input.PassportID != "" || input.PassportCountry != "" {
+		if input.PassportID, input.PassportCountry, err = validation.Passport(input.PassportID, input.PassportCountry); err != nil {
+			return err
+		}
+	}
+	input.HN = strings.TrimSpace(input.HN)
+	for _, name := range []*string{&input.FirstName, &input.MiddleName, &input.LastName} {
+		*name = strings.Join(strings.Fields(*name), " ")
+	}
+	switch input.NameMatch {
+	case "", NameMatchExact, NameMatchPrefix, NameMatchFuzzy, NameMatchPhonetic:
+	default:
+		return errors.New("name_match must be exact, prefix, fuzzy or phonetic")
+	}
+	if input.PhoneNumber != "" {
+		if input.PhoneNumber, err = validation.PhoneE164(input.PhoneNumber, config.PhoneDefaultRegion); err != nil {
+			return err
+		}
+	}
+	if input.Email != "" {
+		if input.Email, err = validation.NormalizeEmail(input.Email); err != nil {
+			return err
+		}
+	}
+	if _, err = validation.ParseDate(input.DateOfBirth); err != nil {
+		return err
+	}
+	for _, age := range []*int{input.AgeMin, input.AgeMax} {
+		if age != nil && (*age < 0 || *age > maxAge) {
+			return fmt.Errorf("age_min and age_max must be between 0 and %d", maxAge)
+		}
+	}
+	if input.AgeMin != nil && input.AgeMax != nil && *input.AgeMin > *input.AgeMax {
+		return errors.New("age_min must not exceed age_max")
+	}
+	return nil
+}
+
+// hasIdentifier reports whether a search names an identifier, the only way
+// hospital systems can be searched.
+func hasIdentifier(input PatientSearchInput) bool {
+	identifier, _ := lookupKey(input)
+	return identifier != ""
+}
+
+// demographicRules parses config.SearchDemographicRules into the lists of
+// criteria a search without an identifier must all include.
+func demographicRules() [][]string {
+	var rules [][]string
+	if strings.TrimSpace(config.SearchDemographicRules) == "none" {
+		return nil
+	}
+	for _, rule := range strings.Split(config.SearchDemographicRules, ";") {
+		var criteria []string
+		for _, criterion := range strings.Split(rule, "+") {
+			if criterion = strings.TrimSpace(criterion); criterion != "" {
+				criteria = append(criteria, criterion)
+			}
+		}
+		if len(criteria) > 0 {
+			rules = append(rules, criteria)
+		}
+	}
+	return rules
+}
+
+// meetsDemographicRules reports whether the search includes every criterion
+// of some rule. Criteria are first_name, middle_name, last_name,
+// date_of_birth, age (age_min or age_max), phone_number and email; a rule
+// naming anything else is never met.
+func meetsDemographicRules(input PatientSearchInput) bool {
+	given := map[string]bool{
+		"first_name":    input.FirstName != "",
+		"middle_name":   input.MiddleName != "",
+		"last_name":     input.LastName != "",
+		"date_of_birth": input.DateOfBirth != "",
+		"age":           input.AgeMin != nil || input.AgeMax != nil,
+		"phone_number":  input.PhoneNumber != "",
+		"email":         input.Email != "",
+	}
+rules:
+	for _, rule := range demographicRules() {
+		for _, criterion := range rule {
+			if !given[criterion] {
+				continue rules
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func demographicRulesError() string {
+	var allowed []string
+	for _, rule := range demographicRules() {
+		allowed = append(allowed, strings.Join(rule, " + "))
+	}
+	if len(allowed) == 0 {
+		return "At least national_id, passport_id or hn must be provided"
+	}
+	return "At least national_id, passport_id or hn must be provided, or one of: " + strings.Join(allowed, "; ")
+}
+
+// storeInDB caches a patient fetched upstream. Blank records are refused. A
+// cached copy with the same HN is replaced, the hospital number being the
+// hospital's own key for the record. A record registered here is kept and
+// returned instead, and one deleted here stays deleted.
+func storeInDB(internalPatient *models.Patient) CodedError {
+	failed := CodedError{Code: http.StatusInternalServerError, Error: "Error saving patient to database"}
+	if isBlankPatient(*internalPatient) {
+		return failed
+	}
+	var stored models.Patient
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if internalPatient.HN != nil {
+			err := tx.Unscoped().Where("hospital_id = ? AND hn = ?", internalPatient.HospitalID, *internalPatient.HN).Limit(1).Find(&stored).Error
+			if err != nil {
+				return err
+			}
+			if stored.ID != 0 && (stored.FetchedAt == nil || stored.DeletedAt.Valid) {
+				return nil
+			}
+			//the hospital system knows nothing of links, a stored copy keeps its own
+			internalPatient.EnterprisePatientID = stored.EnterprisePatientID
+		}
+		columns, err := cachedPatientColumns(tx)
+		if err != nil {
+			return err
+		}
+		upsert := clause.OnConflict{
+			Columns:   []clause.Column{{Name: "hospital_id"}, {Name: "hn"}},
+			DoUpdates: clause.AssignmentColumns(columns),
+			//nor a record registered or deleted here since
+			Where: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "patients.fetched_at IS NOT NULL AND patients.deleted_at IS NULL"}}},
+		}
+		result := tx.Clauses(upsert).Create(internalPatient)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("patient changed here while it was stored")
+		}
+		return clearNegativeLookups(tx, *internalPatient)
 	})
+	switch {
+	case err != nil:
+		return failed
+	case stored.DeletedAt.Valid:
+		return CodedError{Code: http.StatusConflict, Error: "Patient was deleted in this hospital"}
+	case stored.ID != 0 && stored.FetchedAt == nil:
+		*internalPatient = stored
+		return CodedError{}
+	}
+	indexPatientOrLog(internalPatient)
+	return CodedError{}
 }
 
-func storeInDB(internalPatient models.Patient) bool {
-	if err := config.DB.Create(&internalPatient).Error; err != nil {
-		return false
+// cachedPatientColumns are the columns a fresh copy from the hospital system
+// overwrites: all but the record's identity, creation and deletion.
+func cachedPatientColumns(db *gorm.DB) ([]string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&models.Patient{}); err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, column := range stmt.Schema.DBNames {
+		switch column {
+		case "id", "hospital_id", "hn", "created_at", "deleted_at":
+		default:
+			columns = append(columns, column)
+		}
 	}
-	return true
+	return columns, nil
 }
 
-func callExternalAPI(input PatientSearchInput, claims *utils.Claims) (models.Patient, CodedError) {
-	var apiURL string
-	if input.NationalID != "" {
-		apiURL = fmt.Sprintf("https://hospital-a.api.co.th/patient/search/%s", input.NationalID)
-	} else if input.PassportID != "" {
-		apiURL = fmt.Sprintf("https://hospital-a.api.co.th/patient/search/%s", input.PassportID)
+// hospitalNumber stores an empty HN as NULL so the unique index ignores it.
+func hospitalNumber(hn string) *string {
+	hn = strings.TrimSpace(hn)
+	if hn == "" {
+		return nil
 	}
+	return &hn
+}
 
-	resp, err := http.Get(apiURL)
+func callExternalAPI(ctx context.Context, input PatientSearchInput, claims *utils.Claims) ([]models.Patient, CodedError) {
+	//route the lookup to the staff member's own hospital system
+	var hospital models.Hospital
+	if err := config.DB.First(&hospital, claims.HospitalID).Error; err != nil {
+		return nil, CodedError{Code: http.StatusInternalServerError, Error: "Hospital not found"}
+	}
+	return searchUpstream(ctx, hospital, input)
+}
+
+// upstreamSource returns the adapter for a hospital's system.
+func upstreamSource(hospital models.Hospital) (upstream.PatientSource, CodedError) {
+	if !hospital.Enabled || hospital.BaseURL == "" {
+		return nil, CodedError{Code: http.StatusServiceUnavailable, Error: "No upstream system configured for this hospital"}
+	}
+	source, err := upstream.ForHospital(hospital)
 	if err != nil {
-		return models.Patient{}, CodedError{Code: http.StatusInternalServerError, Error: "Failed to fetch patient data from external API"}
+		return nil, CodedError{Code: http.StatusInternalServerError, Error: "Upstream adapter misconfigured"}
 	}
-	defer resp.Body.Close()
+	return source, CodedError{}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return models.Patient{}, CodedError{Code: http.StatusInternalServerError, Error: "Error fetching data from external API"}
+func searchUpstream(ctx context.Context, hospital models.Hospital, input PatientSearchInput) ([]models.Patient, CodedError) {
+	source, sourceErr := upstreamSource(hospital)
+	if sourceErr != (CodedError{}) {
+		return nil, sourceErr
 	}
+	return searchSource(ctx, hospital, source, input)
+}
 
-	body, err := io.ReadAll(resp.Body)
+// searchSource looks the patient up through a hospital's adapter. It does
+// not touch the database, so federated searches can call it concurrently.
+func searchSource(ctx context.Context, hospital models.Hospital, source upstream.PatientSource, input PatientSearchInput) ([]models.Patient, CodedError) {
+	var err error
+	var externalPatients []models.PatientExternal
+	if input.NationalID != "" {
+		externalPatients, err = source.SearchByNationalID(ctx, input.NationalID)
+	} else if input.PassportID != "" {
+		externalPatients, err = source.SearchByPassport(ctx, input.PassportID)
+	} else if input.HN != "" {
+		var externalPatient models.PatientExternal
+		externalPatient, err = source.GetByHN(ctx, input.HN)
+		if err == nil {
+			externalPatients = []models.PatientExternal{externalPatient}
+		}
+	}
+	if errors.Is(err, upstream.ErrNotModified) {
+		return nil, CodedError{Code: http.StatusNotModified}
+	}
+	if errors.Is(err, upstream.ErrNotFound) || (err == nil && len(externalPatients) == 0) {
+		return nil, CodedError{Code: http.StatusNotFound, Error: "Patient not found"}
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return nil, CodedError{Code: http.StatusInternalServerError, Error: "Failed to parse external API response"}
+	}
+	if errors.Is(err, upstream.ErrResponseTooLarge) {
+		return nil, CodedError{Code: http.StatusInternalServerError, Error: "External API response is too large"}
+	}
+	if errors.Is(err, upstream.ErrUnsupported) {
+		return nil, CodedError{Code: http.StatusNotImplemented, Error: "The hospital system does not support this lookup"}
+	}
+	if errors.Is(err, upstream.ErrCircuitOpen) {
+		return nil, CodedError{Code: http.StatusServiceUnavailable, Error: "External API is unavailable, try again later", ErrorCode: ErrorCodeUpstreamUnavailable}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil, CodedError{Code: http.StatusGatewayTimeout, Error: "External API timed out"}
+	}
 	if err != nil {
-		return models.Patient{}, CodedError{Code: http.StatusInternalServerError, Error: "Failed to read response body"}
+		return nil, CodedError{Code: http.StatusInternalServerError, Error: "Failed to fetch patient data from external API"}
 	}
 
-	var externalPatient models.PatientExternal
-	if err := json.Unmarshal(body, &externalPatient); err != nil {
-		return models.Patient{}, CodedError{Code: http.StatusInternalServerError, Error: "Failed to parse external API response"}
+	fetchedAt := time.Now()
+	var patients []models.Patient
+	denied, invalid := 0, 0
+	for _, externalPatient := range externalPatients {
+		//a date of birth that cannot be read is unknown, not a reason to drop the record
+		dateOfBirth, _ := validation.ParseDate(externalPatient.DateOfBirth)
+		patient := models.Patient{
+			FirstNameTH:  externalPatient.FirstNameTH,
+			MiddleNameTH: externalPatient.MiddleNameTH,
+			LastNameTH:   externalPatient.LastNameTH,
+			FirstNameEN:  externalPatient.FirstNameEN,
+			MiddleNameEN: externalPatient.MiddleNameEN,
+			LastNameEN:   externalPatient.LastNameEN,
+			DateOfBirth:  dateOfBirth,
+			NationalID:   externalPatient.NationalID,
+			PassportID:   externalPatient.PassportID,
+			PassportCountry: externalPatient.PassportCountry,
+			PhoneNumber:  externalPatient.PhoneNumber,
+			Email:        externalPatient.Email,
+			Gender:       externalPatient.Gender,
+			HN:           hospitalNumber(externalPatient.PatientHN),
+			HospitalID:   hospital.ID,
+			Hospital:     hospital,
+			FetchedAt:     &fetchedAt,
+			SourceETag:    externalPatient.ETag,
+			SourceVersion: externalPatient.Version,
+		}
+		normalizePatient(&patient)
+		//blank records are misses, never patients
+		if isBlankPatient(patient) {
+			continue
+		}
+		//nor are records whose identifiers cannot be right
+		if len(identifierViolations(patient)) > 0 {
+			invalid++
+			continue
+		}
+		//records name their hospital; a system that doesn't is trusted to return its own
+		if externalPatient.HospitalCode != "" && !strings.EqualFold(externalPatient.HospitalCode, hospital.Code) {
+			denied++
+			continue
+		}
+		//only complete records for the searched identifier may be cached
+		if answersSearch(patient, input) {
+			patients = append(patients, patient)
+		}
 	}
+	if len(patients) == 0 && denied > 0 {
+		return nil, CodedError{Code: http.StatusForbidden, Error: "Access denied for this hospital"}
+	}
+	if len(patients) == 0 && invalid > 0 {
+		return nil, CodedError{Code: http.StatusBadGateway, Error: "External API returned an invalid patient record"}
+	}
+	if len(patients) == 0 {
+		return nil, CodedError{Code: http.StatusNotFound, Error: "Patient not found"}
+	}
+	return patients, CodedError{}
+}
+
+func fetchFromLocal(claims *utils.Claims, input PatientSearchInput, page pageRequest) ([]models.Patient, pageResult) {
+	return fetchFromLocalHospitals([]uint{claims.HospitalID}, input, page) //restricting access to hospital same as staff
+}
 
-	if externalPatient.PatientHN != claims.HospitalName {
-		return models.Patient{}, CodedError{Code: http.StatusForbidden, Error: "Access denied for this hospital"}
+// patientSearchList describes the pages of a patient search. A name search
+// that is not exact is ranked, so it can only be sorted best match first.
+func patientSearchList(input PatientSearchInput, item any) listSpec {
+	if rankedNameSearch(input) {
+		return listSpec{sorts: map[string]string{"score": ""}, defaultSort: "score", item: item}
+	}
+	return listSpec{
+		sorts: map[string]string{
+			"id":            "id",
+			"last_name":     "last_name_en",
+			"date_of_birth": "date_of_birth_value",
+			"updated_at":    "updated_at",
+		},
+		defaultSort: "id",
+		item:        item,
 	}
+}
+
+func fetchFromLocalHospitals(hospitalIDs []uint, input PatientSearchInput, page pageRequest) ([]models.Patient, pageResult) {
+	query := localPatientQuery(hospitalIDs, input, page)
 
-	Hospital := models.Hospital{
-		ID: claims.HospitalID,
-		Name: claims.HospitalName,
+	if page.column == "" {
+		//ranking needs every match, it cannot be done by the database
+		var patients []models.Patient
+		if err := query.Order("id").Limit(maxRankedCandidates).Find(&patients).Error; err != nil {
+			//Do nothing. just return empty page
+		}
+		return pageByScore(rankByName(patients, input), page)
 	}
 
-	internalPatient := models.Patient{
-		FirstNameTH:  externalPatient.FirstNameTH,
-		MiddleNameTH: externalPatient.MiddleNameTH,
-		LastNameTH:   externalPatient.LastNameTH,
-		FirstNameEN:  externalPatient.FirstNameEN,
-		MiddleNameEN: externalPatient.MiddleNameEN,
-		LastNameEN:   externalPatient.LastNameEN,
-		DateOfBirth:  externalPatient.DateOfBirth,
-		NationalID:   externalPatient.NationalID,
-		PassportID:   externalPatient.PassportID,
-		PhoneNumber:  externalPatient.PhoneNumber,
-		Email:        externalPatient.Email,
-		Gender:       externalPatient.Gender,
-		HospitalID:   Hospital.ID,
-		Hospital:     Hospital,
+	patients, result, err := paginate[models.Patient](query, page)
+	if err != nil {
+		//Do nothing. just return empty page
 	}
-	return internalPatient, CodedError{}
+	return patients, result
 }
 
-func fetchFromLocal(claims *utils.Claims, input PatientSearchInput) []models.Patient {
-
-	var patients []models.Patient
-	query := config.DB.Where("hospital_id = ?", claims.HospitalID) //restricting access to hospital same as staff
+// localPatientQuery finds the patients of the given hospitals matching a
+// search.
+func localPatientQuery(hospitalIDs []uint, input PatientSearchInput, page pageRequest) *gorm.DB {
+	query := config.DB.Where("hospital_id IN ?", hospitalIDs)
+	if page.maxID > 0 {
+		query = query.Where("id <= ?", page.maxID)
+	}
 
 	if input.NationalID != "" {
 		query = query.Where("national_id = ?", input.NationalID)
@@ -151,31 +531,73 @@ func fetchFromLocal(claims *utils.Claims, input PatientSearchInput) []models.Pat
 	if input.PassportID != "" {
 		query = query.Where("passport_id = ?", input.PassportID)
 	}
-	if input.FirstName != "" {
-		query = query.Where("first_name_en = ?", input.FirstName)
+	if input.PassportCountry != "" {
+		//copies without a country may still be the one searched for
+		query = query.Where("passport_country IN ?", []string{input.PassportCountry, ""})
+	}
+	if input.HN != "" {
+		query = query.Where("hn = ?", input.HN)
 	}
-	if input.MiddleName != "" {
-		query = query.Where("middle_name_en = ?", input.MiddleName)
+	for _, term := range nameTerms(input) {
+		query = whereNameMatches(query, term, input)
 	}
-	if input.LastName != "" {
-		query = query.Where("last_name_en = ?", input.LastName)
+	if dateOfBirth, _ := validation.ParseDate(input.DateOfBirth); !dateOfBirth.IsZero() {
+		earliest, latest := dateOfBirth.Range()
+		query = whereBornBetween(query, earliest, latest)
 	}
-	if input.DateOfBirth != "" {
-		query = query.Where("date_of_birth = ?", input.DateOfBirth)
+	if input.AgeMin != nil || input.AgeMax != nil {
+		earliest, latest := birthRangeForAges(input.AgeMin, input.AgeMax, time.Now())
+		query = whereBornBetween(query, earliest, latest)
 	}
 	if input.PhoneNumber != "" {
-		query = query.Where("phone_number = ?", input.PhoneNumber)
+		query = query.Where("phone_e164 = ?", input.PhoneNumber)
 	}
 	if input.Email != "" {
-		query = query.Where("email = ?", input.Email)
+		query = query.Where("email_normalized = ?", input.Email)
 	}
+	return query
+}
+
+// maxAge bounds age searches.
+const maxAge = 150
 
-	result := query.Find(&patients)
-	if result.Error != nil {
-		//Do nothing. just return empty slice
+// birthRangeForAges returns the earliest and latest dates of birth of someone
+// aged between minAge and maxAge today. Either bound may be nil.
+func birthRangeForAges(minAge, maxAgeBound *int, now time.Time) (time.Time, time.Time) {
+	today := models.NewPartialDate(now, models.DatePrecisionDay).Value
+	earliest, latest := today.AddDate(-(maxAge + 1), 0, 1), *today
+	if maxAgeBound != nil {
+		//the day after the (max+1)th birthday
+		earliest = today.AddDate(-(*maxAgeBound + 1), 0, 1)
 	}
+	if minAge != nil {
+		latest = today.AddDate(-*minAge, 0, 0)
+	}
+	return earliest, latest
+}
 
-	return patients
+// whereBornBetween keeps patients who may have been born between earliest and
+// latest: their date of birth, at its own precision, overlaps the range.
+// Patients without a date of birth are left out.
+func whereBornBetween(query *gorm.DB, earliest, latest time.Time) *gorm.DB {
+	monthStart := models.NewPartialDate(earliest, models.DatePrecisionMonth).Value
+	yearStart := models.NewPartialDate(earliest, models.DatePrecisionYear).Value
+	return query.Where(
+		"((date_of_birth_precision = ? AND date_of_birth_value BETWEEN ? AND ?) OR "+
+			"(date_of_birth_precision = ? AND date_of_birth_value BETWEEN ? AND ?) OR "+
+			"(date_of_birth_precision = ? AND date_of_birth_value BETWEEN ? AND ?))",
+		models.DatePrecisionDay, earliest, latest,
+		models.DatePrecisionMonth, *monthStart, latest,
+		models.DatePrecisionYear, *yearStart, latest,
+	)
+}
+
+func respondCodedError(c *gin.Context, err CodedError) {
+	body := gin.H{"error": err.Error}
+	if err.ErrorCode != "" {
+		body["code"] = err.ErrorCode
+	}
+	c.JSON(err.Code, body)
 }
 
 func getClaimsFromToken(c *gin.Context) (*utils.Claims, CodedError) {
@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/names"
+	"agnos-hospital-middleware/validation"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+var hnPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9/_.-]{0,31}$`)
+
+const maxPatientNameLength = 100
+
+// GetPatient returns a patient of the caller's hospital.
+func GetPatient(c *gin.Context) {
+	patient, findErr := findHospitalPatient(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"patient": patient})
+}
+
+/*
+-> registration staff only (see routes)
+-> the patient belongs to the caller's hospital
+-> validate every field
+-> identifiers must not already be registered in the hospital
+-> push to DB and link to the same person's records elsewhere (see mpi.go)
+*/
+func CreatePatient(c *gin.Context) {
+	var input models.PatientInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	patient := models.Patient{
+		FirstNameTH:     input.FirstNameTH,
+		MiddleNameTH:    input.MiddleNameTH,
+		LastNameTH:      input.LastNameTH,
+		FirstNameEN:     input.FirstNameEN,
+		MiddleNameEN:    input.MiddleNameEN,
+		LastNameEN:      input.LastNameEN,
+		NationalID:      input.NationalID,
+		PassportID:      input.PassportID,
+		PassportCountry: input.PassportCountry,
+		HN:              hospitalNumber(input.HN),
+		PhoneNumber:     input.PhoneNumber,
+		Email:           input.Email,
+		Gender:          input.Gender,
+		HospitalID:      claims.HospitalID,
+	}
+	var dateErr error
+	patient.DateOfBirth, dateErr = validation.ParseDate(input.DateOfBirth)
+	normalizePatient(&patient)
+	if violations := patientViolations(patient, dateErr); len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patient", "violations": violations})
+		return
+	}
+	if conflict := identifierConflict(patient); conflict != (CodedError{}) {
+		c.JSON(conflict.Code, gin.H{"error": conflict.Error})
+		return
+	}
+
+	if err := config.DB.Create(&patient).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create patient"})
+		return
+	}
+	indexPatientOrLog(&patient)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Patient created", "patient": patient})
+}
+
+/*
+-> registration staff only (see routes)
+-> copies fetched from a hospital system are maintained there, not here
+-> apply the fields present in the input
+-> validate the result and its identifiers
+-> look for new links to the same person's records elsewhere
+*/
+func UpdatePatient(c *gin.Context) {
+	var input models.PatientUpdateInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	patient, findErr := findHospitalPatient(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+	if patient.FetchedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Patient is maintained by the hospital system"})
+		return
+	}
+
+	for field, value := range map[*string]*string{
+		&patient.FirstNameTH:     input.FirstNameTH,
+		&patient.MiddleNameTH:    input.MiddleNameTH,
+		&patient.LastNameTH:      input.LastNameTH,
+		&patient.FirstNameEN:     input.FirstNameEN,
+		&patient.MiddleNameEN:    input.MiddleNameEN,
+		&patient.LastNameEN:      input.LastNameEN,
+		&patient.NationalID:      input.NationalID,
+		&patient.PassportID:      input.PassportID,
+		&patient.PassportCountry: input.PassportCountry,
+		&patient.PhoneNumber:     input.PhoneNumber,
+		&patient.Email:           input.Email,
+		&patient.Gender:          input.Gender,
+	} {
+		if value != nil {
+			*field = *value
+		}
+	}
+	if input.HN != nil {
+		patient.HN = hospitalNumber(*input.HN)
+	}
+	var dateErr error
+	if input.DateOfBirth != nil {
+		patient.DateOfBirth, dateErr = validation.ParseDate(*input.DateOfBirth)
+	}
+	normalizePatient(&patient)
+	if violations := patientViolations(patient, dateErr); len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patient", "violations": violations})
+		return
+	}
+	if conflict := identifierConflict(patient); conflict != (CodedError{}) {
+		c.JSON(conflict.Code, gin.H{"error": conflict.Error})
+		return
+	}
+
+	if err := config.DB.Save(&patient).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update patient"})
+		return
+	}
+	indexPatientOrLog(&patient)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Patient updated", "patient": patient})
+}
+
+// DeletePatient soft deletes a patient of the caller's hospital. The record is
+// kept for the audit trail but no longer returned by any endpoint.
+func DeletePatient(c *gin.Context) {
+	patient, findErr := findHospitalPatient(c)
+	if findErr != (CodedError{}) {
+		c.JSON(findErr.Code, gin.H{"error": findErr.Error})
+		return
+	}
+
+	if err := config.DB.Delete(&patient).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete patient"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Patient deleted"})
+}
+
+// findHospitalPatient loads the patient in the :id parameter. Patients of
+// other hospitals are reported as not found.
+func findHospitalPatient(c *gin.Context) (models.Patient, CodedError) {
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		return models.Patient{}, fetchErr
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return models.Patient{}, CodedError{Code: http.StatusNotFound, Error: "Patient not found"}
+	}
+	var patient models.Patient
+	if err := config.DB.Where("hospital_id = ? AND id = ?", claims.HospitalID, id).First(&patient).Error; err != nil {
+		return models.Patient{}, CodedError{Code: http.StatusNotFound, Error: "Patient not found"}
+	}
+	return patient, CodedError{}
+}
+
+// normalizePatient trims every field, brings codes to their canonical case
+// and derives the keys names, phone numbers and emails are matched by.
+func normalizePatient(patient *models.Patient) {
+	for _, field := range []*string{
+		&patient.FirstNameTH, &patient.MiddleNameTH, &patient.LastNameTH,
+		&patient.FirstNameEN, &patient.MiddleNameEN, &patient.LastNameEN,
+		&patient.PhoneNumber, &patient.Email, &patient.Gender,
+	} {
+		*field = strings.TrimSpace(*field)
+	}
+	patient.NationalID = validation.NormalizeNationalID(patient.NationalID)
+	patient.PassportID = validation.NormalizePassport(patient.PassportID)
+	patient.PassportCountry = validation.NormalizePassport(patient.PassportCountry)
+	patient.Gender = strings.ToUpper(patient.Gender)
+	patient.FirstNameRTGS = names.Key(patient.FirstNameTH)
+	patient.MiddleNameRTGS = names.Key(patient.MiddleNameTH)
+	patient.LastNameRTGS = names.Key(patient.LastNameTH)
+	patient.FirstNameSoundex = names.Soundex(patient.FirstNameEN)
+	patient.MiddleNameSoundex = names.Soundex(patient.MiddleNameEN)
+	patient.LastNameSoundex = names.Soundex(patient.LastNameEN)
+	patient.PhoneE164, _ = validation.PhoneE164(patient.PhoneNumber, config.PhoneDefaultRegion)
+	patient.EmailNormalized, _ = validation.NormalizeEmail(patient.Email)
+}
+
+// patientViolations lists every rule a patient record breaks. dateErr is the
+// error parsing its date of birth, if any.
+func patientViolations(patient models.Patient, dateErr error) []string {
+	violations := []string{}
+
+	if patient.NationalID == "" && patient.PassportID == "" && patient.HN == nil {
+		violations = append(violations, "national_id, passport_id or hn is required")
+	}
+	violations = append(violations, identifierViolations(patient)...)
+	if patient.HN != nil && !hnPattern.MatchString(*patient.HN) {
+		violations = append(violations, "hn must be 1-32 letters, digits, /, _, . or -")
+	}
+
+	if (patient.FirstNameEN == "" || patient.LastNameEN == "") && (patient.FirstNameTH == "" || patient.LastNameTH == "") {
+		violations = append(violations, "a first and last name, in English or Thai, is required")
+	}
+	names := []struct{ field, value string }{
+		{"first_name_th", patient.FirstNameTH}, {"middle_name_th", patient.MiddleNameTH}, {"last_name_th", patient.LastNameTH},
+		{"first_name_en", patient.FirstNameEN}, {"middle_name_en", patient.MiddleNameEN}, {"last_name_en", patient.LastNameEN},
+	}
+	for _, name := range names {
+		name, value := name.field, name.value
+		if utf8.RuneCountInString(value) > maxPatientNameLength {
+			violations = append(violations, fmt.Sprintf("%s must be at most %d characters", name, maxPatientNameLength))
+		}
+		if strings.IndexFunc(value, func(r rune) bool { return unicode.IsDigit(r) || unicode.IsControl(r) }) >= 0 {
+			violations = append(violations, fmt.Sprintf("%s must not contain digits or control characters", name))
+		}
+	}
+
+	if dateErr != nil {
+		violations = append(violations, dateErr.Error())
+	} else if !patient.DateOfBirth.IsZero() {
+		if born, _ := patient.DateOfBirth.Range(); born.After(time.Now()) || born.Year() < 1900 {
+			violations = append(violations, "date_of_birth must be between 1900 and today")
+		}
+	}
+	if patient.PhoneNumber != "" && patient.PhoneE164 == "" {
+		violations = append(violations, validation.ErrInvalidPhone.Error())
+	}
+	if patient.Email != "" && patient.EmailNormalized == "" {
+		violations = append(violations, validation.ErrInvalidEmail.Error())
+	}
+	if patient.Gender != "" && patient.Gender != "M" && patient.Gender != "F" {
+		violations = append(violations, "gender must be M or F")
+	}
+	return violations
+}
+
+// identifierViolations checks the national ID and passport, which hospital
+// systems must get right as well.
+func identifierViolations(patient models.Patient) []string {
+	var violations []string
+	if patient.NationalID != "" && !validation.ValidNationalID(patient.NationalID) {
+		violations = append(violations, validation.ErrInvalidNationalID.Error())
+	}
+	if patient.PassportCountry != "" && !validation.ValidPassportCountry(patient.PassportCountry) {
+		violations = append(violations, validation.ErrInvalidPassportCountry.Error())
+	} else if patient.PassportID != "" && !validation.ValidPassport(patient.PassportID, patient.PassportCountry) {
+		violations = append(violations, validation.ErrInvalidPassport.Error())
+	}
+	if patient.PassportCountry != "" && patient.PassportID == "" {
+		violations = append(violations, "passport_country needs a passport_id")
+	}
+	return violations
+}
+
+// identifierConflict reports another patient of the hospital holding one of
+// the patient's identifiers. HNs stay reserved by deleted patients.
+func identifierConflict(patient models.Patient) CodedError {
+	db := config.DB
+	identifiers := []struct{ column, value string }{{"national_id", patient.NationalID}, {"passport_id", patient.PassportID}}
+	for _, identifier := range identifiers {
+		if identifier.value == "" {
+			continue
+		}
+		var count int64
+		db.Model(&models.Patient{}).Where("hospital_id = ? AND id <> ? AND "+identifier.column+" = ?", patient.HospitalID, patient.ID, identifier.value).Count(&count)
+		if count > 0 {
+			return CodedError{Code: http.StatusConflict, Error: fmt.Sprintf("A patient with this %s already exists", identifier.column)}
+		}
+	}
+	if patient.HN != nil {
+		var count int64
+		db.Unscoped().Model(&models.Patient{}).Where("hospital_id = ? AND id <> ? AND hn = ?", patient.HospitalID, patient.ID, *patient.HN).Count(&count)
+		if count > 0 {
+			return CodedError{Code: http.StatusConflict, Error: "A patient with this hn already exists"}
+		}
+	}
+	return CodedError{}
+}
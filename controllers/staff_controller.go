@@ -4,29 +4,77 @@ import (
 	"agnos-hospital-middleware/config"
 	"agnos-hospital-middleware/models"
 	"agnos-hospital-middleware/utils"
+	"crypto/subtle"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
+var errBootstrapDone = errors.New("bootstrap already completed")
+
 /*
--> Find the hospital with input, create if does not exist
+-> only administrators reach here (see routes)
+-> resolve the hospital, default to the administrator's own
+-> admins may only provision staff in their own hospital
+-> validate the role, default if not given
+-> apply the password policy
 -> hash the password
 -> create the staff
 -> push to DB
 */
 func CreateStaff(c *gin.Context) {
-	var input models.StaffInput
+	var input models.StaffCreateInput
 	if err := c.ShouldBindBodyWithJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		c.JSON(fetchErr.Code, gin.H{"error": fetchErr.Error})
+		return
+	}
+
+	role := input.Role
+	if role == "" {
+		role = models.DefaultRole
+	}
+	if !role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+	if role == models.RoleSystemAdmin && claims.Role != models.RoleSystemAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only system administrators can create system administrators"})
+		return
+	}
+
 	db := config.DB
 
-	//Create or find Hospital
+	//Hospitals must already exist, they are only created through the hospital API
 	var hospital models.Hospital
-	db.FirstOrCreate(&hospital, models.Hospital{Name: input.Hospital})
+	hospitalQuery := db.Where("id = ?", claims.HospitalID)
+	if input.Hospital != "" {
+		hospitalQuery = db.Where("name = ?", input.Hospital)
+	}
+	if err := hospitalQuery.First(&hospital).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hospital not found"})
+		return
+	}
+	if hospital.ID != claims.HospitalID && claims.Role != models.RoleSystemAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot create staff for another hospital"})
+		return
+	}
+
+	if err := checkNewPassword(models.Staff{Username: input.Username}, input.Password); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
 
 	//Hash Password
 	hashedPassword, err := utils.HashPassword(input.Password)
@@ -39,6 +87,7 @@ func CreateStaff(c *gin.Context) {
 	staff := models.Staff{
 		Username:   input.Username,
 		Password:   hashedPassword,
+		Role:       role,
 		HospitalID: hospital.ID,
 	}
 
@@ -47,14 +96,105 @@ func CreateStaff(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Staff created"})
+	c.JSON(http.StatusOK, gin.H{"message": "Staff created", "staff_id": staff.ID})
+
+}
+
+/*
+One-time path to create the very first administrator.
+-> requires the configured bootstrap token
+-> refuses once any staff account exists
+-> create the hospital and a system administrator in one transaction
+*/
+func BootstrapAdmin(c *gin.Context) {
+	var input models.BootstrapInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if config.BootstrapToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Bootstrap is disabled"})
+		return
+	}
+	provided := c.GetHeader("X-Bootstrap-Token")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(config.BootstrapToken)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid bootstrap token"})
+		return
+	}
+
+	if err := checkNewPassword(models.Staff{Username: input.Username}, input.Password); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	hospital := models.Hospital{
+		Name:                     input.Hospital,
+		Code:                     strings.ToUpper(strings.TrimSpace(input.HospitalCode)),
+		Adapter:                  models.HospitalAdapterStandard,
+		AuthMethod:               models.HospitalAuthNone,
+		ConnectTimeoutMs:         3000,
+		TimeoutMs:                10000,
+		MaxRetries:               2,
+		CacheTTLSeconds:          86400,
+		CacheRefreshAheadPercent: 80,
+		Enabled:                  true,
+	}
+	if err := validateHospital(hospital); err != (CodedError{}) {
+		c.JSON(err.Code, gin.H{"error": err.Error})
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(input.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password encryption failed"})
+		return
+	}
+
+	var staff models.Staff
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Staff{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errBootstrapDone
+		}
+
+		if err := tx.Create(&hospital).Error; err != nil {
+			return err
+		}
+
+		staff = models.Staff{
+			Username:   input.Username,
+			Password:   hashedPassword,
+			Role:       models.RoleSystemAdmin,
+			HospitalID: hospital.ID,
+		}
+		return tx.Create(&staff).Error
+	})
+	if errors.Is(err, errBootstrapDone) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Bootstrap already completed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to bootstrap administrator"})
+		return
+	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "Administrator created", "staff_id": staff.ID, "hospital_id": staff.HospitalID})
 }
 
 /*
+-> refuse IPs with too many recent failures
 -> fetch staff from DB
--> match the password hash with input
--> Generate JWT
+-> refuse locked accounts and attempts inside the back-off delay
+-> match the password hash with input, count failures
+-> re-hash outdated hashes with the current settings
+-> with MFA, return a challenge token for /staff/login/mfa instead
+-> Generate access and refresh tokens
+Every credential failure answers the same "Invalid credentials" so the
+lockout state cannot be used to find out which usernames exist.
 */
 func LoginStaff(c *gin.Context) {
 	var input models.StaffInput
@@ -63,30 +203,140 @@ func LoginStaff(c *gin.Context) {
 		return
 	}
 
+	ip := c.ClientIP()
+	if loginIPThrottle.blocked(ip) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login attempts"})
+		return
+	}
+
 	db := config.DB
 
 	var hospital models.Hospital
 	if err := db.Where("name = ?", input.Hospital).First(&hospital).Error; err != nil {
+		burnPasswordCheck(input.Password)
+		loginIPThrottle.fail(ip)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
 	var staff models.Staff
 	if err := db.Where("username = ? AND hospital_id = ?", input.Username, hospital.ID).First(&staff).Error; err != nil {
+		burnPasswordCheck(input.Password)
+		loginIPThrottle.fail(ip)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if loginBlocked(staff, time.Now()) {
+		burnPasswordCheck(input.Password)
+		loginIPThrottle.fail(ip)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	if !utils.CheckPasswordHash(input.Password, staff.Password) {
+	match, needsRehash := utils.CheckPasswordHash(input.Password, staff.Password)
+	if !match {
+		registerFailedLogin(c, staff)
+		loginIPThrottle.fail(ip)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	clearFailedLogins(staff)
+
+	//hash made with an old algorithm or cost: store one with the current settings
+	if needsRehash {
+		upgradePasswordHash(staff, input.Password)
+	}
+
+	//second factor: hand out a short-lived challenge instead of the tokens
+	if staff.MFAEnabled || hospital.RequireMFA {
+		mfaToken, err := utils.GenerateMFAToken(staff, hospital)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required":            true,
+			"mfa_enrollment_required": !staff.MFAEnabled,
+			"mfa_token":               mfaToken,
+		})
+		return
+	}
 
-	token, err := utils.GenerateJWT(staff.Username, staff.Hospital)
+	tokens, err := issueTokens(db, staff, hospital, "")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	c.JSON(http.StatusOK, tokens)
+}
+
+/*
+-> only administrators reach here (see routes)
+-> clear the lockout and failure counters
+*/
+func UnlockStaff(c *gin.Context) {
+	staff, err := findManagedStaff(c)
+	if err != (CodedError{}) {
+		c.JSON(err.Code, gin.H{"error": err.Error})
+		return
+	}
+
+	if dbErr := config.DB.Model(&models.Staff{}).Where("id = ?", staff.ID).Updates(map[string]interface{}{
+		"failed_login_attempts": 0,
+		"last_failed_login_at":  nil,
+		"locked_until":          nil,
+	}).Error; dbErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock staff"})
+		return
+	}
+	recordAudit(c, models.AuditStaffUnlocked, staff.HospitalID, &staff.ID, "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Staff unlocked"})
+}
+
+// upgradePasswordHash replaces a hash in place. Only the exact hash that was
+// verified is replaced, so a concurrent password change is never overwritten.
+// A failure is logged and the old hash keeps working.
+func upgradePasswordHash(staff models.Staff, password string) {
+	hashed, err := utils.HashPassword(password)
+	if err != nil {
+		log.Printf("failed to re-hash password of staff %d: %v", staff.ID, err)
+		return
+	}
+	if err := config.DB.Model(&models.Staff{}).
+		Where("id = ? AND password = ?", staff.ID, staff.Password).
+		Update("password", hashed).Error; err != nil {
+		log.Printf("failed to store re-hashed password of staff %d: %v", staff.ID, err)
+	}
+}
+
+// findManagedStaff loads the staff member named by the :id path parameter and
+// checks the caller may manage them: admins only within their own hospital,
+// and never a system administrator.
+func findManagedStaff(c *gin.Context) (models.Staff, CodedError) {
+	claims, fetchErr := getClaimsFromToken(c)
+	if fetchErr != (CodedError{}) {
+		return models.Staff{}, fetchErr
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return models.Staff{}, CodedError{Code: http.StatusBadRequest, Error: "Invalid staff id"}
+	}
+
+	var staff models.Staff
+	if err := config.DB.First(&staff, id).Error; err != nil {
+		return models.Staff{}, CodedError{Code: http.StatusNotFound, Error: "Staff not found"}
+	}
+	if staff.HospitalID != claims.HospitalID && claims.Role != models.RoleSystemAdmin {
+		//do not reveal staff of other hospitals
+		return models.Staff{}, CodedError{Code: http.StatusNotFound, Error: "Staff not found"}
+	}
+	//as with creating them, only system administrators manage system administrators
+	if staff.Role == models.RoleSystemAdmin && claims.Role != models.RoleSystemAdmin {
+		return models.Staff{}, CodedError{Code: http.StatusForbidden, Error: "Only system administrators can manage system administrators"}
+	}
+	return staff, CodedError{}
 }
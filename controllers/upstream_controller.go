@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/upstream"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpstreamStatusItem is a hospital system and its circuit breaker state.
+type UpstreamStatusItem struct {
+	HospitalID   uint                   `json:"hospital_id"`
+	HospitalCode string                 `json:"hospital_code"`
+	Enabled      bool                   `json:"enabled"`
+	Configured   bool                   `json:"configured"`
+	Breaker      upstream.BreakerStatus `json:"breaker"`
+}
+
+var upstreamStatusList = listSpec{
+	sorts:       map[string]string{"id": "id", "code": "code"},
+	defaultSort: "id",
+	item:        UpstreamStatusItem{},
+}
+
+// UpstreamStatus lists every hospital system with its circuit breaker state.
+func UpstreamStatus(c *gin.Context) {
+	page, pageErr := parsePage(c, upstreamStatusList)
+	if pageErr != (CodedError{}) {
+		c.JSON(pageErr.Code, gin.H{"error": pageErr.Error})
+		return
+	}
+
+	hospitals, result, err := paginate[models.Hospital](config.DB, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list hospitals"})
+		return
+	}
+
+	upstreams := make([]UpstreamStatusItem, 0, len(hospitals))
+	for _, hospital := range hospitals {
+		upstreams = append(upstreams, UpstreamStatusItem{
+			HospitalID:   hospital.ID,
+			HospitalCode: hospital.Code,
+			Enabled:      hospital.Enabled,
+			Configured:   hospital.BaseURL != "",
+			Breaker:      upstream.BreakerFor(hospital.ID).Status(),
+		})
+	}
+
+	respondPage(c, gin.H{}, "upstreams", upstreams, page, result)
+}
+
+// Metrics exposes the service metrics in the Prometheus text format to
+// scrapers holding the metrics token. It is also kept off the public proxy
+// (see nginx.conf).
+func Metrics(c *gin.Context) {
+	if config.MetricsToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Metrics are disabled"})
+		return
+	}
+	provided := c.GetHeader("Authorization")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte("Bearer "+config.MetricsToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid metrics token"})
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	upstream.WriteMetrics(c.Writer)
+}
@@ -3,6 +3,8 @@ package middleware
 import (
 	"net/http"
 	"strings"
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
 	"agnos-hospital-middleware/utils"
 
 	"github.com/gin-gonic/gin"
@@ -18,12 +20,18 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
 		claims, err := utils.ValidateJWT(tokenStr)
-		if err != nil {
+		if err != nil || claims == nil || claims.ID == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			return
 		}
 
+		if models.IsTokenRevoked(config.DB, claims.ID, claims.StaffID, claims.IssuedAtTime()) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			return
+		}
+
 		c.Set("username", claims.Username)
+		c.Set("role", claims.Role)
 		c.Set("hospital", claims)
 
 		c.Next()
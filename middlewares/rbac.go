@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRoles allows the request through only if the authenticated staff
+// member holds one of the given roles. It must run after AuthMiddleware.
+func RequireRoles(roles ...models.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := claimsFromContext(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing authentication"})
+			return
+		}
+		for _, role := range roles {
+			if claims.Role == role {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	}
+}
+
+// RequirePermissions allows the request through only if the role of the
+// authenticated staff member grants every one of the given permissions.
+// It must run after AuthMiddleware.
+func RequirePermissions(perms ...models.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := claimsFromContext(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing authentication"})
+			return
+		}
+		for _, perm := range perms {
+			if !claims.Role.Can(perm) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func claimsFromContext(c *gin.Context) (*utils.Claims, bool) {
+	value, exists := c.Get("hospital")
+	if !exists {
+		return nil, false
+	}
+	claims, ok := value.(*utils.Claims)
+	return claims, ok
+}
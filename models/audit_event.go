@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+const (
+	AuditStaffLockedOut = "staff.locked_out"
+	AuditStaffUnlocked  = "staff.unlocked"
+	AuditMFAEnabled     = "staff.mfa_enabled"
+	AuditMFADisabled    = "staff.mfa_disabled"
+	AuditMFARecoveryUse = "staff.mfa_recovery_code_used"
+
+	AuditPasswordChanged        = "staff.password_changed"
+	AuditPasswordResetIssued    = "staff.password_reset_issued"
+	AuditPasswordResetCompleted = "staff.password_reset_completed"
+
+	AuditHospitalAccessGranted = "staff.hospital_access_granted"
+	AuditHospitalAccessRevoked = "staff.hospital_access_revoked"
+
+	AuditPatientsLinked      = "mpi.patients_linked"
+	AuditPatientUnlinked     = "mpi.patient_unlinked"
+	AuditMatchReviewRejected = "mpi.match_review_rejected"
+)
+
+// AuditEvent is an append-only record of a security relevant action.
+// ActorID is the staff member who performed it, if authenticated, and
+// SubjectID the staff member it was performed on.
+type AuditEvent struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index"`
+	Event      string    `gorm:"index;not null"`
+	HospitalID uint      `gorm:"index"`
+	ActorID    *uint
+	SubjectID  *uint
+	IPAddress  string
+	Details    string
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Precision of a partially known date.
+const (
+	DatePrecisionYear  = "year"
+	DatePrecisionMonth = "month"
+	DatePrecisionDay   = "day"
+)
+
+// PartialDate is a Gregorian calendar date of which only the year, or the
+// year and month, may be known. Value is the first day of the period it
+// denotes, at midnight UTC; a nil Value is an unknown date.
+type PartialDate struct {
+	Value     *time.Time `gorm:"type:date;index"`
+	Precision string     `gorm:"size:5"`
+}
+
+// NewPartialDate truncates t to the given precision.
+func NewPartialDate(t time.Time, precision string) PartialDate {
+	year, month, day := t.Date()
+	switch precision {
+	case DatePrecisionYear:
+		month, day = time.January, 1
+	case DatePrecisionMonth:
+		day = 1
+	default:
+		precision = DatePrecisionDay
+	}
+	value := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return PartialDate{Value: &value, Precision: precision}
+}
+
+func (d PartialDate) IsZero() bool {
+	return d.Value == nil
+}
+
+// Range returns the first and last day the date may denote.
+func (d PartialDate) Range() (time.Time, time.Time) {
+	if d.Value == nil {
+		return time.Time{}, time.Time{}
+	}
+	switch d.Precision {
+	case DatePrecisionYear:
+		return *d.Value, d.Value.AddDate(1, 0, -1)
+	case DatePrecisionMonth:
+		return *d.Value, d.Value.AddDate(0, 1, -1)
+	}
+	return *d.Value, *d.Value
+}
+
+// String formats the date in ISO 8601 at its precision: 1985, 1985-04 or
+// 1985-04-12. An unknown date is empty.
+func (d PartialDate) String() string {
+	if d.Value == nil {
+		return ""
+	}
+	switch d.Precision {
+	case DatePrecisionYear:
+		return d.Value.Format("2006")
+	case DatePrecisionMonth:
+		return d.Value.Format("2006-01")
+	}
+	return d.Value.Format("2006-01-02")
+}
+
+func (d PartialDate) MarshalJSON() ([]byte, error) {
+	if d.Value == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// EnterprisePatient is one person across hospitals: the patient records of
+// every hospital linked to it through Patient.EnterprisePatientID.
+type EnterprisePatient struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+// MatchReview statuses.
+const (
+	MatchReviewPending  = "pending"
+	MatchReviewLinked   = "linked"
+	MatchReviewRejected = "rejected"
+)
+
+// MatchReview is a pair of patient records that may be the same person,
+// queued for a person to decide, or a decision on such a pair. A rejected
+// pair is never linked automatically. PatientID is the lower of the two IDs.
+type MatchReview struct {
+	ID           uint    `gorm:"primaryKey"`
+	PatientID    uint    `gorm:"uniqueIndex:idx_match_review_pair;not null"`
+	Patient      Patient `gorm:"foreignKey:PatientID"`
+	CandidateID  uint    `gorm:"uniqueIndex:idx_match_review_pair;not null"`
+	Candidate    Patient `gorm:"foreignKey:CandidateID"`
+	Score        float64
+	Rule         string // the deterministic rule that matched, if any
+	Status       string `gorm:"index;not null"`
+	ReviewedByID *uint
+	ReviewedAt   *time.Time
+	CreatedAt    time.Time
+}
+
+type PatientLinkInput struct {
+	PatientID      uint `json:"patient_id" binding:"required"`
+	OtherPatientID uint `json:"other_patient_id" binding:"required"`
+}
+
+type MatchReviewDecisionInput struct {
+	Decision string `json:"decision" binding:"required"` // link or reject
+}
@@ -1,6 +1,48 @@
 package models
 
+// Upstream authentication methods for a hospital's HIS API.
+const (
+	HospitalAuthNone   = "none"
+	HospitalAuthAPIKey = "api_key" // X-API-Key: <credential>
+	HospitalAuthBearer = "bearer"  // Authorization: Bearer <credential>
+	HospitalAuthBasic  = "basic"   // credential is "user:password"
+)
+
+// Upstream adapters, see package upstream.
+const (
+	HospitalAdapterStandard = "standard" // the reference /patient/search/{id} API
+	HospitalAdapterMapped   = "mapped"   // URL patterns and field names from AdapterConfig
+)
+
+// Hospital is both the tenant staff and patients belong to and the registry
+// entry for its upstream hospital information system.
 type Hospital struct{
 	ID uint `gorm:"primaryKey"`
 	Name string `gorm:"unique;not null"`
-}
\ No newline at end of file
+	Code string `gorm:"uniqueIndex;not null"`
+	BaseURL string
+	Adapter string `gorm:"not null;default:standard"`
+	AdapterConfig string
+	AuthMethod string `gorm:"not null;default:none"`
+	AuthCredential string `json:"-"`
+	ConnectTimeoutMs int `gorm:"not null;default:3000"`
+	TimeoutMs int `gorm:"not null;default:10000"` // per attempt, until the body is read
+	MaxRetries int `gorm:"not null;default:2"`
+	// Freshness of cached patients: fresh for CacheTTLSeconds (0 = forever),
+	// refreshed in the background once CacheRefreshAheadPercent of it has
+	// passed (0 = off). Stale copies are refreshed before answering unless
+	// CacheStaleWhileRevalidate, which serves them and refreshes afterwards.
+	CacheTTLSeconds int `gorm:"not null;default:86400"`
+	CacheRefreshAheadPercent int `gorm:"not null;default:80"`
+	CacheStaleWhileRevalidate bool `gorm:"not null;default:false"`
+	Enabled bool `gorm:"not null;default:true"`
+	RequireMFA bool `gorm:"not null;default:false"`
+}
+
+func ValidHospitalAuthMethod(method string) bool {
+	switch method {
+	case HospitalAuthNone, HospitalAuthAPIKey, HospitalAuthBearer, HospitalAuthBasic:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// StaffHospitalAccess lets a staff member search the patients of a hospital
+// other than their own, in federated searches. Only system administrators
+// grant it.
+type StaffHospitalAccess struct {
+	ID          uint     `gorm:"primaryKey"`
+	StaffID     uint     `gorm:"uniqueIndex:idx_staff_hospital_access;not null"`
+	HospitalID  uint     `gorm:"uniqueIndex:idx_staff_hospital_access;not null"`
+	Hospital    Hospital `gorm:"foreignKey:HospitalID" json:"-"`
+	GrantedByID *uint
+	CreatedAt   time.Time
+}
+
+type HospitalAccessInput struct {
+	HospitalID uint `json:"hospital_id" binding:"required"`
+}
@@ -0,0 +1,44 @@
+package models
+
+type HospitalInput struct {
+	Name string `json:"name" binding:"required"`
+	Code string `json:"code" binding:"required"`
+
+	BaseURL        string `json:"base_url"`
+	Adapter        string `json:"adapter"`
+	AdapterConfig  string `json:"adapter_config"`
+	AuthMethod     string `json:"auth_method"`
+	AuthCredential string `json:"auth_credential"`
+
+	ConnectTimeoutMs int  `json:"connect_timeout_ms"`
+	TimeoutMs        int  `json:"timeout_ms"`
+	MaxRetries       *int `json:"max_retries"`
+
+	CacheTTLSeconds           *int `json:"cache_ttl_seconds"`
+	CacheRefreshAheadPercent  *int `json:"cache_refresh_ahead_percent"`
+	CacheStaleWhileRevalidate bool `json:"cache_stale_while_revalidate"`
+
+	Enabled *bool `json:"enabled"`
+}
+
+// HospitalUpdateInput holds the fields a PATCH may change; nil means unchanged.
+type HospitalUpdateInput struct {
+	Name *string `json:"name"`
+
+	BaseURL        *string `json:"base_url"`
+	Adapter        *string `json:"adapter"`
+	AdapterConfig  *string `json:"adapter_config"`
+	AuthMethod     *string `json:"auth_method"`
+	AuthCredential *string `json:"auth_credential"`
+
+	ConnectTimeoutMs *int `json:"connect_timeout_ms"`
+	TimeoutMs        *int `json:"timeout_ms"`
+	MaxRetries       *int `json:"max_retries"`
+
+	CacheTTLSeconds           *int  `json:"cache_ttl_seconds"`
+	CacheRefreshAheadPercent  *int  `json:"cache_refresh_ahead_percent"`
+	CacheStaleWhileRevalidate *bool `json:"cache_stale_while_revalidate"`
+
+	Enabled    *bool `json:"enabled"`
+	RequireMFA *bool `json:"require_mfa"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// MFARecoveryCode is a single-use code that replaces a TOTP code when the
+// authenticator is lost. Only the SHA-256 hash is stored.
+type MFARecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	StaffID   uint   `gorm:"index;not null"`
+	CodeHash  string `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type MFACodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFALoginInput struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MFAChallengeInput struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+}
+
+type MFADisableInput struct {
+	Password string `json:"password" binding:"required"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Identifier kinds a negative lookup can be recorded for.
+const (
+	IdentifierNationalID = "national_id"
+	IdentifierPassportID = "passport_id"
+	IdentifierHN         = "hn"
+)
+
+// NegativeLookup remembers that a hospital system had no patient for an
+// identifier, so repeated misses are not sent upstream until ExpiresAt.
+type NegativeLookup struct {
+	ID         uint      `gorm:"primaryKey"`
+	HospitalID uint      `gorm:"uniqueIndex:idx_negative_lookup;not null"`
+	Identifier string    `gorm:"uniqueIndex:idx_negative_lookup;not null"`
+	Value      string    `gorm:"uniqueIndex:idx_negative_lookup;not null"`
+	ExpiresAt  time.Time `gorm:"index;not null"`
+	CreatedAt  time.Time
+}
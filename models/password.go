@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// PasswordHistory keeps previous password hashes of a staff member so a new
+// password cannot repeat a recent one.
+type PasswordHistory struct {
+	ID        uint   `gorm:"primaryKey"`
+	StaffID   uint   `gorm:"index;not null"`
+	Hash      string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// PasswordResetToken is a single-use token an administrator hands to a staff
+// member to set a new password. Only the SHA-256 hash is stored.
+type PasswordResetToken struct {
+	ID          uint   `gorm:"primaryKey"`
+	TokenHash   string `gorm:"uniqueIndex;not null"`
+	StaffID     uint   `gorm:"index;not null"`
+	CreatedByID uint
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	CreatedAt   time.Time
+}
+
+type PasswordChangeInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type PasswordResetInput struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
@@ -1,5 +1,11 @@
 package models
 
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
 type Patient struct {
 	ID            uint      `gorm:"primaryKey"`
 	FirstNameTH   string
@@ -8,12 +14,44 @@ type Patient struct {
 	FirstNameEN   string
 	MiddleNameEN  string
 	LastNameEN    string
-	DateOfBirth   string
+	// The Thai names romanised (see names.Key), to match names across scripts.
+	FirstNameRTGS  string `gorm:"column:first_name_rtgs;index" json:"-"`
+	MiddleNameRTGS string `gorm:"column:middle_name_rtgs" json:"-"`
+	LastNameRTGS   string `gorm:"column:last_name_rtgs;index" json:"-"`
+	// Soundex of the English names (see names.Soundex), for phonetic search.
+	FirstNameSoundex  string `gorm:"index" json:"-"`
+	MiddleNameSoundex string `json:"-"`
+	LastNameSoundex   string `gorm:"index" json:"-"`
+	// MatchScore ranks the results of a name search that is not exact.
+	MatchScore float64 `gorm:"-" json:",omitempty"`
+	DateOfBirth   PartialDate `gorm:"embedded;embeddedPrefix:date_of_birth_"`
 	NationalID    string
 	PassportID    string
+	PassportCountry string // ICAO code of the issuing country, if known
+	// PhoneNumber and Email are kept as given, for display.
 	PhoneNumber   string
 	Email         string
+	// Matching keys: PhoneNumber in E.164 form and Email canonicalised, empty
+	// when the original cannot be read. See validation.PhoneE164.
+	PhoneE164       string `gorm:"column:phone_e164;index" json:"-"`
+	EmailNormalized string `gorm:"index" json:"-"`
 	Gender        string
-	HospitalID    uint
+	// HN is the hospital's own patient number, unique within the hospital.
+	HN            *string `gorm:"uniqueIndex:idx_patient_hospital_hn"`
+	HospitalID    uint    `gorm:"uniqueIndex:idx_patient_hospital_hn"`
 	Hospital      Hospital `gorm:"foreignKey:HospitalID"`
+	// EnterprisePatientID links the records of one person across hospitals,
+	// see package mpi.
+	EnterprisePatientID *uint `gorm:"index"`
+	// Freshness of a copy fetched from the hospital system. FetchedAt is nil
+	// for records that did not come from upstream.
+	FetchedAt     *time.Time
+	SourceETag    string `gorm:"column:source_etag"`
+	SourceVersion string
+	CreatedAt     time.Time
+	// UpdatedAt is when the record last changed, not when a copy was last
+	// found unchanged at its source.
+	UpdatedAt     time.Time `gorm:"index"`
+	// DeletedAt marks a soft deleted record, hidden from every query.
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 }
@@ -9,10 +9,14 @@ type PatientExternal struct {
 	MiddleNameEN  string `json:"middle_name_en"`
 	LastNameEN    string `json:"last_name_en"`
 	DateOfBirth   string `json:"date_of_birth"`
-	PatientHN     string `json:"patient_hn"`
+	PatientHN     string `json:"patient_hn"`    // hospital number
+	HospitalCode  string `json:"hospital_code"` // hospital the record belongs to
 	NationalID    string `json:"national_id"`
 	PassportID    string `json:"passport_id"`
+	PassportCountry string `json:"passport_country"`
 	PhoneNumber   string `json:"phone_number"`
 	Email         string `json:"email"`
 	Gender        string `json:"gender"` // M or F
+	Version       string `json:"version"` // record version at the source, if the system has one
+	ETag          string `json:"-"`       // entity tag of the HTTP response
 }
@@ -0,0 +1,39 @@
+package models
+
+// PatientInput registers a patient held by the middleware itself.
+type PatientInput struct {
+	FirstNameTH  string `json:"first_name_th"`
+	MiddleNameTH string `json:"middle_name_th"`
+	LastNameTH   string `json:"last_name_th"`
+	FirstNameEN  string `json:"first_name_en"`
+	MiddleNameEN string `json:"middle_name_en"`
+	LastNameEN   string `json:"last_name_en"`
+	DateOfBirth  string `json:"date_of_birth"` // see validation.ParseDate
+	NationalID   string `json:"national_id"`
+	PassportID   string `json:"passport_id"`
+	// ICAO code of the issuing country, e.g. THA
+	PassportCountry string `json:"passport_country"`
+	HN              string `json:"hn"`
+	PhoneNumber     string `json:"phone_number"`
+	Email           string `json:"email"`
+	Gender          string `json:"gender"` // M or F
+}
+
+// PatientUpdateInput holds the fields a PATCH may change; nil means unchanged
+// and an empty string clears the field.
+type PatientUpdateInput struct {
+	FirstNameTH     *string `json:"first_name_th"`
+	MiddleNameTH    *string `json:"middle_name_th"`
+	LastNameTH      *string `json:"last_name_th"`
+	FirstNameEN     *string `json:"first_name_en"`
+	MiddleNameEN    *string `json:"middle_name_en"`
+	LastNameEN      *string `json:"last_name_en"`
+	DateOfBirth     *string `json:"date_of_birth"`
+	NationalID      *string `json:"national_id"`
+	PassportID      *string `json:"passport_id"`
+	PassportCountry *string `json:"passport_country"`
+	HN              *string `json:"hn"`
+	PhoneNumber     *string `json:"phone_number"`
+	Email           *string `json:"email"`
+	Gender          *string `json:"gender"`
+}
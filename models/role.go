@@ -0,0 +1,58 @@
+package models
+
+// Role is the job function a staff account acts under. Each role maps to a
+// fixed set of permissions that routes can require.
+type Role string
+
+const (
+	RoleSystemAdmin  Role = "system_admin"
+	RoleAdmin        Role = "admin"
+	RoleDoctor       Role = "doctor"
+	RoleNurse        Role = "nurse"
+	RoleRegistration Role = "registration"
+	RoleAuditor      Role = "auditor"
+)
+
+// DefaultRole is assigned when a staff account is created without a role.
+const DefaultRole = RoleNurse
+
+// Permission is a single capability checked by the RBAC middleware.
+type Permission string
+
+const (
+	PermPatientRead    Permission = "patient:read"
+	PermPatientWrite   Permission = "patient:write"
+	PermStaffManage    Permission = "staff:manage"
+	PermHospitalManage Permission = "hospital:manage"
+	PermAuditRead      Permission = "audit:read"
+	PermMPIManage      Permission = "mpi:manage"
+)
+
+// RoleSystemAdmin manages hospitals and may provision staff in any hospital.
+// RoleAdmin may only provision staff in its own hospital.
+var rolePermissions = map[Role][]Permission{
+	RoleSystemAdmin:  {PermHospitalManage, PermStaffManage},
+	RoleAdmin:        {PermPatientRead, PermStaffManage, PermAuditRead, PermMPIManage},
+	RoleDoctor:       {PermPatientRead},
+	RoleNurse:        {PermPatientRead},
+	RoleRegistration: {PermPatientRead, PermPatientWrite},
+	RoleAuditor:      {PermAuditRead},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
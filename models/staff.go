@@ -1,9 +1,28 @@
 package models
 
+import "time"
+
 type Staff struct {
 	ID         uint   `gorm:"primaryKey"`
 	Username   string `gorm:"unique;not null"`
 	Password   string `gorm:"not null"`
+	Role       Role   `gorm:"not null;default:nurse"`
 	HospitalID uint
 	Hospital   Hospital `gorm:"foreignKey:HospitalID"`
-}
\ No newline at end of file
+
+	// Login throttling state, see controllers.LoginStaff
+	FailedLoginAttempts int `gorm:"not null;default:0"`
+	LastFailedLoginAt   *time.Time
+	LockedUntil         *time.Time
+
+	// TOTP second factor. MFAPendingSecret holds a secret that was issued by
+	// enrollment but not yet confirmed with a code.
+	MFAEnabled       bool   `gorm:"not null;default:false"`
+	MFASecret        string `json:"-"`
+	MFAPendingSecret string `json:"-"`
+	MFALastStep      int64  `json:"-"`
+
+	// Access tokens issued before SessionsRevokedAt are refused, see
+	// controllers.RevokeStaffSessions
+	SessionsRevokedAt *time.Time `json:"-"`
+}
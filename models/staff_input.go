@@ -4,4 +4,21 @@ type StaffInput struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
 	Hospital string `json:"hospital" binding:"required"`
-}
\ No newline at end of file
+}
+
+// StaffCreateInput is used by administrators to provision a staff account.
+// Hospital defaults to the administrator's own hospital when left empty.
+type StaffCreateInput struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Hospital string `json:"hospital"`
+	Role     Role   `json:"role"`
+}
+
+// BootstrapInput creates the first administrator together with its hospital.
+type BootstrapInput struct {
+	Username     string `json:"username" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	Hospital     string `json:"hospital" binding:"required"`
+	HospitalCode string `json:"hospital_code" binding:"required"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RefreshToken is a single-use refresh token. Only the SHA-256 hash of the
+// token is stored. Every token issued by rotating another shares its
+// FamilyID, so presenting an already used token revokes the whole family.
+type RefreshToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	FamilyID  string `gorm:"index;not null"`
+	StaffID   uint   `gorm:"index;not null"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// RevokedToken records the jti of an access token that was revoked before it
+// expired. Rows can be pruned once ExpiresAt has passed.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// IsTokenRevoked reports whether a token was revoked, on its own by its jti
+// or with every session of its staff member after it was issued. It fails
+// closed: if the revocation state cannot be read the token is treated as
+// revoked.
+func IsTokenRevoked(db *gorm.DB, jti string, staffID uint, issuedAt time.Time) bool {
+	var count int64
+	if err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil || count > 0 {
+		return true
+	}
+	var staff Staff
+	if err := db.Select("sessions_revoked_at").Where("id = ?", staffID).Limit(1).Find(&staff).Error; err != nil {
+		return true
+	}
+	return staff.SessionsRevokedAt != nil && issuedAt.Before(*staff.SessionsRevokedAt)
+}
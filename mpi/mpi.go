@@ -0,0 +1,147 @@
+// Package mpi decides whether two patient records, usually of different
+// hospitals, are the same person, for the enterprise master patient index.
+// Shared identifiers decide deterministically; otherwise names, date of birth
+// and phone number are weighed Fellegi–Sunter style.
+package mpi
+
+import (
+	"agnos-hospital-middleware/models"
+	"agnos-hospital-middleware/names"
+	"math"
+)
+
+// Decisions on a pair of records.
+const (
+	Match         = "match"
+	PossibleMatch = "possible_match" // for a person to review
+	NonMatch      = "non_match"
+)
+
+// Deterministic rules.
+const (
+	RuleNationalID = "national_id"
+	RulePassport   = "passport"
+)
+
+// Thresholds on the score of records no rule decided: pairs scoring at least
+// Link are the same person, at least Review possibly.
+type Thresholds struct {
+	Link   float64
+	Review float64
+}
+
+// Result is the comparison of two records.
+type Result struct {
+	Decision string
+	// Rule is the deterministic rule that decided, empty when scored.
+	Rule  string
+	Score float64
+}
+
+// field holds the Fellegi–Sunter probabilities of a field: m that it agrees
+// between two records of the same person, u between records of two people
+// chosen at random.
+type field struct {
+	m, u float64
+}
+
+// agreement and disagreement are the log2 likelihood ratios a field adds to
+// the score when it agrees or disagrees. Fields missing from either record
+// add nothing.
+func (f field) agreement() float64    { return math.Log2(f.m / f.u) }
+func (f field) disagreement() float64 { return math.Log2((1 - f.m) / (1 - f.u)) }
+
+var (
+	firstName   = field{m: 0.95, u: 0.01}
+	lastName    = field{m: 0.95, u: 0.005}
+	dateOfBirth = field{m: 0.97, u: 0.001}
+	phoneNumber = field{m: 0.85, u: 0.0001}
+)
+
+// similarNames is the trigram similarity from which names count as half
+// agreeing, for spelling variants and typos.
+const similarNames = 0.6
+
+// Compare decides whether a and b are the same person.
+func Compare(a, b models.Patient, thresholds Thresholds) Result {
+	if a.NationalID != "" && b.NationalID != "" {
+		//one person has one national ID
+		if a.NationalID == b.NationalID {
+			return Result{Decision: Match, Rule: RuleNationalID}
+		}
+		return Result{Decision: NonMatch, Rule: RuleNationalID}
+	}
+	if a.PassportID != "" && a.PassportID == b.PassportID &&
+		(a.PassportCountry == b.PassportCountry || a.PassportCountry == "" || b.PassportCountry == "") {
+		return Result{Decision: Match, Rule: RulePassport}
+	}
+
+	score := compareNames(firstName, nameKeys(a.FirstNameEN, a.FirstNameRTGS), nameKeys(b.FirstNameEN, b.FirstNameRTGS)) +
+		compareNames(lastName, nameKeys(a.LastNameEN, a.LastNameRTGS), nameKeys(b.LastNameEN, b.LastNameRTGS)) +
+		compareDates(a.DateOfBirth, b.DateOfBirth)
+	if a.PhoneE164 != "" && b.PhoneE164 != "" {
+		if a.PhoneE164 == b.PhoneE164 {
+			score += phoneNumber.agreement()
+		} else {
+			score += phoneNumber.disagreement()
+		}
+	}
+
+	result := Result{Decision: NonMatch, Score: score}
+	switch {
+	case score >= thresholds.Link:
+		result.Decision = Match
+	case score >= thresholds.Review:
+		result.Decision = PossibleMatch
+	}
+	return result
+}
+
+// nameKeys returns a name's English and romanised Thai forms, whichever the
+// record has.
+func nameKeys(english, romanised string) []string {
+	var keys []string
+	for _, key := range []string{names.Key(english), romanised} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// compareNames weighs the most similar pair of forms of a name.
+func compareNames(f field, a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	best := 0.0
+	for _, x := range a {
+		for _, y := range b {
+			best = max(best, names.Similarity(x, y))
+		}
+	}
+	switch {
+	case best == 1:
+		return f.agreement()
+	case best >= similarNames:
+		return f.agreement() / 2
+	}
+	return f.disagreement()
+}
+
+// compareDates weighs two dates of birth: the same day agrees, and a partial
+// date that may be the other half agrees.
+func compareDates(a, b models.PartialDate) float64 {
+	if a.IsZero() || b.IsZero() {
+		return 0
+	}
+	aFirst, aLast := a.Range()
+	bFirst, bLast := b.Range()
+	switch {
+	case aFirst.Equal(bFirst) && aLast.Equal(bLast) && a.Precision == models.DatePrecisionDay:
+		return dateOfBirth.agreement()
+	case !aFirst.After(bLast) && !bFirst.After(aLast):
+		return dateOfBirth.agreement() / 2
+	}
+	return dateOfBirth.disagreement()
+}
@@ -0,0 +1,52 @@
+package mpi
+
+import (
+	"agnos-hospital-middleware/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var thresholds = Thresholds{Link: 22, Review: 12}
+
+func born(year int, month time.Month, day int, precision string) models.PartialDate {
+	return models.NewPartialDate(time.Date(year, month, day, 0, 0, 0, 0, time.UTC), precision)
+}
+
+func TestCompare_Rules(t *testing.T) {
+	a := models.Patient{NationalID: "1101700203450", FirstNameEN: "Somchai"}
+	b := models.Patient{NationalID: "1101700203450", FirstNameEN: "Anan"}
+	assert.Equal(t, Result{Decision: Match, Rule: RuleNationalID}, Compare(a, b, thresholds))
+
+	//different national IDs are different people, however alike otherwise
+	b = a
+	b.NationalID = "3101500123459"
+	assert.Equal(t, Result{Decision: NonMatch, Rule: RuleNationalID}, Compare(a, b, thresholds))
+
+	a = models.Patient{PassportID: "AA1234567", PassportCountry: "GBR"}
+	b = models.Patient{PassportID: "AA1234567"}
+	assert.Equal(t, RulePassport, Compare(a, b, thresholds).Rule)
+	b.PassportCountry = "USA"
+	assert.Equal(t, NonMatch, Compare(a, b, thresholds).Decision)
+}
+
+func TestCompare_Scores(t *testing.T) {
+	a := models.Patient{FirstNameEN: "Somchai", LastNameEN: "Jaidee", DateOfBirth: born(1985, 3, 22, models.DatePrecisionDay)}
+
+	//the same person registered in Thai elsewhere
+	b := models.Patient{FirstNameRTGS: "somchai", LastNameRTGS: "chaidi", DateOfBirth: born(1985, 3, 22, models.DatePrecisionDay)}
+	b.LastNameEN = "Jaidee"
+	assert.Equal(t, Match, Compare(a, b, thresholds).Decision)
+
+	b = models.Patient{FirstNameEN: "Somchay", LastNameEN: "Jaidee", DateOfBirth: born(1985, 1, 1, models.DatePrecisionYear)}
+	result := Compare(a, b, thresholds)
+	assert.Equal(t, PossibleMatch, result.Decision)
+	assert.Less(t, result.Score, Compare(a, a, thresholds).Score)
+
+	b = models.Patient{FirstNameEN: "Anan", LastNameEN: "Jaidee", DateOfBirth: born(1990, 6, 15, models.DatePrecisionDay)}
+	assert.Equal(t, NonMatch, Compare(a, b, thresholds).Decision)
+
+	//fields missing from either record weigh nothing
+	assert.Zero(t, Compare(a, models.Patient{}, thresholds).Score)
+}
@@ -0,0 +1,307 @@
+// Package names detects the script of personal names and romanises Thai ones,
+// so a name can be matched whichever script it is written in.
+package names
+
+import (
+	"strings"
+	"unicode"
+)
+
+// IsThai reports whether a name is written in Thai script.
+func IsThai(name string) bool {
+	return strings.IndexFunc(name, func(r rune) bool { return unicode.Is(unicode.Thai, r) && unicode.IsLetter(r) }) >= 0
+}
+
+// Key returns the form names are compared by across scripts: Thai names
+// romanised with RTGS, then trimmed and lower case.
+func Key(name string) string {
+	if IsThai(name) {
+		name = RTGS(name)
+	}
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+const (
+	maiHanAkat  = 'ั'
+	saraI       = 'ิ'
+	saraIi      = 'ี'
+	saraUe      = 'ึ'
+	saraUee     = 'ื'
+	saraU       = 'ุ'
+	saraUu      = 'ู'
+	maiTaiKhu   = '็'
+	saraA       = 'ะ'
+	saraAa      = 'า'
+	saraAm      = 'ำ'
+	thanThaKhat = '์'
+)
+
+// initials are the consonants' sounds at the start of a syllable. อ only
+// carries the vowel.
+var initials = map[rune]string{
+	'ก': "k", 'ข': "kh", 'ฃ': "kh", 'ค': "kh", 'ฅ': "kh", 'ฆ': "kh", 'ง': "ng",
+	'จ': "ch", 'ฉ': "ch", 'ช': "ch", 'ซ': "s", 'ฌ': "ch", 'ญ': "y",
+	'ฎ': "d", 'ฏ': "t", 'ฐ': "th", 'ฑ': "th", 'ฒ': "th", 'ณ': "n",
+	'ด': "d", 'ต': "t", 'ถ': "th", 'ท': "th", 'ธ': "th", 'น': "n",
+	'บ': "b", 'ป': "p", 'ผ': "ph", 'ฝ': "f", 'พ': "ph", 'ฟ': "f", 'ภ': "ph", 'ม': "m",
+	'ย': "y", 'ร': "r", 'ล': "l", 'ว': "w", 'ศ': "s", 'ษ': "s", 'ส': "s",
+	'ห': "h", 'ฬ': "l", 'อ': "", 'ฮ': "h",
+}
+
+// finals are the consonants' sounds closing a syllable.
+var finals = map[rune]string{
+	'ก': "k", 'ข': "k", 'ค': "k", 'ฆ': "k", 'ง': "ng",
+	'จ': "t", 'ช': "t", 'ซ': "t", 'ฌ': "t", 'ฎ': "t", 'ฏ': "t", 'ฐ': "t", 'ฑ': "t", 'ฒ': "t",
+	'ด': "t", 'ต': "t", 'ถ': "t", 'ท': "t", 'ธ': "t", 'ศ': "t", 'ษ': "t", 'ส': "t",
+	'ญ': "n", 'ณ': "n", 'น': "n", 'ร': "n", 'ล': "n", 'ฬ': "n",
+	'บ': "p", 'ป': "p", 'พ': "p", 'ฟ': "p", 'ภ': "p", 'ผ': "p", 'ฝ': "p",
+	'ม': "m", 'ย': "i", 'ว': "o",
+}
+
+// RTGS romanises Thai text with the Royal Thai General System, e.g. สมชาย
+// becomes somchai. Thai spelling does not mark every syllable boundary or
+// vowel, so this applies the common rules and can differ from the official
+// romanisation of unusual spellings. Other characters are kept.
+func RTGS(text string) string {
+	r := romaniser{}
+	for _, c := range text {
+		//tone marks, nikhahit and repetition marks do not change the romanisation
+		if (c >= '่' && c <= '๋') || c == 'ํ' || c == 'ๆ' || c == 'ฯ' {
+			continue
+		}
+		r.text = append(r.text, c)
+	}
+	for r.pos < len(r.text) {
+		r.next()
+	}
+	return r.out.String()
+}
+
+type romaniser struct {
+	text []rune
+	pos  int
+	out  strings.Builder
+}
+
+func (r *romaniser) at(i int) rune {
+	if i < 0 || i >= len(r.text) {
+		return 0
+	}
+	return r.text[i]
+}
+
+func isConsonant(c rune) bool {
+	_, ok := initials[c]
+	return ok
+}
+
+func isLeadingVowel(c rune) bool {
+	return c >= 'เ' && c <= 'ไ'
+}
+
+// startsVowel reports whether c is a vowel written after its consonant.
+func startsVowel(c rune) bool {
+	switch c {
+	case maiHanAkat, saraI, saraIi, saraUe, saraUee, saraU, saraUu, maiTaiKhu, saraA, saraAa, saraAm:
+		return true
+	}
+	return false
+}
+
+func isThaiLetter(c rune) bool {
+	return isConsonant(c) || isLeadingVowel(c) || startsVowel(c) || c == thanThaKhat || c == 'ฤ' || c == 'ฦ'
+}
+
+// silenced returns how many characters at i form a consonant silenced by
+// thanthakhat, with any vowel it carries, or 0.
+func (r *romaniser) silenced(i int) int {
+	if !isConsonant(r.at(i)) {
+		return 0
+	}
+	switch {
+	case r.at(i+1) == thanThaKhat:
+		return 2
+	case (r.at(i+1) == saraI || r.at(i+1) == saraU) && r.at(i+2) == thanThaKhat:
+		return 3
+	}
+	return 0
+}
+
+func (r *romaniser) next() {
+	c := r.at(r.pos)
+	switch {
+	case c == 'ฤ':
+		r.out.WriteString("rue")
+		r.pos++
+	case c == 'ฦ':
+		r.out.WriteString("lue")
+		r.pos++
+	case r.pos > 0 && r.silenced(r.pos) > 0:
+		r.pos += r.silenced(r.pos)
+	case r.pos > 0 && isConsonant(c) && r.silenced(r.pos+1) == 2:
+		//a consonant starting no syllable before a silenced one is silent too, as in จันทร์
+		r.pos += 3
+	case isLeadingVowel(c):
+		r.pos++
+		r.syllable(c)
+	case isConsonant(c):
+		r.syllable(0)
+	case isThaiLetter(c):
+		//a vowel without its consonant
+		r.pos++
+	default:
+		r.out.WriteRune(c)
+		r.pos++
+	}
+}
+
+// syllable romanises the syllable whose initial consonant is at pos, lead
+// being the vowel written before it, if any.
+func (r *romaniser) syllable(lead rune) {
+	initial := r.at(r.pos)
+	if !isConsonant(initial) {
+		return
+	}
+	r.pos++
+	onset := initials[initial]
+
+	switch second := r.at(r.pos); {
+	case (initial == 'ห' && strings.ContainsRune("งญนมยรลว", second) || initial == 'อ' && second == 'ย') && r.at(r.pos+1) != thanThaKhat:
+		//ห and อ only give the next consonant its tone
+		onset = initials[second]
+		r.pos++
+	case strings.ContainsRune("รลว", second) && (startsVowel(r.at(r.pos+1)) || lead != 0 && isConsonant(r.at(r.pos+1))):
+		switch {
+		case second == 'ร' && strings.ContainsRune("ทสศซ", initial):
+			onset = "s"
+			r.pos++
+		case strings.ContainsRune("กขคตปพผ", initial) && (second != 'ว' || strings.ContainsRune("กขค", initial)):
+			onset += initials[second]
+			r.pos++
+		}
+	}
+
+	//เ and แ may belong to the next consonant, as in เจริญ
+	if second := r.at(r.pos); (lead == 'เ' || lead == 'แ') && isConsonant(second) {
+		third := r.at(r.pos + 1)
+		if startsVowel(third) && third != saraAa && third != saraA || isConsonant(third) && third != 'ร' && !isThaiLetter(r.at(r.pos+2)) {
+			r.out.WriteString(onset + "a")
+			r.syllable(lead)
+			return
+		}
+	}
+
+	vowel := r.vowel(lead)
+	final := ""
+	//a consonant before a vowel or ร ร starts the next syllable
+	if c := r.at(r.pos); isConsonant(c) && !startsVowel(r.at(r.pos+1)) && !(r.at(r.pos+1) == 'ร' && r.at(r.pos+2) == 'ร') && r.silenced(r.pos) == 0 {
+		switch {
+		case vowel == "ai" || vowel == "am" || vowel == "ao":
+			//these vowels close the syllable themselves; ไทย keeps a silent ย
+			if c == 'ย' && !isThaiLetter(r.at(r.pos+1)) {
+				r.pos++
+			}
+		case vowel == "" && isConsonant(r.at(r.pos+1)) && !isThaiLetter(r.at(r.pos+2)):
+			//two consonants end the word: this syllable is open, as in กมล
+		default:
+			final = finals[c]
+			r.pos++
+			//ร after a final is silent, as in เพชร
+			if r.at(r.pos) == 'ร' && !isThaiLetter(r.at(r.pos+1)) {
+				r.pos++
+			}
+		}
+	}
+	switch {
+	case vowel == "" && final != "":
+		vowel = "o"
+	case vowel == "":
+		vowel = "a"
+	case vowel == "rr" && final == "":
+		vowel, final = "a", "n"
+	case vowel == "rr":
+		vowel = "a"
+	}
+	if final == "i" && strings.HasSuffix(vowel, "i") {
+		final = ""
+	}
+	r.out.WriteString(onset + vowel + final)
+}
+
+// vowel reads the vowel after the initial consonant. rr is the ร ร pair,
+// which is romanised by what follows it.
+func (r *romaniser) vowel(lead rune) string {
+	c, next := r.at(r.pos), r.at(r.pos+1)
+	take := func(n int, vowel string) string {
+		r.pos += n
+		return vowel
+	}
+	switch lead {
+	case 'เ':
+		switch {
+		case c == saraIi && next == 'ย':
+			return take(2, "ia")
+		case c == saraUee && next == 'อ':
+			return take(2, "uea")
+		case c == saraI:
+			return take(1, "oe")
+		case c == maiTaiKhu:
+			return take(1, "e")
+		case c == saraAa && next == saraA:
+			return take(2, "o")
+		case c == saraAa:
+			return take(1, "ao")
+		case c == 'อ' && next == saraA:
+			return take(2, "oe")
+		case c == 'อ':
+			return take(1, "oe")
+		case c == saraA:
+			return take(1, "e")
+		}
+		return "e"
+	case 'แ':
+		if c == maiTaiKhu || c == saraA {
+			r.pos++
+		}
+		return "ae"
+	case 'โ':
+		if c == saraA {
+			r.pos++
+		}
+		return "o"
+	case 'ใ', 'ไ':
+		return "ai"
+	}
+
+	switch {
+	case c == maiHanAkat && next == 'ว':
+		return take(2, "ua")
+	case c == maiHanAkat:
+		return take(1, "a")
+	case c == saraI || c == saraIi:
+		return take(1, "i")
+	case c == saraUe:
+		return take(1, "ue")
+	case c == saraUee && next == 'อ':
+		return take(2, "ue")
+	case c == saraUee:
+		return take(1, "ue")
+	case c == saraU || c == saraUu:
+		return take(1, "u")
+	case c == saraAa || c == saraA:
+		return take(1, "a")
+	case c == saraAm:
+		return take(1, "am")
+	case c == maiTaiKhu && next == 'อ':
+		return take(2, "o")
+	case c == maiTaiKhu:
+		return take(1, "o")
+	case c == 'อ' && !startsVowel(next):
+		return take(1, "o")
+	case c == 'ร' && next == 'ร':
+		return take(2, "rr")
+	case c == 'ว' && isConsonant(next) && !startsVowel(r.at(r.pos+2)):
+		return take(1, "ua")
+	}
+	return ""
+}
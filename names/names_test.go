@@ -0,0 +1,67 @@
+package names
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTGS(t *testing.T) {
+	for thai, want := range map[string]string{
+		"สมชาย":     "somchai",
+		"ใจดี":      "chaidi",
+		"สมศักดิ์":  "somsak",
+		"ประเสริฐ":  "prasoet",
+		"วิชัย":     "wichai",
+		"กมล":       "kamon",
+		"นภา":       "napha",
+		"เจริญ":     "charoen",
+		"เพชร":      "phet",
+		"จันทร์":    "chan",
+		"สมหญิง":    "somying",
+		"ประยุทธ์":  "prayut",
+		"สุวรรณ":    "suwan",
+		"เชียงใหม่": "chiangmai",
+		"เมือง":     "mueang",
+		"แก้ว":      "kaeo",
+		"กลัว":      "klua",
+		"ทราย":      "sai",
+		"ณัฐพล":     "natphon",
+		"พิมพ์ชนก":  "phimchanok",
+		"ทองดี ":    "thongdi ",
+	} {
+		assert.Equal(t, want, RTGS(thai), thai)
+	}
+}
+
+func TestKey(t *testing.T) {
+	assert.True(t, IsThai("สมชาย"))
+	assert.False(t, IsThai("Somchai"))
+	assert.Equal(t, "somchai", Key(" สมชาย"))
+	assert.Equal(t, "somchai", Key("SOMCHAI "))
+	assert.Equal(t, "", Key(""))
+}
+
+func TestSoundex(t *testing.T) {
+	for name, want := range map[string]string{
+		"Robert":   "R163",
+		"Rupert":   "R163",
+		"Ashcraft": "A261",
+		"Tymczak":  "T522",
+		"Pfister":  "P236",
+		"Somchai":  "S520",
+		"Somchay":  "S520",
+		"Lee":      "L000",
+		"สมชาย":    "",
+	} {
+		assert.Equal(t, want, Soundex(name), name)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, Similarity("Somchai", " somchai"))
+	assert.Equal(t, 0.0, Similarity("Somchai", ""))
+	assert.InDelta(t, 5.0/11, Similarity("somchai", "somchia"), 1e-9)
+	assert.Less(t, Similarity("somchai", "wichai"), 0.3)
+	assert.Equal(t, 1.0, Similarity("ใจดี", "ใจดี"))
+}
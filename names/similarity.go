@@ -0,0 +1,83 @@
+package names
+
+import (
+	"strings"
+	"unicode"
+)
+
+// soundexCodes are the American Soundex digits of the consonants that have one.
+var soundexCodes = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3',
+	'l': '4',
+	'm': '5', 'n': '5',
+	'r': '6',
+}
+
+// Soundex returns the American Soundex code of an English name, e.g. R163 for
+// both Robert and Rupert. Characters other than the letters a-z are ignored,
+// so names of several words are coded as one. It is empty when the name has
+// no such letter.
+func Soundex(name string) string {
+	var code []byte
+	var last byte
+	for _, r := range strings.ToLower(name) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		digit := soundexCodes[r]
+		switch {
+		case len(code) == 0:
+			code = append(code, byte(unicode.ToUpper(r)))
+		case digit != 0 && digit != last:
+			code = append(code, digit)
+		}
+		//h and w do not separate letters with the same code, vowels do
+		if r != 'h' && r != 'w' {
+			last = digit
+		}
+		if len(code) == 4 {
+			break
+		}
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// Similarity is the trigram similarity of two names as Postgres pg_trgm
+// computes it: the shared trigrams of their lower case words, each padded
+// with two spaces before and one after, over all their trigrams. It ranges
+// from 0 for nothing in common to 1 for the same words.
+func Similarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	shared := 0
+	for trigram := range ta {
+		if tb[trigram] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+func trigrams(s string) map[string]bool {
+	set := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+	return set
+}
@@ -3,18 +3,80 @@ package routes
 import (
 	"agnos-hospital-middleware/controllers"
 	middleware "agnos-hospital-middleware/middlewares"
+	"agnos-hospital-middleware/models"
 
 	"github.com/gin-gonic/gin"
 )
 
 func SetupRoutes(r *gin.Engine) {
-	r.POST("/staff/create", controllers.CreateStaff)
+	r.GET("/.well-known/jwks.json", controllers.JWKS)
+	r.GET("/metrics", controllers.Metrics)
+
+	r.POST("/staff/bootstrap", controllers.BootstrapAdmin)
 	r.POST("/staff/login", controllers.LoginStaff)
+	r.POST("/staff/login/mfa", controllers.LoginMFA)
+	r.POST("/staff/login/mfa/enroll", controllers.LoginMFAEnroll)
+	r.POST("/staff/refresh", controllers.RefreshToken)
+	r.POST("/staff/password/reset", controllers.ResetPassword)
+
+	staff := r.Group("/staff")
+	staff.Use(middleware.AuthMiddleware())
+	{
+		staff.POST("/logout", controllers.Logout)
+		staff.POST("/password", controllers.ChangePassword)
+		staff.POST("/mfa/enroll", controllers.EnrollMFA)
+		staff.POST("/mfa/activate", controllers.ActivateMFA)
+		staff.POST("/mfa/disable", controllers.DisableMFA)
+		staff.POST("/mfa/recovery-codes", controllers.RegenerateRecoveryCodes)
+		staff.POST("/create", middleware.RequirePermissions(models.PermStaffManage), controllers.CreateStaff)
+		staff.POST("/:id/revoke-sessions", middleware.RequirePermissions(models.PermStaffManage), controllers.RevokeStaffSessions)
+		staff.POST("/:id/unlock", middleware.RequirePermissions(models.PermStaffManage), controllers.UnlockStaff)
+		staff.POST("/:id/password-reset", middleware.RequirePermissions(models.PermStaffManage), controllers.IssuePasswordReset)
+	}
+
+	audit := r.Group("/audit")
+	audit.Use(middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermAuditRead))
+	{
+		audit.GET("/events", controllers.ListAuditEvents)
+	}
+
+	admin := r.Group("/admin")
+	admin.Use(middleware.AuthMiddleware(), middleware.RequirePermissions(models.PermHospitalManage))
+	{
+		admin.POST("/hospitals", controllers.CreateHospital)
+		admin.GET("/hospitals", controllers.ListHospitals)
+		admin.GET("/hospitals/:id", controllers.GetHospital)
+		admin.PATCH("/hospitals/:id", controllers.UpdateHospital)
+		admin.DELETE("/hospitals/:id", controllers.DeleteHospital)
+		admin.GET("/upstreams/status", controllers.UpstreamStatus)
+		admin.GET("/staff/:id/hospital-access", controllers.ListHospitalAccess)
+		admin.POST("/staff/:id/hospital-access", controllers.GrantHospitalAccess)
+		admin.DELETE("/staff/:id/hospital-access/:hospital_id", controllers.RevokeHospitalAccess)
+	}
 
 	protected := r.Group("/patient")
 	protected.Use(middleware.AuthMiddleware())
 	{
-		protected.POST("/search", controllers.SearchPatient)
+		protected.POST("/search", middleware.RequirePermissions(models.PermPatientRead), controllers.SearchPatient)
+	}
+
+	mpi := r.Group("/mpi")
+	mpi.Use(middleware.AuthMiddleware())
+	{
+		mpi.GET("/enterprise-patients/:id", middleware.RequirePermissions(models.PermPatientRead), controllers.GetEnterprisePatient)
+		mpi.POST("/links", middleware.RequirePermissions(models.PermMPIManage), controllers.LinkPatients)
+		mpi.DELETE("/links/:id", middleware.RequirePermissions(models.PermMPIManage), controllers.UnlinkPatient)
+		mpi.GET("/reviews", middleware.RequirePermissions(models.PermMPIManage), controllers.ListMatchReviews)
+		mpi.POST("/reviews/:id/resolve", middleware.RequirePermissions(models.PermMPIManage), controllers.ResolveMatchReview)
+	}
+
+	patients := r.Group("/patients")
+	patients.Use(middleware.AuthMiddleware())
+	{
+		patients.POST("", middleware.RequirePermissions(models.PermPatientWrite), controllers.CreatePatient)
+		patients.GET("/:id", middleware.RequirePermissions(models.PermPatientRead), controllers.GetPatient)
+		patients.PATCH("/:id", middleware.RequirePermissions(models.PermPatientWrite), controllers.UpdatePatient)
+		patients.DELETE("/:id", middleware.RequirePermissions(models.PermPatientWrite), controllers.DeletePatient)
 	}
 
 }
@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/config"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the hospital system while its
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// Circuit breaker states.
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// Breaker stops calling a hospital system after BreakerFailureThreshold
+// consecutive failed lookups. After BreakerOpenDuration it lets
+// BreakerHalfOpenRequests trial lookups through: a success closes the
+// circuit again, a failure reopens it.
+type Breaker struct {
+	mu          sync.Mutex
+	state       string
+	failures    int
+	probes      int
+	openedAt    time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+// BreakerStatus is a snapshot of a breaker for the admin API.
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[uint]*Breaker{}
+)
+
+// BreakerFor returns the breaker of a hospital, creating a closed one on first use.
+func BreakerFor(hospitalID uint) *Breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breaker, ok := breakers[hospitalID]
+	if !ok {
+		breaker = &Breaker{state: StateClosed}
+		breakers[hospitalID] = breaker
+	}
+	return breaker
+}
+
+// ResetBreakers forgets all breaker state.
+func ResetBreakers() {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breakers = map[uint]*Breaker{}
+}
+
+// Allow reports whether a lookup may be sent now. Every allowed lookup must be
+// followed by exactly one call to Record or Release.
+func (b *Breaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen {
+		if now.Sub(b.openedAt) < config.UpstreamBreakerOpenDuration {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probes = 0
+	}
+	if b.state == StateHalfOpen {
+		if b.probes >= config.UpstreamBreakerHalfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Record counts the outcome of an allowed lookup.
+func (b *Breaker) Record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen {
+		b.probes--
+	}
+	if err == nil {
+		if b.state == StateHalfOpen {
+			b.state = StateClosed
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastFailure = now
+	b.lastError = err.Error()
+	if b.state == StateHalfOpen || (b.state == StateClosed && b.failures >= config.UpstreamBreakerFailureThreshold) {
+		b.state = StateOpen
+		b.openedAt = now
+	}
+}
+
+// Release gives back an allowed lookup whose outcome says nothing about the
+// hospital system, e.g. one cancelled by the caller.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen {
+		b.probes--
+	}
+}
+
+// Status returns a snapshot of the breaker.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastError}
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		retryAt := b.openedAt.Add(config.UpstreamBreakerOpenDuration)
+		status.OpenedAt, status.RetryAt = &openedAt, &retryAt
+	}
+	if !b.lastFailure.IsZero() {
+		lastFailure := b.lastFailure
+		status.LastFailureAt = &lastFailure
+	}
+	return status
+}
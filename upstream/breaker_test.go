@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func breakerSettings(t *testing.T, threshold int, openFor time.Duration) {
+	oldThreshold, oldOpen, oldProbes := config.UpstreamBreakerFailureThreshold, config.UpstreamBreakerOpenDuration, config.UpstreamBreakerHalfOpenRequests
+	config.UpstreamBreakerFailureThreshold = threshold
+	config.UpstreamBreakerOpenDuration = openFor
+	config.UpstreamBreakerHalfOpenRequests = 1
+	ResetBreakers()
+	t.Cleanup(func() {
+		config.UpstreamBreakerFailureThreshold, config.UpstreamBreakerOpenDuration, config.UpstreamBreakerHalfOpenRequests = oldThreshold, oldOpen, oldProbes
+		ResetBreakers()
+	})
+}
+
+func TestBreaker_StateMachine(t *testing.T) {
+	breakerSettings(t, 2, time.Minute)
+	breaker := &Breaker{state: StateClosed}
+	now := time.Now()
+	failure := errors.New("connection refused")
+
+	require.True(t, breaker.Allow(now))
+	breaker.Record(failure, now)
+	assert.Equal(t, StateClosed, breaker.Status().State)
+	require.True(t, breaker.Allow(now))
+	breaker.Record(failure, now)
+	assert.Equal(t, StateOpen, breaker.Status().State)
+	assert.Equal(t, "connection refused", breaker.Status().LastError)
+
+	//open: refuse until the open duration has passed
+	assert.False(t, breaker.Allow(now.Add(30*time.Second)))
+
+	//half open: one trial at a time
+	later := now.Add(time.Minute)
+	require.True(t, breaker.Allow(later))
+	assert.Equal(t, StateHalfOpen, breaker.Status().State)
+	assert.False(t, breaker.Allow(later))
+
+	//a failed trial reopens
+	breaker.Record(failure, later)
+	assert.Equal(t, StateOpen, breaker.Status().State)
+	assert.False(t, breaker.Allow(later.Add(time.Second)))
+
+	//a successful trial closes
+	muchLater := later.Add(time.Minute)
+	require.True(t, breaker.Allow(muchLater))
+	breaker.Record(nil, muchLater)
+	status := breaker.Status()
+	assert.Equal(t, StateClosed, status.State)
+	assert.Zero(t, status.ConsecutiveFailures)
+}
+
+func TestBreaker_ReleaseFreesTrial(t *testing.T) {
+	breakerSettings(t, 1, time.Minute)
+	breaker := &Breaker{state: StateClosed}
+	now := time.Now()
+	breaker.Allow(now)
+	breaker.Record(errors.New("down"), now)
+
+	later := now.Add(time.Minute)
+	require.True(t, breaker.Allow(later))
+	breaker.Release()
+	assert.True(t, breaker.Allow(later))
+}
+
+func TestGet_OpenCircuitSkipsHospital(t *testing.T) {
+	breakerSettings(t, 2, time.Minute)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	source, _ := ForHospital(models.Hospital{ID: 42, Code: "DOWN", BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000})
+	for i := 0; i < 2; i++ {
+		_, err := source.SearchByNationalID(context.Background(), "1234")
+		var statusErr *StatusError
+		require.True(t, errors.As(err, &statusErr))
+	}
+	_, err := source.SearchByNationalID(context.Background(), "1234")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(2), calls.Load())
+
+	var metrics strings.Builder
+	WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `upstream_requests_total{hospital="DOWN",outcome="rejected"} 1`)
+	assert.Contains(t, metrics.String(), `upstream_circuit_state{hospital="DOWN"} 1`)
+}
+
+func TestGet_ClientErrorsDoNotOpenCircuit(t *testing.T) {
+	breakerSettings(t, 1, time.Minute)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	source, _ := ForHospital(models.Hospital{ID: 43, Code: "AUTH", BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000})
+	source.SearchByNationalID(context.Background(), "1234")
+	assert.Equal(t, StateClosed, BreakerFor(43).Status().State)
+}
@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/config"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport, when set, replaces the per-hospital transports. Tests use it to
+// stub the hospital systems.
+var Transport http.RoundTripper
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[time.Duration]*http.Transport{}
+)
+
+// transportFor returns a shared transport whose dials and TLS handshakes give
+// up after connectTimeout. Connection pools are kept per host, so hospitals
+// with the same timeout can share one transport.
+func transportFor(connectTimeout time.Duration) http.RoundTripper {
+	if Transport != nil {
+		return Transport
+	}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if transport, ok := transports[connectTimeout]; ok {
+		return transport
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout: connectTimeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	transports[connectTimeout] = transport
+	return transport
+}
+
+// retryable reports whether a failed attempt may succeed when repeated.
+// Lookups are GETs, so connection errors and timeouts of a single attempt are
+// safe to retry; cancellation of the caller's context is not.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrNotModified) && !errors.Is(err, ErrResponseTooLarge)
+}
+
+// isSystemFailure reports whether err means the hospital system is down or
+// overloaded, as opposed to refusing this particular request.
+func isSystemFailure(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return !errors.Is(err, ErrNotFound)
+}
+
+// backoff returns the wait before retry number attempt (0 based): full jitter
+// over an exponentially growing window, or the server's Retry-After.
+func backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	window := config.UpstreamRetryBaseDelay << attempt
+	if window <= 0 || window > config.UpstreamRetryMaxDelay {
+		window = config.UpstreamRetryMaxDelay
+	}
+	if window <= 0 {
+		return 0
+	}
+	return rand.N(window + 1)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
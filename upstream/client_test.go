@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fastRetries(t *testing.T) {
+	base, max := config.UpstreamRetryBaseDelay, config.UpstreamRetryMaxDelay
+	config.UpstreamRetryBaseDelay = time.Millisecond
+	config.UpstreamRetryMaxDelay = 50 * time.Millisecond
+	ResetBreakers()
+	t.Cleanup(func() {
+		config.UpstreamRetryBaseDelay, config.UpstreamRetryMaxDelay = base, max
+		ResetBreakers()
+	})
+}
+
+func TestGet_RetriesTransientFailures(t *testing.T) {
+	fastRetries(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"national_id":"1234"}`))
+	}))
+	defer server.Close()
+
+	source, err := ForHospital(models.Hospital{BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000, MaxRetries: 2})
+	require.NoError(t, err)
+	patients, err := source.SearchByNationalID(context.Background(), "1234")
+	require.NoError(t, err)
+	assert.Len(t, patients, 1)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestGet_GivesUpAfterMaxRetries(t *testing.T) {
+	fastRetries(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	source, _ := ForHospital(models.Hospital{BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000, MaxRetries: 1})
+	_, err := source.SearchByNationalID(context.Background(), "1234")
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestGet_DoesNotRetryClientErrors(t *testing.T) {
+	fastRetries(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	source, _ := ForHospital(models.Hospital{BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000, MaxRetries: 3})
+	_, err := source.SearchByNationalID(context.Background(), "1234")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestGet_RefusesOversizedResponses(t *testing.T) {
+	fastRetries(t)
+	limit := config.UpstreamMaxResponseBytes
+	config.UpstreamMaxResponseBytes = 64
+	defer func() { config.UpstreamMaxResponseBytes = limit }()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"first_name_en":"` + strings.Repeat("a", 64) + `"}`))
+	}))
+	defer server.Close()
+
+	source, _ := ForHospital(models.Hospital{BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000, MaxRetries: 3})
+	_, err := source.SearchByNationalID(context.Background(), "1234")
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestGet_RetryAfterLongerThanMaxDelay(t *testing.T) {
+	fastRetries(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	source, _ := ForHospital(models.Hospital{BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 1000, MaxRetries: 3})
+	_, err := source.SearchByNationalID(context.Background(), "1234")
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, 2*time.Minute, statusErr.RetryAfter)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestGet_StopsWhenContextEnds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	source, _ := ForHospital(models.Hospital{BaseURL: server.URL, ConnectTimeoutMs: 1000, TimeoutMs: 10000, MaxRetries: 3})
+	started := time.Now()
+	_, err := source.SearchByNationalID(ctx, "1234")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(started), 2*time.Second)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+}
+
+func TestBackoff_StaysWithinWindow(t *testing.T) {
+	fastRetries(t)
+	for attempt := 0; attempt < 10; attempt++ {
+		wait := backoff(attempt, 0)
+		assert.GreaterOrEqual(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, config.UpstreamRetryMaxDelay)
+	}
+	assert.Equal(t, time.Second, backoff(0, time.Second))
+}
@@ -0,0 +1,153 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpSource holds what every HTTP based adapter needs: the hospital's base
+// URL, credentials, timeouts and retry budget.
+type httpSource struct {
+	hospital models.Hospital
+	client   *http.Client
+}
+
+func newHTTPSource(hospital models.Hospital) httpSource {
+	return httpSource{
+		hospital: hospital,
+		client: &http.Client{
+			Transport: transportFor(time.Duration(hospital.ConnectTimeoutMs) * time.Millisecond),
+			Timeout:   time.Duration(hospital.TimeoutMs) * time.Millisecond,
+		},
+	}
+}
+
+// response is a successful answer from a hospital system.
+type response struct {
+	body []byte
+	etag string
+}
+
+// get fetches base_url + path and returns the body of a 200 response. It is
+// refused with ErrCircuitOpen while the hospital's breaker is open. With an
+// entity tag in ctx (see WithIfNoneMatch) an unchanged record gives
+// ErrNotModified.
+func (s httpSource) get(ctx context.Context, path string) (response, error) {
+	breaker := BreakerFor(s.hospital.ID)
+	started := time.Now()
+	if !breaker.Allow(started) {
+		recordLookup(s.hospital.ID, s.hospital.Code, OutcomeRejected, 0)
+		return response{}, ErrCircuitOpen
+	}
+
+	resp, err := s.getWithRetries(ctx, path)
+	elapsed := time.Since(started)
+	switch {
+	case err == nil || errors.Is(err, ErrNotModified):
+		breaker.Record(nil, time.Now())
+		recordLookup(s.hospital.ID, s.hospital.Code, OutcomeSuccess, elapsed)
+	case errors.Is(err, ErrNotFound):
+		breaker.Record(nil, time.Now())
+		recordLookup(s.hospital.ID, s.hospital.Code, OutcomeNotFound, elapsed)
+	case errors.Is(err, context.Canceled) || !isSystemFailure(err):
+		//the caller went away or the request itself was refused, the system is up
+		breaker.Release()
+		recordLookup(s.hospital.ID, s.hospital.Code, OutcomeFailure, elapsed)
+	default:
+		breaker.Record(err, time.Now())
+		recordLookup(s.hospital.ID, s.hospital.Code, OutcomeFailure, elapsed)
+	}
+	return resp, err
+}
+
+// getWithRetries retries transient failures with backoff until the
+// hospital's MaxRetries is used up or ctx is done.
+func (s httpSource) getWithRetries(ctx context.Context, path string) (response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.getOnce(ctx, path)
+		if err == nil || attempt >= s.hospital.MaxRetries || !retryable(ctx, err) {
+			return resp, err
+		}
+
+		var retryAfter time.Duration
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			retryAfter = statusErr.RetryAfter
+		}
+		if retryAfter > config.UpstreamRetryMaxDelay {
+			//the hospital asks for a longer pause than we are willing to hold the request
+			return response{}, err
+		}
+
+		timer := time.NewTimer(backoff(attempt, retryAfter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return response{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s httpSource) getOnce(ctx context.Context, path string) (response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.hospital.BaseURL, "/")+path, nil)
+	if err != nil {
+		return response{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag := ifNoneMatch(ctx); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	applyAuth(req, s.hospital)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return response{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return response{etag: resp.Header.Get("ETag")}, ErrNotModified
+	case http.StatusNotFound:
+		return response{}, ErrNotFound
+	default:
+		return response{}, &StatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, config.UpstreamMaxResponseBytes+1))
+	if err != nil {
+		return response{}, err
+	}
+	if int64(len(body)) > config.UpstreamMaxResponseBytes {
+		return response{}, ErrResponseTooLarge
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		//some systems answer a miss with an empty 200
+		return response{}, ErrNotFound
+	}
+	return response{body: body, etag: resp.Header.Get("ETag")}, nil
+}
+
+// applyAuth adds the hospital's configured credentials to a request.
+func applyAuth(req *http.Request, hospital models.Hospital) {
+	switch hospital.AuthMethod {
+	case models.HospitalAuthAPIKey:
+		req.Header.Set("X-API-Key", hospital.AuthCredential)
+	case models.HospitalAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+hospital.AuthCredential)
+	case models.HospitalAuthBasic:
+		user, password, _ := strings.Cut(hospital.AuthCredential, ":")
+		req.SetBasicAuth(user, password)
+	}
+}
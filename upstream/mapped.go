@@ -0,0 +1,213 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	Register(models.HospitalAdapterMapped, newMappedSource)
+}
+
+// MappedConfig describes a hospital API whose URLs and JSON field names differ
+// from the reference API. It is stored as JSON in Hospital.AdapterConfig.
+//
+// Paths are appended to the base URL. {national_id}, {passport_id} and {hn}
+// are replaced with the value, escaped as a path segment or, after the "?", as
+// a query value. A lookup whose path is empty is reported as unsupported.
+type MappedConfig struct {
+	NationalIDPath   string `json:"national_id_path"`
+	PassportPath     string `json:"passport_path"`
+	DemographicsPath string `json:"demographics_path"`
+	HNPath           string `json:"hn_path"`
+
+	// DemographicParams maps first_name, middle_name, last_name,
+	// date_of_birth, phone_number and email to the hospital's query
+	// parameter names. Unmapped criteria use their own name.
+	DemographicParams map[string]string `json:"demographic_params"`
+
+	// Results is the dotted path to the patient list or object in the
+	// response, e.g. "data.patients". Empty means the body itself.
+	Results string `json:"results"`
+
+	// Fields maps models.PatientExternal JSON names to dotted paths within
+	// each record, e.g. {"first_name_en": "name.given"}. Unmapped fields are
+	// read from their own name.
+	Fields map[string]string `json:"fields"`
+}
+
+type mappedSource struct {
+	httpSource
+	config MappedConfig
+}
+
+func newMappedSource(hospital models.Hospital) (PatientSource, error) {
+	var config MappedConfig
+	if strings.TrimSpace(hospital.AdapterConfig) == "" {
+		return nil, errors.New("adapter_config is required for the mapped adapter")
+	}
+	if err := json.Unmarshal([]byte(hospital.AdapterConfig), &config); err != nil {
+		return nil, fmt.Errorf("invalid adapter_config: %w", err)
+	}
+	for _, path := range []string{config.NationalIDPath, config.PassportPath, config.DemographicsPath, config.HNPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("adapter_config path %q must start with /", path)
+		}
+	}
+	return mappedSource{httpSource: newHTTPSource(hospital), config: config}, nil
+}
+
+func (s mappedSource) SearchByNationalID(ctx context.Context, nationalID string) ([]models.PatientExternal, error) {
+	return s.search(ctx, s.config.NationalIDPath, "{national_id}", nationalID)
+}
+
+func (s mappedSource) SearchByPassport(ctx context.Context, passportID string) ([]models.PatientExternal, error) {
+	return s.search(ctx, s.config.PassportPath, "{passport_id}", passportID)
+}
+
+func (s mappedSource) SearchByDemographics(ctx context.Context, query DemographicQuery) ([]models.PatientExternal, error) {
+	if s.config.DemographicsPath == "" {
+		return nil, ErrUnsupported
+	}
+	params := url.Values{}
+	for name, value := range map[string]string{
+		"first_name":    query.FirstName,
+		"middle_name":   query.MiddleName,
+		"last_name":     query.LastName,
+		"date_of_birth": query.DateOfBirth,
+		"phone_number":  query.PhoneNumber,
+		"email":         query.Email,
+	} {
+		if value == "" {
+			continue
+		}
+		if mapped, ok := s.config.DemographicParams[name]; ok {
+			name = mapped
+		}
+		params.Set(name, value)
+	}
+	path := s.config.DemographicsPath
+	if len(params) > 0 {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		path += separator + params.Encode()
+	}
+	return s.fetch(ctx, path)
+}
+
+func (s mappedSource) GetByHN(ctx context.Context, hn string) (models.PatientExternal, error) {
+	patients, err := s.search(ctx, s.config.HNPath, "{hn}", hn)
+	if err != nil {
+		return models.PatientExternal{}, err
+	}
+	if len(patients) == 0 {
+		return models.PatientExternal{}, ErrNotFound
+	}
+	return patients[0], nil
+}
+
+func (s mappedSource) search(ctx context.Context, path, placeholder, value string) ([]models.PatientExternal, error) {
+	if path == "" {
+		return nil, ErrUnsupported
+	}
+	//escaped as a path segment before the query, as a query value after it
+	route, query, hasQuery := strings.Cut(path, "?")
+	path = strings.ReplaceAll(route, placeholder, url.PathEscape(value))
+	if hasQuery {
+		path += "?" + strings.ReplaceAll(query, placeholder, url.QueryEscape(value))
+	}
+	return s.fetch(ctx, path)
+}
+
+func (s mappedSource) fetch(ctx context.Context, path string) ([]models.PatientExternal, error) {
+	resp, err := s.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var document any
+	if err := json.Unmarshal(resp.body, &document); err != nil {
+		return nil, err
+	}
+
+	var records []any
+	switch results := lookup(document, s.config.Results).(type) {
+	case []any:
+		records = results
+	case map[string]any:
+		records = []any{results}
+	case nil:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("results at %q is not a patient list", s.config.Results)
+	}
+
+	patients := make([]models.PatientExternal, 0, len(records))
+	for _, record := range records {
+		patient, err := s.mapRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		patients = append(patients, patient)
+	}
+	if len(patients) == 1 {
+		//the entity tag describes the whole response, so it only identifies a single record
+		patients[0].ETag = resp.etag
+	}
+	return patients, nil
+}
+
+// patientFields are the models.PatientExternal JSON names.
+var patientFields = []string{
+	"first_name_th", "middle_name_th", "last_name_th",
+	"first_name_en", "middle_name_en", "last_name_en",
+	"date_of_birth", "patient_hn", "hospital_code", "national_id", "passport_id",
+	"passport_country", "phone_number", "email", "gender", "version",
+}
+
+// mapRecord reads each patient field from its configured path and decodes the
+// result into models.PatientExternal.
+func (s mappedSource) mapRecord(record any) (models.PatientExternal, error) {
+	values := map[string]string{}
+	for _, field := range patientFields {
+		path := field
+		if mapped, ok := s.config.Fields[field]; ok {
+			path = mapped
+		}
+		switch value := lookup(record, path).(type) {
+		case nil:
+		case string:
+			values[field] = value
+		default:
+			values[field] = fmt.Sprint(value)
+		}
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return models.PatientExternal{}, err
+	}
+	var patient models.PatientExternal
+	err = json.Unmarshal(encoded, &patient)
+	return patient, err
+}
+
+// lookup follows a dotted path through decoded JSON objects.
+func lookup(value any, path string) any {
+	if path == "" {
+		return value
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lookup outcomes counted in upstream_requests_total.
+const (
+	OutcomeSuccess  = "success"
+	OutcomeNotFound = "not_found"
+	OutcomeFailure  = "failure"
+	OutcomeRejected = "rejected" // not sent, circuit open
+)
+
+type lookupStats struct {
+	outcomes map[string]uint64
+	seconds  float64
+	count    uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	stats     = map[string]*lookupStats{}
+	// hospital code per breaker, for labelling the circuit state gauge
+	breakerCodes = map[uint]string{}
+)
+
+func recordLookup(hospitalID uint, code, outcome string, elapsed time.Duration) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	breakerCodes[hospitalID] = code
+	s, ok := stats[code]
+	if !ok {
+		s = &lookupStats{outcomes: map[string]uint64{}}
+		stats[code] = s
+	}
+	s.outcomes[outcome]++
+	if outcome != OutcomeRejected {
+		s.seconds += elapsed.Seconds()
+		s.count++
+	}
+}
+
+// WriteMetrics writes the upstream counters and breaker states in the
+// Prometheus text exposition format.
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	codes := make([]string, 0, len(stats))
+	for code := range stats {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	fmt.Fprintln(w, "# HELP upstream_requests_total Patient lookups sent to hospital systems, by outcome.")
+	fmt.Fprintln(w, "# TYPE upstream_requests_total counter")
+	for _, code := range codes {
+		for _, outcome := range []string{OutcomeSuccess, OutcomeNotFound, OutcomeFailure, OutcomeRejected} {
+			fmt.Fprintf(w, "upstream_requests_total{hospital=%q,outcome=%q} %d\n", code, outcome, stats[code].outcomes[outcome])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP upstream_request_duration_seconds Time spent on patient lookups, retries included.")
+	fmt.Fprintln(w, "# TYPE upstream_request_duration_seconds summary")
+	for _, code := range codes {
+		fmt.Fprintf(w, "upstream_request_duration_seconds_sum{hospital=%q} %g\n", code, stats[code].seconds)
+		fmt.Fprintf(w, "upstream_request_duration_seconds_count{hospital=%q} %d\n", code, stats[code].count)
+	}
+
+	ids := make([]uint, 0, len(breakerCodes))
+	for id := range breakerCodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return breakerCodes[ids[i]] < breakerCodes[ids[j]] })
+
+	fmt.Fprintln(w, "# HELP upstream_circuit_state Circuit breaker state per hospital: 0 closed, 1 open, 2 half open.")
+	fmt.Fprintln(w, "# TYPE upstream_circuit_state gauge")
+	for _, id := range ids {
+		value := 0
+		switch BreakerFor(id).Status().State {
+		case StateOpen:
+			value = 1
+		case StateHalfOpen:
+			value = 2
+		}
+		fmt.Fprintf(w, "upstream_circuit_state{hospital=%q} %d\n", breakerCodes[id], value)
+	}
+}
@@ -0,0 +1,113 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/models"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound means the hospital system has no matching patient.
+	ErrNotFound = errors.New("patient not found upstream")
+	// ErrUnsupported means the adapter cannot perform this kind of lookup.
+	ErrUnsupported = errors.New("lookup not supported by this hospital system")
+	// ErrNotModified means the record still matches the entity tag passed
+	// with WithIfNoneMatch.
+	ErrNotModified = errors.New("patient not modified upstream")
+	// ErrResponseTooLarge means the answer exceeded
+	// config.UpstreamMaxResponseBytes.
+	ErrResponseTooLarge = errors.New("upstream response too large")
+)
+
+type ifNoneMatchKey struct{}
+
+// WithIfNoneMatch makes the lookups done with ctx conditional on the record
+// having changed since the given entity tag was received.
+func WithIfNoneMatch(ctx context.Context, etag string) context.Context {
+	return context.WithValue(ctx, ifNoneMatchKey{}, etag)
+}
+
+func ifNoneMatch(ctx context.Context) string {
+	etag, _ := ctx.Value(ifNoneMatchKey{}).(string)
+	return etag
+}
+
+// StatusError is returned when a hospital system answers with an unexpected
+// HTTP status. RetryAfter is the server's requested pause, if any.
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.StatusCode)
+}
+
+// DemographicQuery holds the non-identifier search criteria. Empty fields are
+// not sent upstream.
+type DemographicQuery struct {
+	FirstName   string
+	MiddleName  string
+	LastName    string
+	DateOfBirth string
+	PhoneNumber string
+	Email       string
+}
+
+// PatientSource is one hospital information system. Implementations translate
+// the hospital's URL patterns and JSON shape into models.PatientExternal.
+type PatientSource interface {
+	SearchByNationalID(ctx context.Context, nationalID string) ([]models.PatientExternal, error)
+	SearchByPassport(ctx context.Context, passportID string) ([]models.PatientExternal, error)
+	SearchByDemographics(ctx context.Context, query DemographicQuery) ([]models.PatientExternal, error)
+	GetByHN(ctx context.Context, hn string) (models.PatientExternal, error)
+}
+
+// Factory builds the source for a hospital from its registry entry. It must
+// reject an invalid adapter configuration so hospitals can be validated on save.
+type Factory func(hospital models.Hospital) (PatientSource, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes an adapter available under name. Registering the same name
+// twice replaces the earlier factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+}
+
+// Adapters lists the registered adapter names.
+func Adapters() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ForHospital returns the source configured for the hospital. An empty
+// adapter name selects the standard adapter.
+func ForHospital(hospital models.Hospital) (PatientSource, error) {
+	name := hospital.Adapter
+	if name == "" {
+		name = models.HospitalAdapterStandard
+	}
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown adapter %q", name)
+	}
+	return factory(hospital)
+}
@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/models"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandardSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-API-Key"))
+		if r.URL.Path == "/patient/search/empty" {
+			return
+		}
+		if r.URL.Path != "/patient/search/1234" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"first_name_en":"Somchai","national_id":"1234","patient_hn":"HN-1"}`))
+	}))
+	defer server.Close()
+
+	source, err := ForHospital(models.Hospital{BaseURL: server.URL, AuthMethod: models.HospitalAuthAPIKey, AuthCredential: "secret", TimeoutMs: 1000})
+	require.NoError(t, err)
+
+	patients, err := source.SearchByNationalID(context.Background(), "1234")
+	require.NoError(t, err)
+	require.Len(t, patients, 1)
+	assert.Equal(t, "Somchai", patients[0].FirstNameEN)
+	assert.Equal(t, `"v1"`, patients[0].ETag)
+
+	_, err = source.SearchByNationalID(WithIfNoneMatch(context.Background(), `"v1"`), "1234")
+	assert.ErrorIs(t, err, ErrNotModified)
+
+	_, err = source.SearchByPassport(context.Background(), "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = source.SearchByNationalID(context.Background(), "empty")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = source.GetByHN(context.Background(), "HN-1")
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestMappedSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/people" && r.URL.Query().Get("cid") == "1234":
+			w.Write([]byte(`{"data":{"items":[{"name":{"given":"Somchai","family":"Jaidee"},"cid":1234,"hn":"HN-9"}]}}`))
+		case r.URL.EscapedPath() == "/v2/patients/HN%209%2F1":
+			w.Write([]byte(`{"data":{"items":[{"name":{"given":"Somchai","family":"Jaidee"},"hn":"HN 9/1"}]}}`))
+		case r.URL.Path == "/v2/people" && r.URL.Query().Get("fname") == "Somchai":
+			w.Write([]byte(`{"data":{"items":[]}}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	hospital := models.Hospital{
+		BaseURL:   server.URL,
+		Adapter:   models.HospitalAdapterMapped,
+		TimeoutMs: 1000,
+		AdapterConfig: `{
+			"national_id_path": "/v2/people?cid={national_id}",
+			"demographics_path": "/v2/people",
+			"hn_path": "/v2/patients/{hn}",
+			"demographic_params": {"first_name": "fname"},
+			"results": "data.items",
+			"fields": {"first_name_en": "name.given", "last_name_en": "name.family", "national_id": "cid", "patient_hn": "hn"}
+		}`,
+	}
+	source, err := ForHospital(hospital)
+	require.NoError(t, err)
+
+	patients, err := source.SearchByNationalID(context.Background(), "1234")
+	require.NoError(t, err)
+	require.Len(t, patients, 1)
+	assert.Equal(t, models.PatientExternal{FirstNameEN: "Somchai", LastNameEN: "Jaidee", NationalID: "1234", PatientHN: "HN-9"}, patients[0])
+
+	//a path placeholder is escaped as a path segment, not as a query value
+	patient, err := source.GetByHN(context.Background(), "HN 9/1")
+	require.NoError(t, err)
+	assert.Equal(t, "HN 9/1", patient.PatientHN)
+
+	patients, err = source.SearchByDemographics(context.Background(), DemographicQuery{FirstName: "Somchai"})
+	require.NoError(t, err)
+	assert.Empty(t, patients)
+
+	_, err = source.SearchByPassport(context.Background(), "AA123")
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	var statusErr *StatusError
+	_, err = source.SearchByNationalID(context.Background(), "9999")
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+}
+
+func TestForHospital_InvalidConfig(t *testing.T) {
+	_, err := ForHospital(models.Hospital{Adapter: "unknown"})
+	assert.Error(t, err)
+
+	_, err = ForHospital(models.Hospital{Adapter: models.HospitalAdapterMapped})
+	assert.Error(t, err)
+
+	_, err = ForHospital(models.Hospital{Adapter: models.HospitalAdapterMapped, AdapterConfig: `{"hn_path": "patients/{hn}"}`})
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package upstream
+
+import (
+	"agnos-hospital-middleware/models"
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+func init() {
+	Register(models.HospitalAdapterStandard, newStandardSource)
+}
+
+// standardSource speaks the reference hospital API: GET /patient/search/{id}
+// answers with a single patient in the models.PatientExternal shape, for
+// either a national ID or a passport number.
+type standardSource struct {
+	httpSource
+}
+
+func newStandardSource(hospital models.Hospital) (PatientSource, error) {
+	return standardSource{newHTTPSource(hospital)}, nil
+}
+
+func (s standardSource) SearchByNationalID(ctx context.Context, nationalID string) ([]models.PatientExternal, error) {
+	return s.search(ctx, nationalID)
+}
+
+func (s standardSource) SearchByPassport(ctx context.Context, passportID string) ([]models.PatientExternal, error) {
+	return s.search(ctx, passportID)
+}
+
+func (s standardSource) SearchByDemographics(ctx context.Context, query DemographicQuery) ([]models.PatientExternal, error) {
+	return nil, ErrUnsupported
+}
+
+func (s standardSource) GetByHN(ctx context.Context, hn string) (models.PatientExternal, error) {
+	return models.PatientExternal{}, ErrUnsupported
+}
+
+func (s standardSource) search(ctx context.Context, id string) ([]models.PatientExternal, error) {
+	resp, err := s.get(ctx, "/patient/search/"+url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	var patient models.PatientExternal
+	if err := json.Unmarshal(resp.body, &patient); err != nil {
+		return nil, err
+	}
+	patient.ETag = resp.etag
+	return []models.PatientExternal{patient}, nil
+}
@@ -1,13 +1,223 @@
 package utils
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"agnos-hospital-middleware/config"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes new passwords with one algorithm and set of
+// parameters. Every known hasher can verify its own hashes, so existing
+// passwords keep working after the configured algorithm changes.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Recognizes reports whether the hash was produced by this algorithm.
+	Recognizes(hash string) bool
+	Verify(password, hash string) bool
+	// NeedsRehash reports whether a hash of this algorithm was produced with
+	// parameters other than the hasher's own.
+	NeedsRehash(hash string) bool
+}
+
+// BcryptHasher hashes with bcrypt at a tunable cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
 	return string(bytes), err
 }
 
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
\ No newline at end of file
+func (h BcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h BcryptHasher) Verify(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes with argon2id and encodes the result in the PHC
+// string format: $argon2id$v=19$m=<KiB>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h Argon2idHasher) Verify(password, hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(candidate, key) == 1
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time != h.Time || params.Memory != h.Memory || params.Threads != h.Threads ||
+		uint32(len(key)) != h.KeyLen || uint32(len(salt)) != h.SaltLen
+}
+
+// Bounds of the argon2id parameters, configured or read from a stored hash:
+// outside them argon2 panics, or a single hash could exhaust the memory.
+const (
+	argon2MaxMemoryKiB = 4 * 1024 * 1024
+	argon2MaxThreads   = 255
+	argon2MinKeyLen    = 16
+)
+
+// checkArgon2Params validates argon2id parameters before they are narrowed
+// to the types argon2 takes.
+func checkArgon2Params(time, memory, threads int) error {
+	if time < 1 {
+		return fmt.Errorf("argon2 time must be at least 1")
+	}
+	if threads < 1 || threads > argon2MaxThreads {
+		return fmt.Errorf("argon2 threads must be between 1 and %d", argon2MaxThreads)
+	}
+	if memory < 8*threads || memory > argon2MaxMemoryKiB {
+		return fmt.Errorf("argon2 memory must be between %d KiB (8 per thread) and %d KiB", 8*threads, argon2MaxMemoryKiB)
+	}
+	return nil
+}
+
+func decodeArgon2id(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+	var memory, time, threads int
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return params, nil, nil, err
+	}
+	if err := checkArgon2Params(time, memory, threads); err != nil {
+		return params, nil, nil, err
+	}
+	params.Memory, params.Time, params.Threads = uint32(memory), uint32(time), uint8(threads)
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	//an empty key would match every password
+	if len(key) < argon2MinKeyLen {
+		return params, nil, nil, fmt.Errorf("argon2 key too short")
+	}
+	return params, salt, key, nil
+}
+
+var (
+	hasherMu sync.RWMutex
+	hasher   PasswordHasher
+)
+
+// LoadPasswordHasher picks the hasher for new passwords from configuration.
+func LoadPasswordHasher() error {
+	switch config.PasswordHashAlgorithm {
+	case "bcrypt":
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		SetPasswordHasher(BcryptHasher{Cost: config.BcryptCost})
+	case "argon2id":
+		if err := checkArgon2Params(config.Argon2Time, config.Argon2MemoryKiB, config.Argon2Threads); err != nil {
+			return fmt.Errorf("ARGON2_TIME, ARGON2_MEMORY_KIB or ARGON2_THREADS: %w", err)
+		}
+		SetPasswordHasher(Argon2idHasher{
+			Time:    uint32(config.Argon2Time),
+			Memory:  uint32(config.Argon2MemoryKiB),
+			Threads: uint8(config.Argon2Threads),
+			KeyLen:  32,
+			SaltLen: 16,
+		})
+	default:
+		return fmt.Errorf("unknown PASSWORD_HASH_ALGORITHM %q", config.PasswordHashAlgorithm)
+	}
+	return nil
+}
+
+func SetPasswordHasher(h PasswordHasher) {
+	hasherMu.Lock()
+	defer hasherMu.Unlock()
+	hasher = h
+}
+
+func currentHasher() PasswordHasher {
+	hasherMu.RLock()
+	h := hasher
+	hasherMu.RUnlock()
+	if h != nil {
+		return h
+	}
+	if err := LoadPasswordHasher(); err != nil {
+		SetPasswordHasher(BcryptHasher{Cost: bcrypt.DefaultCost})
+	}
+	hasherMu.RLock()
+	defer hasherMu.RUnlock()
+	return hasher
+}
+
+func HashPassword(password string) (string, error) {
+	return currentHasher().Hash(password)
+}
+
+// CheckPasswordHash verifies a password against a hash of any known
+// algorithm. needsRehash is true when the password matched but the hash was
+// made with another algorithm or other parameters than the configured ones,
+// so the caller should store a fresh HashPassword result.
+func CheckPasswordHash(password, hash string) (match bool, needsRehash bool) {
+	current := currentHasher()
+	for _, h := range []PasswordHasher{current, BcryptHasher{}, Argon2idHasher{}} {
+		if !h.Recognizes(hash) {
+			continue
+		}
+		if !h.Verify(password, hash) {
+			return false, false
+		}
+		return true, !current.Recognizes(hash) || current.NeedsRehash(hash)
+	}
+	return false, false
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"agnos-hospital-middleware/config"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPasswordHash_DetectsOutdatedHashes(t *testing.T) {
+	defer SetPasswordHasher(nil)
+
+	SetPasswordHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	bcryptHash, err := HashPassword("Correct-Horse-1")
+	require.NoError(t, err)
+
+	match, needsRehash := CheckPasswordHash("Correct-Horse-1", bcryptHash)
+	assert.True(t, match)
+	assert.False(t, needsRehash)
+
+	// Higher bcrypt cost configured
+	SetPasswordHasher(BcryptHasher{Cost: bcrypt.MinCost + 1})
+	match, needsRehash = CheckPasswordHash("Correct-Horse-1", bcryptHash)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+
+	// Algorithm switched to argon2id
+	argon := Argon2idHasher{Time: 1, Memory: 8 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	SetPasswordHasher(argon)
+	match, needsRehash = CheckPasswordHash("Correct-Horse-1", bcryptHash)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+
+	argonHash, err := HashPassword("Correct-Horse-1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(argonHash, "$argon2id$v=19$m=8192,t=1,p=1$"))
+
+	match, needsRehash = CheckPasswordHash("Correct-Horse-1", argonHash)
+	assert.True(t, match)
+	assert.False(t, needsRehash)
+
+	match, needsRehash = CheckPasswordHash("wrong", argonHash)
+	assert.False(t, match)
+	assert.False(t, needsRehash)
+
+	// argon2id with other parameters
+	SetPasswordHasher(Argon2idHasher{Time: 2, Memory: 8 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16})
+	match, needsRehash = CheckPasswordHash("Correct-Horse-1", argonHash)
+	assert.True(t, match)
+	assert.True(t, needsRehash)
+}
+
+func TestCheckPasswordHash_UnknownFormat(t *testing.T) {
+	match, _ := CheckPasswordHash("anything", "plaintext")
+	assert.False(t, match)
+}
+
+func TestLoadPasswordHasher_RejectsBadArgon2Parameters(t *testing.T) {
+	defer SetPasswordHasher(nil)
+	algorithm, time, memory, threads := config.PasswordHashAlgorithm, config.Argon2Time, config.Argon2MemoryKiB, config.Argon2Threads
+	defer func() {
+		config.PasswordHashAlgorithm, config.Argon2Time, config.Argon2MemoryKiB, config.Argon2Threads = algorithm, time, memory, threads
+	}()
+
+	config.PasswordHashAlgorithm = "argon2id"
+	for _, params := range [][3]int{{0, 8 * 1024, 1}, {1, 8 * 1024, 0}, {1, 8 * 1024, 256}, {1, 4, 1}, {1, 1 << 30, 1}} {
+		config.Argon2Time, config.Argon2MemoryKiB, config.Argon2Threads = params[0], params[1], params[2]
+		assert.Error(t, LoadPasswordHasher(), "%v", params)
+	}
+	config.Argon2Time, config.Argon2MemoryKiB, config.Argon2Threads = 1, 8*1024, 1
+	assert.NoError(t, LoadPasswordHasher())
+}
+
+func TestCheckPasswordHash_RejectsBadArgon2Hashes(t *testing.T) {
+	defer SetPasswordHasher(nil)
+	SetPasswordHasher(Argon2idHasher{Time: 1, Memory: 8 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16})
+
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, hash := range []string{
+		"$argon2id$v=19$m=8192,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=8192,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=8192,t=1,p=256$" + salt + "$" + key,
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=8192,t=1,p=1$" + salt + "$",
+	} {
+		assert.NotPanics(t, func() {
+			match, _ := CheckPasswordHash("anything", hash)
+			assert.False(t, match, hash)
+		})
+	}
+}
@@ -1,41 +1,106 @@
 package utils
 
 import (
+	"errors"
 	"time"
 	"github.com/golang-jwt/jwt/v5"
+	"agnos-hospital-middleware/config"
 	"agnos-hospital-middleware/models"
 )
 
-var jwtKey = []byte("secret_key") // change to env var in prod
+// Token uses. An MFA challenge token only proves the password step and must
+// never be accepted where an access token is expected.
+const (
+	TokenUseAccess = "access"
+	TokenUseMFA    = "mfa"
+)
+
+func init() {
+	//issue times to the microsecond, as precise as the database keeps the time
+	//sessions were revoked, so a token issued right after it is not taken for
+	//one issued before
+	jwt.TimePrecision = time.Microsecond
+}
 
 type Claims struct {
+	StaffID uint
 	Username string
+	Role models.Role
 	HospitalID uint
 	HospitalName string
+	TokenUse string
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(username string, hospital models.Hospital) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateJWT issues a short-lived access token. Each token carries a random
+// jti so it can be revoked individually before it expires.
+func GenerateJWT(staff models.Staff, hospital models.Hospital) (string, error) {
+	return generateToken(staff, hospital, TokenUseAccess, config.AccessTokenTTL)
+}
+
+// GenerateMFAToken issues the challenge token returned by the password step
+// of a login when a second factor is still required.
+func GenerateMFAToken(staff models.Staff, hospital models.Hospital) (string, error) {
+	return generateToken(staff, hospital, TokenUseMFA, config.MFAChallengeTTL)
+}
+
+func generateToken(staff models.Staff, hospital models.Hospital, use string, ttl time.Duration) (string, error) {
+	jti, err := RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := &Claims{
-		Username: username,
+		StaffID: staff.ID,
+		Username: staff.Username,
+		Role: staff.Role,
 		HospitalID: hospital.ID,
 		HospitalName: hospital.Name,
+		TokenUse: use,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	ks, err := currentKeySet()
+	if err != nil {
+		return "", err
+	}
+	return ks.sign(claims)
+}
+
+// IssuedAtTime is when the token was issued, the zero time if it does not say.
+func (c *Claims) IssuedAtTime() time.Time {
+	if c.IssuedAt == nil {
+		return time.Time{}
+	}
+	return c.IssuedAt.Time
 }
 
 func ValidateJWT(tokenStr string) (*Claims, error) {
+	return validateToken(tokenStr, TokenUseAccess)
+}
+
+func ValidateMFAToken(tokenStr string) (*Claims, error) {
+	return validateToken(tokenStr, TokenUseMFA)
+}
+
+func validateToken(tokenStr string, use string) (*Claims, error) {
+	ks, err := currentKeySet()
+	if err != nil {
+		return nil, err
+	}
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-	if err != nil || !token.Valid {
+	token, err := jwt.ParseWithClaims(tokenStr, claims, ks.keyFunc, jwt.WithValidMethods(validMethods()))
+	if err != nil {
 		return nil, err
 	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.TokenUse != use {
+		return nil, errors.New("wrong token use")
+	}
 	return claims, nil
 }
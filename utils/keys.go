@@ -0,0 +1,361 @@
+package utils
+
+import (
+	"agnos-hospital-middleware/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one entry of the key set. Verify-only keys (a public key or
+// an HMAC secret that is no longer active) have no effect on signing but keep
+// tokens issued before a rotation valid until they expire.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet holds every key tokens may be verified with, and the one key new
+// tokens are signed with.
+type KeySet struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+// keyFileEntry is one key in the JWT_KEYS_FILE document.
+type keyFileEntry struct {
+	KID            string `json:"kid"`
+	Alg            string `json:"alg"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+	SecretFile     string `json:"secret_file"`
+}
+
+type keyFile struct {
+	ActiveKID string         `json:"active_kid"`
+	Keys      []keyFileEntry `json:"keys"`
+}
+
+var supportedMethods = map[string]jwt.SigningMethod{
+	"HS256": jwt.SigningMethodHS256,
+	"RS256": jwt.SigningMethodRS256,
+	"ES256": jwt.SigningMethodES256,
+	"EdDSA": jwt.SigningMethodEdDSA,
+}
+
+var (
+	keySetMu sync.RWMutex
+	keySet   *KeySet
+	// serialises loading the key set on first use, so concurrent callers
+	// cannot each generate their own ephemeral key
+	keySetLoadMu sync.Mutex
+)
+
+// LoadSigningKeys loads the key set from configuration:
+// JWT_KEYS_FILE if set, otherwise JWT_SECRET as a single HS256 key. With
+// neither, a random secret is generated so tokens do not survive a restart.
+func LoadSigningKeys() error {
+	var ks *KeySet
+	var err error
+	switch {
+	case config.JWTKeysFile != "":
+		ks, err = LoadKeySetFile(config.JWTKeysFile)
+	case config.JWTSecret != "":
+		ks, err = NewHMACKeySet("default", []byte(config.JWTSecret))
+	default:
+		log.Println("JWT_KEYS_FILE and JWT_SECRET are not set, using an ephemeral signing key")
+		var secret string
+		secret, err = RandomToken(32)
+		if err == nil {
+			ks, err = NewHMACKeySet("ephemeral", []byte(secret))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	SetKeySet(ks)
+	return nil
+}
+
+// SetKeySet replaces the key set used to sign and verify tokens.
+func SetKeySet(ks *KeySet) {
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+	keySet = ks
+}
+
+func currentKeySet() (*KeySet, error) {
+	keySetMu.RLock()
+	ks := keySet
+	keySetMu.RUnlock()
+	if ks != nil {
+		return ks, nil
+	}
+	keySetLoadMu.Lock()
+	defer keySetLoadMu.Unlock()
+	keySetMu.RLock()
+	ks = keySet
+	keySetMu.RUnlock()
+	//loaded by another caller meanwhile
+	if ks != nil {
+		return ks, nil
+	}
+	if err := LoadSigningKeys(); err != nil {
+		return nil, err
+	}
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	return keySet, nil
+}
+
+func NewHMACKeySet(kid string, secret []byte) (*KeySet, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("HS256 secret must be at least 32 bytes")
+	}
+	key := &SigningKey{ID: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+	return &KeySet{active: key, keys: map[string]*SigningKey{kid: key}}, nil
+}
+
+// LoadKeySetFile reads a JSON key list such as:
+//
+//	{"active_kid": "2026-10", "keys": [
+//	  {"kid": "2026-10", "alg": "ES256", "private_key_file": "/keys/2026-10.pem"},
+//	  {"kid": "2026-07", "alg": "ES256", "public_key_file": "/keys/2026-07.pub.pem"}]}
+func LoadKeySetFile(path string) (*KeySet, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc keyFile
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	ks := &KeySet{keys: map[string]*SigningKey{}}
+	for _, entry := range doc.Keys {
+		key, err := loadKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.KID, err)
+		}
+		if _, dup := ks.keys[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate kid %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	active, ok := ks.keys[doc.ActiveKID]
+	if !ok {
+		return nil, fmt.Errorf("active_kid %q is not in the key list", doc.ActiveKID)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key or secret", doc.ActiveKID)
+	}
+	ks.active = active
+	return ks, nil
+}
+
+func loadKey(entry keyFileEntry) (*SigningKey, error) {
+	if entry.KID == "" {
+		return nil, errors.New("kid is required")
+	}
+	method, ok := supportedMethods[entry.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", entry.Alg)
+	}
+	key := &SigningKey{ID: entry.KID, Method: method}
+
+	if entry.Alg == "HS256" {
+		secret, err := os.ReadFile(entry.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = []byte(strings.TrimSpace(string(secret)))
+		if len(secret) < 32 {
+			return nil, errors.New("HS256 secret must be at least 32 bytes")
+		}
+		key.signKey, key.verifyKey = secret, secret
+		return key, nil
+	}
+
+	switch {
+	case entry.PrivateKeyFile != "":
+		private, err := readPEMPrivateKey(entry.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = private
+		key.verifyKey = private.Public()
+	case entry.PublicKeyFile != "":
+		public, err := readPEMPublicKey(entry.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key.verifyKey = public
+	default:
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+
+	if err := checkKeyMatchesAlg(entry.Alg, key.verifyKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func readPEMPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func readPEMPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+	return block, nil
+}
+
+func checkKeyMatchesAlg(alg string, public crypto.PublicKey) error {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && k.Curve == elliptic.P256() {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			return nil
+		}
+	}
+	return fmt.Errorf("key type %T cannot be used with %s", public, alg)
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.signKey)
+}
+
+// keyFunc picks the verification key by kid and refuses tokens whose alg does
+// not match the key, so a public key can never be used as an HMAC secret.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("alg %s does not match key %q", token.Method.Alg(), kid)
+	}
+	return key.verifyKey, nil
+}
+
+func validMethods() []string {
+	methods := make([]string, 0, len(supportedMethods))
+	for alg := range supportedMethods {
+		methods = append(methods, alg)
+	}
+	return methods
+}
+
+// JWK is a public key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns the public half of every asymmetric key. HMAC keys are never
+// published.
+func JWKS() ([]JWK, error) {
+	ks, err := currentKeySet()
+	if err != nil {
+		return nil, err
+	}
+	jwks := []JWK{}
+	for _, key := range ks.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch k := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = b64(k.N.Bytes())
+			jwk.E = b64(big.NewInt(int64(k.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = "P-256"
+			jwk.X = b64(k.X.FillBytes(make([]byte, 32)))
+			jwk.Y = b64(k.Y.FillBytes(make([]byte, 32)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = b64(k)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
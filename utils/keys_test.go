@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"agnos-hospital-middleware/config"
+	"agnos-hospital-middleware/models"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+func writeKeysFile(t *testing.T, dir string, doc keyFile) string {
+	raw, _ := json.Marshal(doc)
+	path := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(path, raw, 0600))
+	return path
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+	defer SetKeySet(nil)
+
+	// The old EdDSA key starts out active
+	_, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edPrivate)
+	edPath := writePEM(t, dir, "old.pem", "PRIVATE KEY", edDER)
+
+	ks, err := LoadKeySetFile(writeKeysFile(t, dir, keyFile{
+		ActiveKID: "old",
+		Keys:      []keyFileEntry{{KID: "old", Alg: "EdDSA", PrivateKeyFile: edPath}},
+	}))
+	require.NoError(t, err)
+	SetKeySet(ks)
+
+	staff := models.Staff{ID: 7, Username: "rotating", Role: models.RoleDoctor}
+	oldToken, err := GenerateJWT(staff, models.Hospital{ID: 1, Name: "Test Hospital"})
+	require.NoError(t, err)
+
+	// Rotate to a new ES256 key, keeping only the public half of the old one
+	ecPrivate, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecPrivate)
+	ecPath := writePEM(t, dir, "new.pem", "EC PRIVATE KEY", ecDER)
+	edPublicDER, _ := x509.MarshalPKIXPublicKey(edPrivate.Public())
+	edPublicPath := writePEM(t, dir, "old.pub.pem", "PUBLIC KEY", edPublicDER)
+
+	ks, err = LoadKeySetFile(writeKeysFile(t, dir, keyFile{
+		ActiveKID: "new",
+		Keys: []keyFileEntry{
+			{KID: "new", Alg: "ES256", PrivateKeyFile: ecPath},
+			{KID: "old", Alg: "EdDSA", PublicKeyFile: edPublicPath},
+		},
+	}))
+	require.NoError(t, err)
+	SetKeySet(ks)
+
+	claims, err := ValidateJWT(oldToken)
+	require.NoError(t, err)
+	assert.Equal(t, "rotating", claims.Username)
+
+	newToken, err := GenerateJWT(staff, models.Hospital{ID: 1, Name: "Test Hospital"})
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "new", parsed.Header["kid"])
+	assert.Equal(t, "ES256", parsed.Method.Alg())
+
+	jwks, err := JWKS()
+	require.NoError(t, err)
+	require.Len(t, jwks, 2)
+	assert.Equal(t, "EC", jwks[0].Kty)
+	assert.Equal(t, "OKP", jwks[1].Kty)
+}
+
+func TestValidateJWT_RejectsUnknownKidAndAlgMismatch(t *testing.T) {
+	defer SetKeySet(nil)
+
+	ks, err := NewHMACKeySet("hs", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	SetKeySet(ks)
+
+	claims := &Claims{Username: "mallory"}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "missing"
+	signed, _ := token.SignedString([]byte("0123456789abcdef0123456789abcdef"))
+	_, err = ValidateJWT(signed)
+	assert.Error(t, err)
+
+	token = jwt.NewWithClaims(jwt.SigningMethodHS384, claims)
+	token.Header["kid"] = "hs"
+	signed, _ = token.SignedString([]byte("0123456789abcdef0123456789abcdef"))
+	_, err = ValidateJWT(signed)
+	assert.Error(t, err)
+}
+
+func TestLoadKeySetFile_ActiveKeyNeedsPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	_, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	publicDER, _ := x509.MarshalPKIXPublicKey(edPrivate.Public())
+	publicPath := writePEM(t, dir, "pub.pem", "PUBLIC KEY", publicDER)
+
+	_, err := LoadKeySetFile(writeKeysFile(t, dir, keyFile{
+		ActiveKID: "pub",
+		Keys:      []keyFileEntry{{KID: "pub", Alg: "EdDSA", PublicKeyFile: publicPath}},
+	}))
+	assert.Error(t, err)
+}
+
+func TestCurrentKeySet_LoadsOnce(t *testing.T) {
+	defer SetKeySet(nil)
+	keysFile, secret := config.JWTKeysFile, config.JWTSecret
+	config.JWTKeysFile, config.JWTSecret = "", ""
+	defer func() { config.JWTKeysFile, config.JWTSecret = keysFile, secret }()
+	SetKeySet(nil)
+
+	//every caller must get the same ephemeral key, or tokens fail to verify
+	loaded := make(chan *KeySet, 8)
+	for i := 0; i < cap(loaded); i++ {
+		go func() {
+			ks, _ := currentKeySet()
+			loaded <- ks
+		}()
+	}
+	first := <-loaded
+	require.NotNil(t, first)
+	for i := 1; i < cap(loaded); i++ {
+		assert.Same(t, first, <-loaded)
+	}
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"agnos-hospital-middleware/config"
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// PasswordPolicy describes what a new password must look like. Reuse of
+// earlier passwords needs the stored history and is checked by the caller.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Denylist holds lowercased common or breached passwords.
+	Denylist map[string]struct{}
+}
+
+// PasswordPolicyError lists every rule a password broke, so the user can fix
+// them all at once.
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Violations, ", ")
+}
+
+var (
+	passwordPolicyMu sync.RWMutex
+	passwordPolicy   *PasswordPolicy
+)
+
+// LoadPasswordPolicy builds the policy from configuration, reading the
+// denylist file if one is configured.
+func LoadPasswordPolicy() error {
+	policy := &PasswordPolicy{
+		MinLength:     config.PasswordMinLength,
+		RequireUpper:  config.PasswordRequireUpper,
+		RequireLower:  config.PasswordRequireLower,
+		RequireDigit:  config.PasswordRequireDigit,
+		RequireSymbol: config.PasswordRequireSymbol,
+	}
+	if config.PasswordDenylistFile != "" {
+		denylist, err := LoadPasswordDenylist(config.PasswordDenylistFile)
+		if err != nil {
+			return err
+		}
+		policy.Denylist = denylist
+	}
+	SetPasswordPolicy(policy)
+	return nil
+}
+
+func SetPasswordPolicy(policy *PasswordPolicy) {
+	passwordPolicyMu.Lock()
+	defer passwordPolicyMu.Unlock()
+	passwordPolicy = policy
+}
+
+func CurrentPasswordPolicy() *PasswordPolicy {
+	passwordPolicyMu.RLock()
+	policy := passwordPolicy
+	passwordPolicyMu.RUnlock()
+	if policy != nil {
+		return policy
+	}
+	if err := LoadPasswordPolicy(); err != nil {
+		//an unreadable denylist must not disable the other rules
+		SetPasswordPolicy(&PasswordPolicy{
+			MinLength:     config.PasswordMinLength,
+			RequireUpper:  config.PasswordRequireUpper,
+			RequireLower:  config.PasswordRequireLower,
+			RequireDigit:  config.PasswordRequireDigit,
+			RequireSymbol: config.PasswordRequireSymbol,
+		})
+	}
+	passwordPolicyMu.RLock()
+	defer passwordPolicyMu.RUnlock()
+	return passwordPolicy
+}
+
+// LoadPasswordDenylist reads one password per line. Blank lines and lines
+// starting with # are ignored.
+func LoadPasswordDenylist(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denylist := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denylist[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return denylist, nil
+}
+
+// Validate returns a *PasswordPolicyError if the password breaks any rule.
+func (p *PasswordPolicy) Validate(password, username string) error {
+	var violations []string
+
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, "must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	if _, listed := p.Denylist[lowered]; listed {
+		violations = append(violations, "is too common")
+	}
+	if len(username) >= 3 && strings.Contains(lowered, strings.ToLower(username)) {
+		violations = append(violations, "must not contain the username")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 6238 appendix B, SHA1 rows truncated to 6 digits
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "time %d", unix)
+	}
+}
+
+func TestValidateTOTP_DriftAndReplay(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	require.NoError(t, err)
+	now := time.Now()
+
+	previous, _ := TOTPCode(secret, TOTPStep(now)-1)
+	step, ok := ValidateTOTP(secret, previous, now, 0)
+	assert.True(t, ok)
+
+	// The same code cannot be used twice
+	_, ok = ValidateTOTP(secret, previous, now, step)
+	assert.False(t, ok)
+
+	tooOld, _ := TOTPCode(secret, TOTPStep(now)-3)
+	_, ok = ValidateTOTP(secret, tooOld, now, 0)
+	assert.False(t, ok)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI("Hospital Middleware", "dr smith", "ABC")
+	assert.Equal(t, "otpauth://totp/Hospital%20Middleware:dr%20smith?algorithm=SHA1&digits=6&issuer=Hospital+Middleware&period=30&secret=ABC", uri)
+}
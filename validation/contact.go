@@ -0,0 +1,124 @@
+package validation
+
+import (
+	"errors"
+	"net/mail"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrInvalidPhone = errors.New("phone_number must be an international number starting with + or a national number starting with 0")
+	ErrInvalidEmail = errors.New("email must be a valid address")
+)
+
+// phoneRegion is a country whose national numbers start with the trunk prefix
+// 0, which is replaced by the calling code to make them international.
+type phoneRegion struct {
+	callingCode string
+	// bounds of the national significant number, when known
+	minDigits, maxDigits int
+}
+
+// phoneRegions are keyed by ISO 3166 alpha-2 code.
+var phoneRegions = map[string]phoneRegion{
+	"TH": {callingCode: "66", minDigits: 8, maxDigits: 9},
+	"LA": {callingCode: "856"},
+	"KH": {callingCode: "855"},
+	"MM": {callingCode: "95"},
+	"MY": {callingCode: "60"},
+	"VN": {callingCode: "84"},
+	"CN": {callingCode: "86"},
+	"JP": {callingCode: "81"},
+	"IN": {callingCode: "91"},
+	"AU": {callingCode: "61"},
+	"GB": {callingCode: "44"},
+}
+
+// phoneCallingCodes are the regions of phoneRegions, longest calling code
+// first, so a number is matched by the most specific code it starts with.
+var phoneCallingCodes = func() []phoneRegion {
+	regions := make([]phoneRegion, 0, len(phoneRegions))
+	for _, region := range phoneRegions {
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		if len(regions[i].callingCode) != len(regions[j].callingCode) {
+			return len(regions[i].callingCode) > len(regions[j].callingCode)
+		}
+		return regions[i].callingCode < regions[j].callingCode
+	})
+	return regions
+}()
+
+// E.164 numbers have at most 15 digits; shorter than 8 is never a full number
+const (
+	minPhoneDigits = 8
+	maxPhoneDigits = 15
+)
+
+// PhoneE164 returns a phone number in E.164 form, e.g. 081-234 5678 becomes
+// +66812345678 in region TH. International numbers start with + or 00;
+// anything else must be a national number of region, starting with 0.
+// Grouping characters and Thai digits are accepted.
+func PhoneE164(raw, region string) (string, error) {
+	number := strings.TrimSpace(raw)
+	international := strings.HasPrefix(number, "+")
+	number = strings.TrimPrefix(number, "+")
+
+	var digits strings.Builder
+	for _, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r >= '๐' && r <= '๙':
+			digits.WriteRune('0' + r - '๐')
+		case unicode.IsSpace(r) || unicode.Is(unicode.Pd, r) || strings.ContainsRune(".()/", r):
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	number = digits.String()
+
+	if !international && strings.HasPrefix(number, "00") {
+		international = true
+		number = number[2:]
+	}
+	if !international {
+		home, ok := phoneRegions[strings.ToUpper(region)]
+		if !ok || !strings.HasPrefix(number, "0") {
+			return "", ErrInvalidPhone
+		}
+		number = home.callingCode + number[1:]
+	}
+
+	for _, known := range phoneCallingCodes {
+		national, ok := strings.CutPrefix(number, known.callingCode)
+		if !ok {
+			continue
+		}
+		//+66 081... keeps the trunk prefix by mistake
+		national = strings.TrimPrefix(national, "0")
+		if known.minDigits > 0 && (len(national) < known.minDigits || len(national) > known.maxDigits) {
+			return "", ErrInvalidPhone
+		}
+		number = known.callingCode + national
+		break
+	}
+	if len(number) < minPhoneDigits || len(number) > maxPhoneDigits || number[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	return "+" + number, nil
+}
+
+// NormalizeEmail returns an email address in the form it is matched by:
+// trimmed and lower case. Display names and comments are not accepted.
+func NormalizeEmail(raw string) (string, error) {
+	email := strings.TrimSpace(raw)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(email), nil
+}
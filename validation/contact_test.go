@@ -0,0 +1,58 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhoneE164(t *testing.T) {
+	for raw, want := range map[string]string{
+		"0812345678":        "+66812345678",
+		"081-234-5678":      "+66812345678",
+		" (081) 234 5678 ":  "+66812345678",
+		"+66 81 234 5678":   "+66812345678",
+		"+66 081 234 5678":  "+66812345678",
+		"0066812345678":     "+66812345678",
+		"๐๘๑๒๓๔๕๖๗๘":        "+66812345678",
+		"02-123-4567":       "+6621234567",
+		"+1 (415) 555-0132": "+14155550132",
+		"+44 020 7946 0018": "+442079460018",
+	} {
+		phone, err := PhoneE164(raw, "TH")
+		assert.NoError(t, err, raw)
+		assert.Equal(t, want, phone, raw)
+	}
+
+	phone, err := PhoneE164("020 7946 0018", "gb")
+	assert.NoError(t, err)
+	assert.Equal(t, "+442079460018", phone)
+
+	for _, raw := range []string{"", "812345678", "081234567890", "+66 81 234", "081 234 5678 ext 2", "+0812345678", "+1234567890123456"} {
+		_, err := PhoneE164(raw, "TH")
+		assert.ErrorIs(t, err, ErrInvalidPhone, raw)
+	}
+
+	//national numbers need a known region
+	_, err = PhoneE164("0812345678", "")
+	assert.ErrorIs(t, err, ErrInvalidPhone)
+
+	//calling codes are tried longest first, whatever the map order
+	phone, err = PhoneE164("+856 020 5555 1234", "TH")
+	assert.NoError(t, err)
+	assert.Equal(t, "+8562055551234", phone)
+	for i := 1; i < len(phoneCallingCodes); i++ {
+		assert.GreaterOrEqual(t, len(phoneCallingCodes[i-1].callingCode), len(phoneCallingCodes[i].callingCode))
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	email, err := NormalizeEmail("  Somchai.J@Example.CO.TH ")
+	assert.NoError(t, err)
+	assert.Equal(t, "somchai.j@example.co.th", email)
+
+	for _, raw := range []string{"", "somchai", "Somchai <somchai@example.com>", "a@b@c"} {
+		_, err := NormalizeEmail(raw)
+		assert.ErrorIs(t, err, ErrInvalidEmail, raw)
+	}
+}
@@ -0,0 +1,106 @@
+package validation
+
+import (
+	"agnos-hospital-middleware/models"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidDate = errors.New("date_of_birth must be a date such as 1985-04-12, 12/04/2528, 1985-04 or 1985")
+
+// Years from here on are Buddhist Era, 543 years ahead of the Gregorian
+// calendar. No Gregorian birth year comes close.
+const buddhistEraFrom = 2400
+
+var (
+	isoDate     = regexp.MustCompile(`^(\d{4})(?:-(\d{1,2})(?:-(\d{1,2}))?)?$`)
+	compactDate = regexp.MustCompile(`^(\d{4})(\d{2})(\d{2})$`)
+	// day first, as written in Thailand: 12/04/2528, 12-4-1985, 12.04.1985, 04/1985
+	dayFirstDate = regexp.MustCompile(`^(?:(\d{1,2})[/.-])?(\d{1,2})[/.-](\d{4})$`)
+	// 12 Apr 1985, 12 เม.ย. 2528, April 1985
+	namedMonthDate = regexp.MustCompile(`^(?:(\d{1,2})\s+)?(\S+)\s+(\d{4})$`)
+	// Apr 12, 1985
+	monthFirstDate = regexp.MustCompile(`^(\S+)\s+(\d{1,2}),\s*(\d{4})$`)
+)
+
+var monthNames = map[string]time.Month{}
+
+func init() {
+	thai := [][]string{
+		{"ม.ค.", "มกราคม"}, {"ก.พ.", "กุมภาพันธ์"}, {"มี.ค.", "มีนาคม"}, {"เม.ย.", "เมษายน"},
+		{"พ.ค.", "พฤษภาคม"}, {"มิ.ย.", "มิถุนายน"}, {"ก.ค.", "กรกฎาคม"}, {"ส.ค.", "สิงหาคม"},
+		{"ก.ย.", "กันยายน"}, {"ต.ค.", "ตุลาคม"}, {"พ.ย.", "พฤศจิกายน"}, {"ธ.ค.", "ธันวาคม"},
+	}
+	for month := time.January; month <= time.December; month++ {
+		english := strings.ToLower(month.String())
+		monthNames[english] = month
+		monthNames[english[:3]] = month
+		for _, name := range thai[month-1] {
+			monthNames[name] = month
+		}
+	}
+	monthNames["sept"] = time.September
+}
+
+// ParseDate reads a possibly partial date in the formats hospital systems
+// use: ISO 8601 (1985-04-12, 1985-04, 1985, or a timestamp), YYYYMMDD, day
+// first with /, - or . (12/04/1985, 04/1985), and English or Thai month names
+// (12 Apr 1985, Apr 12, 1985, 12 เม.ย. 2528). Buddhist Era years are
+// converted to Gregorian ones. An empty string is an unknown date.
+func ParseDate(raw string) (models.PartialDate, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return models.PartialDate{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return dateOf(t.Year(), int(t.Month()), t.Day())
+	}
+	if m := isoDate.FindStringSubmatch(raw); m != nil {
+		return dateOf(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+	}
+	if m := compactDate.FindStringSubmatch(raw); m != nil {
+		return dateOf(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+	}
+	if m := dayFirstDate.FindStringSubmatch(raw); m != nil {
+		return dateOf(atoi(m[3]), atoi(m[2]), atoi(m[1]))
+	}
+	if m := namedMonthDate.FindStringSubmatch(raw); m != nil {
+		if month, ok := monthNames[strings.ToLower(strings.TrimSuffix(m[2], ","))]; ok {
+			return dateOf(atoi(m[3]), int(month), atoi(m[1]))
+		}
+	}
+	if m := monthFirstDate.FindStringSubmatch(raw); m != nil {
+		if month, ok := monthNames[strings.ToLower(m[1])]; ok {
+			return dateOf(atoi(m[3]), int(month), atoi(m[2]))
+		}
+	}
+	return models.PartialDate{}, ErrInvalidDate
+}
+
+// dateOf builds the date from its parts; a zero month or day is unknown.
+func dateOf(year, month, day int) (models.PartialDate, error) {
+	if year >= buddhistEraFrom {
+		year -= 543
+	}
+	precision := models.DatePrecisionDay
+	switch {
+	case month == 0 && day == 0:
+		precision, month, day = models.DatePrecisionYear, 1, 1
+	case day == 0:
+		precision, day = models.DatePrecisionMonth, 1
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	//time.Date normalises 31 April to 1 May, a real date does not
+	if month < 1 || month > 12 || t.Day() != day || int(t.Month()) != month {
+		return models.PartialDate{}, ErrInvalidDate
+	}
+	return models.NewPartialDate(t, precision), nil
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
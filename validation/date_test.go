@@ -0,0 +1,56 @@
+package validation
+
+import (
+	"agnos-hospital-middleware/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDate(t *testing.T) {
+	for raw, want := range map[string]string{
+		"1985-04-12":           "1985-04-12",
+		"1985-4-2":             "1985-04-02",
+		"1985-04":              "1985-04",
+		"1985":                 "1985",
+		"2528-04-12":           "1985-04-12",
+		"1985-04-12T00:00:00Z": "1985-04-12",
+		"19850412":             "1985-04-12",
+		"12/04/2528":           "1985-04-12",
+		"12-4-1985":            "1985-04-12",
+		"12.04.1985":           "1985-04-12",
+		"04/2528":              "1985-04",
+		"12 Apr 1985":          "1985-04-12",
+		"12 april 1985":        "1985-04-12",
+		"Apr 12, 1985":         "1985-04-12",
+		"April 1985":           "1985-04",
+		"12 เม.ย. 2528":        "1985-04-12",
+		"12 เมษายน 2528":       "1985-04-12",
+		"":                     "",
+	} {
+		date, err := ParseDate(raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, want, date.String(), raw)
+	}
+
+	for _, raw := range []string{"31/04/1985", "1985-13", "12/04", "yesterday", "12 Foo 1985"} {
+		_, err := ParseDate(raw)
+		assert.ErrorIs(t, err, ErrInvalidDate, raw)
+	}
+}
+
+func TestParseDate_Precision(t *testing.T) {
+	date, err := ParseDate("2528")
+	require.NoError(t, err)
+	assert.Equal(t, models.DatePrecisionYear, date.Precision)
+	first, last := date.Range()
+	assert.Equal(t, "1985-01-01", first.Format("2006-01-02"))
+	assert.Equal(t, "1985-12-31", last.Format("2006-01-02"))
+
+	date, err = ParseDate("02/2528")
+	require.NoError(t, err)
+	assert.Equal(t, models.DatePrecisionMonth, date.Precision)
+	_, last = date.Range()
+	assert.Equal(t, "1985-02-28", last.Format("2006-01-02"))
+}
@@ -0,0 +1,107 @@
+// Package validation checks and normalises the identifiers and contact
+// details patients are looked up by, wherever they come from: search input, registration or a
+// hospital system's response.
+package validation
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrInvalidNationalID      = errors.New("national_id must be 13 digits with a valid check digit")
+	ErrInvalidPassport        = errors.New("passport_id must be 6-9 letters or digits")
+	ErrInvalidPassportCountry = errors.New("passport_country must be an ICAO country code such as THA")
+)
+
+var (
+	// ICAO 9303 document numbers are at most 9 characters
+	passportPattern = regexp.MustCompile(`^[A-Z0-9]{6,9}$`)
+	// alpha-3 codes, plus D which ICAO uses for Germany
+	countryPattern = regexp.MustCompile(`^([A-Z]{3}|D)$`)
+	// issuing countries whose numbering is known to be stricter
+	passportFormats = map[string]*regexp.Regexp{
+		"THA": regexp.MustCompile(`^[A-Z]{1,2}[0-9]{6,7}$`),
+	}
+)
+
+// stripSeparators drops whitespace, dashes and dots that identifiers are
+// commonly grouped with, e.g. 1-1017-00203-45-0.
+func stripSeparators(raw string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.Is(unicode.Pd, r) || r == '.' {
+			return -1
+		}
+		return r
+	}, raw)
+}
+
+// NormalizeNationalID removes separators from a Thai national ID.
+func NormalizeNationalID(raw string) string {
+	return stripSeparators(raw)
+}
+
+// ValidNationalID reports whether id is 13 digits whose last digit is the
+// mod-11 check digit of the first 12.
+func ValidNationalID(id string) bool {
+	if len(id) != 13 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 13; i++ {
+		if id[i] < '0' || id[i] > '9' {
+			return false
+		}
+		if i < 12 {
+			sum += int(id[i]-'0') * (13 - i)
+		}
+	}
+	return int(id[12]-'0') == (11-sum%11)%10
+}
+
+// NationalID normalises and validates a Thai national ID.
+func NationalID(raw string) (string, error) {
+	id := NormalizeNationalID(raw)
+	if !ValidNationalID(id) {
+		return id, ErrInvalidNationalID
+	}
+	return id, nil
+}
+
+// NormalizePassport removes separators and uppercases a passport number or
+// issuing country code.
+func NormalizePassport(raw string) string {
+	return strings.ToUpper(stripSeparators(raw))
+}
+
+// ValidPassport reports whether number is a plausible passport number, under
+// the issuing country's own format when country is given and known.
+func ValidPassport(number, country string) bool {
+	if !passportPattern.MatchString(number) {
+		return false
+	}
+	if format, ok := passportFormats[country]; ok {
+		return format.MatchString(number)
+	}
+	return true
+}
+
+// ValidPassportCountry reports whether country is an ICAO issuing state code.
+func ValidPassportCountry(country string) bool {
+	return countryPattern.MatchString(country)
+}
+
+// Passport normalises and validates a passport number and its optional
+// issuing country.
+func Passport(rawNumber, rawCountry string) (string, string, error) {
+	number, country := NormalizePassport(rawNumber), NormalizePassport(rawCountry)
+	if country != "" && !ValidPassportCountry(country) {
+		return number, country, ErrInvalidPassportCountry
+	}
+	if !ValidPassport(number, country) {
+		return number, country, ErrInvalidPassport
+	}
+	return number, country, nil
+}
@@ -0,0 +1,47 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNationalID(t *testing.T) {
+	for raw, want := range map[string]string{
+		"1101700203450":       "1101700203450",
+		"1-1017-00203-45-0":   "1101700203450",
+		" 3 1015 00123 45 9 ": "3101500123459",
+	} {
+		id, err := NationalID(raw)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, want, id)
+	}
+
+	for _, raw := range []string{"", "12345", "1101700203451", "110170020345X", "11017002034500"} {
+		_, err := NationalID(raw)
+		assert.ErrorIs(t, err, ErrInvalidNationalID, raw)
+	}
+}
+
+func TestPassport(t *testing.T) {
+	number, country, err := Passport("aa 1234567", "tha")
+	assert.NoError(t, err)
+	assert.Equal(t, "AA1234567", number)
+	assert.Equal(t, "THA", country)
+
+	_, _, err = Passport("C01X00T47", "D")
+	assert.NoError(t, err)
+
+	_, _, err = Passport("P98765", "")
+	assert.NoError(t, err)
+
+	//Thai passports are letters then digits
+	_, _, err = Passport("123456789", "THA")
+	assert.ErrorIs(t, err, ErrInvalidPassport)
+
+	_, _, err = Passport("AB12", "")
+	assert.ErrorIs(t, err, ErrInvalidPassport)
+
+	_, _, err = Passport("AB123456", "TH")
+	assert.ErrorIs(t, err, ErrInvalidPassportCountry)
+}